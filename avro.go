@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// avroSchema is a parsed Avro schema, see the Avro 1.8 specification. Logical
+// types are ignored, values are encoded according to their underlying type.
+type avroSchema struct {
+	// typ is the name of a primitive type, or one of record, enum, array,
+	// map, union and fixed.
+	typ string
+	// name is the full name of records, enums and fixed types.
+	name string
+
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema // array items and map values
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name       string
+	schema     *avroSchema
+	dflt       interface{}
+	hasDefault bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// readAvroSchema parses str as an inline Avro schema if it looks like JSON,
+// otherwise it reads the schema from the file str names.
+func readAvroSchema(str string) (*avroSchema, error) {
+	s := strings.TrimSpace(str)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") && !strings.HasPrefix(s, `"`) {
+		buf, err := ioutil.ReadFile(str)
+		if err != nil {
+			return nil, err
+		}
+		s = string(buf)
+	}
+	return parseAvroSchema(s)
+}
+
+// parseAvroSchema parses the JSON Avro schema str.
+func parseAvroSchema(str string) (*avroSchema, error) {
+	v, err := decodeJSONNumbers(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema JSON err=%v", err)
+	}
+	p := &avroParser{names: map[string]*avroSchema{}}
+	return p.parse(v, "")
+}
+
+// decodeJSONNumbers decodes the single JSON document str, keeping numbers as
+// json.Number so integers don't lose precision.
+func decodeJSONNumbers(str string) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewBufferString(str))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("more than one document")
+	}
+	return v, nil
+}
+
+type avroParser struct {
+	names map[string]*avroSchema
+}
+
+func (p *avroParser) parse(v interface{}, namespace string) (*avroSchema, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroSchema{typ: v}, nil
+		}
+		if s, ok := p.names[avroFullName(v, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.names[v]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown type %#v", v)
+
+	case []interface{}:
+		s := &avroSchema{typ: "union"}
+		for _, b := range v {
+			bs, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if bs.typ == "union" {
+				return nil, fmt.Errorf("unions may not immediately contain other unions")
+			}
+			s.branches = append(s.branches, bs)
+		}
+		if len(s.branches) == 0 {
+			return nil, fmt.Errorf("empty union")
+		}
+		return s, nil
+
+	case map[string]interface{}:
+		return p.parseComplex(v, namespace)
+
+	default:
+		return nil, fmt.Errorf("invalid schema %v", v)
+	}
+}
+
+func (p *avroParser) parseComplex(v map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, ok := v["type"].(string)
+	if !ok {
+		if t, ok := v["type"]; ok {
+			// e.g. {"type": {"type": "array", "items": "int"}}
+			return p.parse(t, namespace)
+		}
+		return nil, fmt.Errorf("missing type in %v", v)
+	}
+
+	switch typ {
+	case "record", "error", "enum", "fixed":
+	case "array", "map":
+		s := &avroSchema{typ: typ}
+		key := "items"
+		if typ == "map" {
+			key = "values"
+		}
+		t, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("%v is missing %v", typ, key)
+		}
+		var err error
+		if s.items, err = p.parse(t, namespace); err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return p.parse(typ, namespace)
+	}
+
+	name, ok := v["name"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%v is missing a name", typ)
+	}
+	if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	s := &avroSchema{typ: typ, name: avroFullName(name, namespace)}
+	if _, ok := p.names[s.name]; ok {
+		return nil, fmt.Errorf("type %v is defined more than once", s.name)
+	}
+	p.names[s.name] = s
+	if i := strings.LastIndex(s.name, "."); i >= 0 {
+		namespace = s.name[:i]
+	}
+
+	switch typ {
+	case "enum":
+		symbols, ok := v["symbols"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("enum %v is missing symbols", s.name)
+		}
+		for _, sym := range symbols {
+			str, ok := sym.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol %v of enum %v", sym, s.name)
+			}
+			s.symbols = append(s.symbols, str)
+		}
+
+	case "fixed":
+		n, ok := v["size"].(json.Number)
+		size, err := strconv.Atoi(string(n))
+		if !ok || err != nil || size < 0 {
+			return nil, fmt.Errorf("fixed %v needs a non-negative size", s.name)
+		}
+		s.size = size
+
+	default:
+		s.typ = "record"
+		fields, ok := v["fields"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("record %v is missing fields", s.name)
+		}
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid field %v of record %v", f, s.name)
+			}
+			fname, ok := fm["name"].(string)
+			if !ok {
+				return nil, fmt.Errorf("field of record %v is missing a name", s.name)
+			}
+			fs, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, fmt.Errorf("field %v of record %v: %v", fname, s.name, err)
+			}
+			dflt, hasDefault := fm["default"]
+			s.fields = append(s.fields, avroField{name: fname, schema: fs, dflt: dflt, hasDefault: hasDefault})
+		}
+	}
+
+	return s, nil
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroTypeName is the name that selects s as a union branch in Avro's JSON
+// encoding, e.g. {"string": "hans"}.
+func (s *avroSchema) avroTypeName() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.typ
+}
+
+// avroFromJSON encodes the JSON document str as Avro binary data according to
+// schema. Unions accept either a plain value, encoded as the first branch that
+// fits, or Avro's JSON encoding of an object with the branch's type name as
+// its only key. Bytes and fixed values are strings whose code points are the
+// byte values, as in Avro's JSON encoding.
+func avroFromJSON(schema *avroSchema, str string) ([]byte, error) {
+	v, err := decodeJSONNumbers(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON err=%v", err)
+	}
+
+	// non-nil even if empty, e.g. for null, so it's sent as an empty value.
+	buf := bytes.NewBuffer([]byte{})
+	if err := writeAvro(buf, schema, v, ""); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// avroError describes why v doesn't match s at path, which names the field or
+// element within the document.
+func avroError(path string, s *avroSchema, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		buf = []byte(fmt.Sprintf("%v", v))
+	}
+	return avroPathError(path, fmt.Errorf("expected %v, got %s", s.avroTypeName(), buf))
+}
+
+func avroPathError(path string, err error) error {
+	if path == "" {
+		return err
+	}
+	return fmt.Errorf("%v: %v", path, err)
+}
+
+func avroPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	if strings.HasPrefix(elem, "[") {
+		return path + elem
+	}
+	return path + "." + elem
+}
+
+func writeAvro(buf *bytes.Buffer, s *avroSchema, v interface{}, path string) error {
+	switch s.typ {
+	case "null":
+		if v != nil {
+			return avroError(path, s, v)
+		}
+
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+
+	case "int", "long":
+		n, ok := v.(json.Number)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		bits := 64
+		if s.typ == "int" {
+			bits = 32
+		}
+		i, err := strconv.ParseInt(string(n), 10, bits)
+		if err != nil {
+			return avroError(path, s, v)
+		}
+		writeAvroLong(buf, i)
+
+	case "float", "double":
+		n, ok := v.(json.Number)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return avroError(path, s, v)
+		}
+		if s.typ == "float" {
+			binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(f)))
+		} else {
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		}
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		writeAvroLong(buf, int64(len(str)))
+		buf.WriteString(str)
+
+	case "bytes", "fixed":
+		str, ok := v.(string)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		data, err := avroBytes(str)
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		if s.typ == "fixed" {
+			if len(data) != s.size {
+				return avroPathError(path, fmt.Errorf("expected %v bytes for %v, got %v", s.size, s.name, len(data)))
+			}
+		} else {
+			writeAvroLong(buf, int64(len(data)))
+		}
+		buf.Write(data)
+
+	case "enum":
+		str, ok := v.(string)
+		if !ok {
+			return avroError(path, s, v)
+		}
+		for i, sym := range s.symbols {
+			if sym == str {
+				writeAvroLong(buf, int64(i))
+				return nil
+			}
+		}
+		return avroPathError(path, fmt.Errorf("%#v is not a symbol of %v", str, s.name))
+
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return avroError(path, s, v)
+		}
+		if len(a) > 0 {
+			writeAvroLong(buf, int64(len(a)))
+			for i, e := range a {
+				if err := writeAvro(buf, s.items, e, avroPath(path, fmt.Sprintf("[%v]", i))); err != nil {
+					return err
+				}
+			}
+		}
+		buf.WriteByte(0)
+
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return avroError(path, s, v)
+		}
+		if len(m) > 0 {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			writeAvroLong(buf, int64(len(m)))
+			for _, k := range keys {
+				writeAvroLong(buf, int64(len(k)))
+				buf.WriteString(k)
+				if err := writeAvro(buf, s.items, m[k], avroPath(path, k)); err != nil {
+					return err
+				}
+			}
+		}
+		buf.WriteByte(0)
+
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return avroError(path, s, v)
+		}
+		known := map[string]bool{}
+		for _, f := range s.fields {
+			known[f.name] = true
+			fv, ok := m[f.name]
+			fs := f.schema
+			if !ok {
+				if !f.hasDefault {
+					return fmt.Errorf("missing field %v", avroPath(path, f.name))
+				}
+				// defaults of unions are for their first branch.
+				if fs.typ == "union" {
+					writeAvroLong(buf, 0)
+					fs = fs.branches[0]
+				}
+				fv = f.dflt
+			}
+			if err := writeAvro(buf, fs, fv, avroPath(path, f.name)); err != nil {
+				return err
+			}
+		}
+		for k := range m {
+			if !known[k] {
+				return fmt.Errorf("unknown field %v of %v", avroPath(path, k), s.name)
+			}
+		}
+
+	case "union":
+		return writeAvroUnion(buf, s, v, path)
+	}
+
+	return nil
+}
+
+func writeAvroUnion(buf *bytes.Buffer, s *avroSchema, v interface{}, path string) error {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for name, bv := range m {
+			for i, b := range s.branches {
+				if name == b.avroTypeName() || (b.name != "" && name == b.name[strings.LastIndex(b.name, ".")+1:]) {
+					writeAvroLong(buf, int64(i))
+					return writeAvro(buf, b, bv, path)
+				}
+			}
+		}
+	}
+
+	for i, b := range s.branches {
+		var branch bytes.Buffer
+		if err := writeAvro(&branch, b, v, path); err == nil {
+			writeAvroLong(buf, int64(i))
+			buf.Write(branch.Bytes())
+			return nil
+		}
+	}
+
+	names := make([]string, len(s.branches))
+	for i, b := range s.branches {
+		names[i] = b.avroTypeName()
+	}
+	return avroError(path, &avroSchema{typ: "one of " + strings.Join(names, ", ")}, v)
+}
+
+// avroBytes converts a string of Avro's JSON encoding of bytes, where each
+// code point is a byte value, to the bytes.
+func avroBytes(str string) ([]byte, error) {
+	data := make([]byte, 0, len(str))
+	for _, r := range str {
+		if r > 0xff {
+			return nil, fmt.Errorf("invalid byte %U, bytes are strings of code points up to U+00FF", r)
+		}
+		data = append(data, byte(r))
+	}
+	return data, nil
+}
+
+// writeAvroLong writes n zig-zag encoded as a variable-length integer.
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+// avroToJSON decodes the single Avro datum in data according to schema to
+// JSON, the inverse of avroFromJSON: unions become the plain value of their
+// branch, bytes and fixed values strings whose code points are the byte
+// values, and record fields keep the schema's order.
+func avroToJSON(schema *avroSchema, data []byte) (json.RawMessage, error) {
+	r := &avroReader{data: data}
+	buf := &bytes.Buffer{}
+	if err := r.read(buf, schema, ""); err != nil {
+		return nil, err
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("unexpected %v bytes after Avro data", len(data)-r.pos)
+	}
+	return json.RawMessage(buf.Bytes()), nil
+}
+
+type avroReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *avroReader) next(n int64) ([]byte, error) {
+	if n < 0 || int64(len(r.data)-r.pos) < n {
+		return nil, fmt.Errorf("unexpected end of Avro data at byte %v", r.pos)
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *avroReader) long() (int64, error) {
+	n, size := binary.Varint(r.data[r.pos:])
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid long at byte %v", r.pos)
+	}
+	r.pos += size
+	return n, nil
+}
+
+// count reads the item count of an array or map block. Negative counts are
+// followed by the block's size in bytes, which isn't needed.
+func (r *avroReader) count() (int64, error) {
+	n, err := r.long()
+	if err != nil || n >= 0 {
+		return n, err
+	}
+	if _, err := r.long(); err != nil {
+		return 0, err
+	}
+	return -n, nil
+}
+
+func (r *avroReader) read(buf *bytes.Buffer, s *avroSchema, path string) error {
+	at := r.pos
+
+	switch s.typ {
+	case "null":
+		buf.WriteString("null")
+
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		switch b[0] {
+		case 0:
+			buf.WriteString("false")
+		case 1:
+			buf.WriteString("true")
+		default:
+			return avroPathError(path, fmt.Errorf("invalid boolean %v at byte %v", b[0], at))
+		}
+
+	case "int", "long":
+		n, err := r.long()
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		if s.typ == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return avroPathError(path, fmt.Errorf("int %v out of range at byte %v", n, at))
+		}
+		buf.WriteString(strconv.FormatInt(n, 10))
+
+	case "float", "double":
+		var f float64
+		bits := 64
+		if s.typ == "float" {
+			b, err := r.next(4)
+			if err != nil {
+				return avroPathError(path, err)
+			}
+			f, bits = float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32
+		} else {
+			b, err := r.next(8)
+			if err != nil {
+				return avroPathError(path, err)
+			}
+			f = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return avroPathError(path, fmt.Errorf("unsupported %v %v, not a valid JSON number", s.typ, f))
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+
+	case "string", "bytes", "fixed":
+		size := int64(s.size)
+		if s.typ != "fixed" {
+			var err error
+			if size, err = r.long(); err != nil {
+				return avroPathError(path, err)
+			}
+		}
+		data, err := r.next(size)
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		str := string(data)
+		if s.typ != "string" {
+			runes := make([]rune, len(data))
+			for i, b := range data {
+				runes[i] = rune(b)
+			}
+			str = string(runes)
+		}
+		writeJSONString(buf, str)
+
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		if i < 0 || i >= int64(len(s.symbols)) {
+			return avroPathError(path, fmt.Errorf("invalid index %v of enum %v at byte %v", i, s.name, at))
+		}
+		writeJSONString(buf, s.symbols[i])
+
+	case "array", "map":
+		start, end := "[", "]"
+		if s.typ == "map" {
+			start, end = "{", "}"
+		}
+		buf.WriteString(start)
+		for i := 0; ; {
+			n, err := r.count()
+			if err != nil {
+				return avroPathError(path, err)
+			}
+			if n == 0 {
+				break
+			}
+			if s.items.typ != "null" && n > int64(len(r.data)-r.pos) {
+				return avroPathError(path, fmt.Errorf("invalid block count %v at byte %v", n, at))
+			}
+			for ; n > 0; n-- {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				elem := fmt.Sprintf("[%v]", i)
+				if s.typ == "map" {
+					size, err := r.long()
+					if err != nil {
+						return avroPathError(path, err)
+					}
+					key, err := r.next(size)
+					if err != nil {
+						return avroPathError(path, err)
+					}
+					writeJSONString(buf, string(key))
+					buf.WriteString(":")
+					elem = string(key)
+				}
+				if err := r.read(buf, s.items, avroPath(path, elem)); err != nil {
+					return err
+				}
+				i++
+			}
+		}
+		buf.WriteString(end)
+
+	case "record":
+		buf.WriteString("{")
+		for i, f := range s.fields {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeJSONString(buf, f.name)
+			buf.WriteString(":")
+			if err := r.read(buf, f.schema, avroPath(path, f.name)); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return avroPathError(path, err)
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return avroPathError(path, fmt.Errorf("invalid union index %v at byte %v", i, at))
+		}
+		return r.read(buf, s.branches[i], path)
+	}
+
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, str string) {
+	b, _ := json.Marshal(str)
+	buf.Write(b)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testUserSchema = `{
+	"type": "record",
+	"name": "User",
+	"namespace": "kt.test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": "string"},
+		{"name": "email", "type": ["null", "string"], "default": null},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []},
+		{"name": "role", "type": {"type": "enum", "name": "Role", "symbols": ["admin", "user"]}, "default": "user"},
+		{"name": "manager", "type": ["null", "User"], "default": null}
+	]
+}`
+
+func TestAvroFromJSON(t *testing.T) {
+	schema, err := parseAvroSchema(testUserSchema)
+	require.NoError(t, err)
+
+	data := []struct {
+		input    string
+		expected []byte
+	}{
+		{
+			input:    `{"id": 1, "name": "a"}`,
+			expected: []byte{0x02, 0x02, 'a', 0x00, 0x00, 0x02, 0x00},
+		},
+		{
+			input:    `{"id": -2, "name": "", "email": "x", "tags": ["b", "c"], "role": "admin"}`,
+			expected: []byte{0x03, 0x00, 0x02, 0x02, 'x', 0x04, 0x02, 'b', 0x02, 'c', 0x00, 0x00, 0x00},
+		},
+		{
+			input:    `{"id": 1, "name": "a", "email": {"string": "x"}, "manager": {"id": 2, "name": "b"}}`,
+			expected: []byte{0x02, 0x02, 'a', 0x02, 0x02, 'x', 0x00, 0x02, 0x02, 0x04, 0x02, 'b', 0x00, 0x00, 0x02, 0x00},
+		},
+	}
+
+	for _, d := range data {
+		actual, err := avroFromJSON(schema, d.input)
+		require.NoError(t, err, d.input)
+		require.Equal(t, d.expected, actual, d.input)
+	}
+}
+
+func TestAvroFromJSONPrimitives(t *testing.T) {
+	data := []struct {
+		schema   string
+		input    string
+		expected []byte
+	}{
+		{schema: `"null"`, input: `null`, expected: []byte{}},
+		{schema: `"boolean"`, input: `true`, expected: []byte{1}},
+		{schema: `"int"`, input: `64`, expected: []byte{0x80, 0x01}},
+		{schema: `"float"`, input: `1`, expected: []byte{0x00, 0x00, 0x80, 0x3f}},
+		{schema: `"double"`, input: `-2`, expected: []byte{0, 0, 0, 0, 0, 0, 0, 0xc0}},
+		{schema: `"bytes"`, input: `"\u0000ÿ"`, expected: []byte{0x04, 0x00, 0xff}},
+		{schema: `{"type": "fixed", "name": "Two", "size": 2}`, input: `"ab"`, expected: []byte{'a', 'b'}},
+		{schema: `{"type": "map", "values": "int"}`, input: `{"b": 2, "a": 1}`, expected: []byte{0x04, 0x02, 'a', 0x02, 0x02, 'b', 0x04, 0x00}},
+		{schema: `{"type": "int", "logicalType": "date"}`, input: `1`, expected: []byte{0x02}},
+	}
+
+	for _, d := range data {
+		schema, err := parseAvroSchema(d.schema)
+		require.NoError(t, err, d.schema)
+		actual, err := avroFromJSON(schema, d.input)
+		require.NoError(t, err, d.schema)
+		require.Equal(t, d.expected, actual, d.schema)
+	}
+}
+
+func TestAvroFromJSONErrors(t *testing.T) {
+	schema, err := parseAvroSchema(testUserSchema)
+	require.NoError(t, err)
+
+	data := []struct {
+		input    string
+		expected string
+	}{
+		{input: `{"name": "a"}`, expected: "missing field id"},
+		{input: `{"id": "1", "name": "a"}`, expected: `id: expected long, got "1"`},
+		{input: `{"id": 1.5, "name": "a"}`, expected: `id: expected long, got 1.5`},
+		{input: `{"id": 1, "name": "a", "role": "boss"}`, expected: `role: "boss" is not a symbol of kt.test.Role`},
+		{input: `{"id": 1, "name": "a", "tags": [1]}`, expected: `tags[0]: expected string, got 1`},
+		{input: `{"id": 1, "name": "a", "extra": 1}`, expected: "unknown field extra of kt.test.User"},
+		{input: `{"id": 1, "name": "a", "email": 1}`, expected: "email: expected one of null, string, got 1"},
+		{input: `{"id": 1, "name": "a", "manager": {"id": 2}}`, expected: "expected one of null, kt.test.User"},
+		{input: `[]`, expected: "expected kt.test.User, got []"},
+		{input: `{`, expected: "invalid JSON"},
+	}
+
+	for _, d := range data {
+		_, err := avroFromJSON(schema, d.input)
+		require.Error(t, err, d.input)
+		require.Contains(t, err.Error(), d.expected, d.input)
+	}
+}
+
+func TestParseAvroSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`"nope"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "A"}`,
+		`{"type": "enum", "name": "E"}`,
+		`{"type": "fixed", "name": "F"}`,
+		`{"type": "array"}`,
+		`["null", ["int"]]`,
+		`[]`,
+		`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "B"}]}`,
+		`not json`,
+	} {
+		_, err := parseAvroSchema(schema)
+		require.Error(t, err, schema)
+	}
+}
+
+func TestAvroToJSON(t *testing.T) {
+	schema, err := parseAvroSchema(testUserSchema)
+	require.NoError(t, err)
+
+	for _, input := range []string{
+		`{"id":1,"name":"a","email":null,"tags":[],"role":"user","manager":null}`,
+		`{"id":-2,"name":"","email":"x","tags":["b","c"],"role":"admin","manager":null}`,
+		`{"id":1,"name":"a","email":"x","tags":[],"role":"user","manager":{"id":2,"name":"b","email":null,"tags":[],"role":"user","manager":null}}`,
+	} {
+		data, err := avroFromJSON(schema, input)
+		require.NoError(t, err, input)
+		actual, err := avroToJSON(schema, data)
+		require.NoError(t, err, input)
+		require.Equal(t, input, string(actual))
+	}
+}
+
+func TestAvroToJSONPrimitives(t *testing.T) {
+	data := []struct {
+		schema   string
+		input    []byte
+		expected string
+	}{
+		{schema: `"null"`, input: []byte{}, expected: `null`},
+		{schema: `"boolean"`, input: []byte{1}, expected: `true`},
+		{schema: `"int"`, input: []byte{0x80, 0x01}, expected: `64`},
+		{schema: `"float"`, input: []byte{0x00, 0x00, 0xc0, 0x3f}, expected: `1.5`},
+		{schema: `"double"`, input: []byte{0, 0, 0, 0, 0, 0, 0, 0xc0}, expected: `-2`},
+		{schema: `"bytes"`, input: []byte{0x04, 0x00, 0xff}, expected: `"\u0000ÿ"`},
+		{schema: `{"type": "fixed", "name": "Two", "size": 2}`, input: []byte{'a', 'b'}, expected: `"ab"`},
+		{schema: `{"type": "map", "values": "int"}`, input: []byte{0x04, 0x02, 'a', 0x02, 0x02, 'b', 0x04, 0x00}, expected: `{"a":1,"b":2}`},
+		// a block with a negative count is followed by its size in bytes.
+		{schema: `{"type": "array", "items": "int"}`, input: []byte{0x03, 0x04, 0x02, 0x04, 0x00}, expected: `[1,2]`},
+	}
+
+	for _, d := range data {
+		schema, err := parseAvroSchema(d.schema)
+		require.NoError(t, err, d.schema)
+		actual, err := avroToJSON(schema, d.input)
+		require.NoError(t, err, d.schema)
+		require.Equal(t, d.expected, string(actual), d.schema)
+	}
+}
+
+func TestAvroToJSONErrors(t *testing.T) {
+	schema, err := parseAvroSchema(testUserSchema)
+	require.NoError(t, err)
+
+	data := []struct {
+		input    []byte
+		expected string
+	}{
+		{input: []byte{}, expected: "id: invalid long at byte 0"},
+		{input: []byte{0x02, 0x0a, 'a'}, expected: "name: unexpected end of Avro data at byte 2"},
+		{input: []byte{0x02, 0x02, 'a', 0x04}, expected: "email: invalid union index 2 at byte 3"},
+		{input: []byte{0x02, 0x02, 'a', 0x00, 0x00, 0x08, 0x00}, expected: "role: invalid index 4 of enum kt.test.Role at byte 5"},
+		{input: []byte{0x02, 0x02, 'a', 0x00, 0x00, 0x02, 0x00, 0x00}, expected: "unexpected 1 bytes after Avro data"},
+	}
+
+	for _, d := range data {
+		_, err := avroToJSON(schema, d.input)
+		require.Error(t, err, d.expected)
+		require.Equal(t, d.expected, err.Error())
+	}
+}
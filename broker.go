@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+type brokerArgs struct {
+	brokers     string
+	apiVersions bool
+	verbose     bool
+	pretty      bool
+	color       string
+	version     string
+	tls         tlsArgs
+}
+
+type brokerCmd struct {
+	brokers     []string
+	apiVersions bool
+	verbose     bool
+	pretty      bool
+	color       bool
+	version     sarama.KafkaVersion
+	tlsConfig   *tls.Config
+
+	client sarama.Client
+}
+
+type brokerInfo struct {
+	Address     string       `json:"address"`
+	APIVersions []apiVersion `json:"apiVersions,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+type apiVersion struct {
+	Key  int16  `json:"key"`
+	Name string `json:"name"`
+	Min  int16  `json:"min"`
+	Max  int16  `json:"max"`
+}
+
+// apiNames are the names of the Kafka protocol's API keys, as listed in the
+// protocol guide.
+var apiNames = []string{
+	"Produce", "Fetch", "ListOffsets", "Metadata", "LeaderAndIsr",
+	"StopReplica", "UpdateMetadata", "ControlledShutdown", "OffsetCommit", "OffsetFetch",
+	"FindCoordinator", "JoinGroup", "Heartbeat", "LeaveGroup", "SyncGroup",
+	"DescribeGroups", "ListGroups", "SaslHandshake", "ApiVersions", "CreateTopics",
+	"DeleteTopics", "DeleteRecords", "InitProducerId", "OffsetForLeaderEpoch", "AddPartitionsToTxn",
+	"AddOffsetsToTxn", "EndTxn", "WriteTxnMarkers", "TxnOffsetCommit", "DescribeAcls",
+	"CreateAcls", "DeleteAcls", "DescribeConfigs", "AlterConfigs", "AlterReplicaLogDirs",
+	"DescribeLogDirs", "SaslAuthenticate", "CreatePartitions", "CreateDelegationToken", "RenewDelegationToken",
+	"ExpireDelegationToken", "DescribeDelegationToken", "DeleteGroups", "ElectLeaders", "IncrementalAlterConfigs",
+	"AlterPartitionReassignments", "ListPartitionReassignments", "OffsetDelete", "DescribeClientQuotas", "AlterClientQuotas",
+	"DescribeUserScramCredentials", "AlterUserScramCredentials", "Vote", "BeginQuorumEpoch", "EndQuorumEpoch",
+	"DescribeQuorum", "AlterPartition", "UpdateFeatures", "Envelope", "FetchSnapshot",
+	"DescribeCluster", "DescribeProducers", "BrokerRegistration", "BrokerHeartbeat", "UnregisterBroker",
+	"DescribeTransactions", "ListTransactions", "AllocateProducerIds", "ConsumerGroupHeartbeat",
+}
+
+// apiName returns the name of API key, or Unknown followed by the key for
+// keys newer than apiNames.
+func apiName(key int16) string {
+	if key >= 0 && int(key) < len(apiNames) {
+		return apiNames[key]
+	}
+	return "Unknown" + strconv.Itoa(int(key))
+}
+
+// newAPIVersions returns the API versions of blocks ordered by key.
+func newAPIVersions(blocks []*sarama.ApiVersionsResponseBlock) []apiVersion {
+	result := make([]apiVersion, 0, len(blocks))
+	for _, b := range blocks {
+		result = append(result, apiVersion{Key: b.ApiKey, Name: apiName(b.ApiKey), Min: b.MinVersion, Max: b.MaxVersion})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func (cmd *brokerCmd) parseFlags(as []string) brokerArgs {
+	var (
+		args  brokerArgs
+		flags = flag.NewFlagSet("broker", flag.ExitOnError)
+	)
+
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.BoolVar(&args.apiVersions, "api-versions", false, "Include the min and max version of each API the broker supports.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+	addColorFlag(flags, &args.color)
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version, or auto to probe the brokers for it (defaults to v0.10.0.0).")
+	addTLSFlags(flags, &args.tls)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of broker:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, brokerDocString+tlsDocString)
+		os.Exit(2)
+	}
+
+	flags.Parse(as)
+	return args
+}
+
+func (cmd *brokerCmd) failStartup(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	failf("use \"kt broker -help\" for more information")
+}
+
+func (cmd *brokerCmd) parseArgs(as []string) {
+	var (
+		err  error
+		args = cmd.parseFlags(as)
+	)
+
+	if args.brokers == "" {
+		args.brokers = os.Getenv("KT_BROKERS")
+	}
+	if args.brokers == "" {
+		args.brokers = "localhost:9092"
+	}
+	if cmd.brokers, err = parseBrokers(args.brokers); err != nil {
+		cmd.failStartup(err.Error())
+	}
+
+	cmd.apiVersions = args.apiVersions
+	cmd.verbose = args.verbose
+	cmd.pretty = args.pretty
+	if cmd.color, err = resolveColor(args.color); err != nil {
+		cmd.failStartup(err.Error())
+	}
+
+	if cmd.tlsConfig, err = newTLSConfig(args.tls); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	cmd.version = resolveKafkaVersion(args.version, cmd.brokers, cmd.tlsConfig)
+}
+
+func (cmd *brokerCmd) connect() {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-broker-" + sanitizeUsername(usr.Username)
+	applyTLS(cfg, cmd.tlsConfig)
+	if cmd.verbose {
+		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
+	}
+
+	if cmd.client, err = sarama.NewClient(cmd.brokers, cfg); err != nil {
+		failf("failed to create client err=%v", err)
+	}
+}
+
+func (cmd *brokerCmd) run(as []string) {
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	cmd.connect()
+	defer logClose("client", cmd.client)
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		out    = make(chan printContext)
+		result = map[int32]brokerInfo{}
+	)
+
+	go print(out, cmd.pretty, cmd.color)
+
+	for _, b := range cmd.client.Brokers() {
+		wg.Add(1)
+		go func(b *sarama.Broker) {
+			defer wg.Done()
+			info := cmd.readBroker(b)
+			mu.Lock()
+			result[b.ID()] = info
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+
+	ctx := printContext{output: result, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+// readBroker returns the information for b, connecting to it first if it
+// needs to ask the broker itself. Errors are reported in the result.
+func (cmd *brokerCmd) readBroker(b *sarama.Broker) brokerInfo {
+	info := brokerInfo{Address: b.Addr()}
+	if !cmd.apiVersions {
+		return info
+	}
+
+	if ok, _ := b.Connected(); !ok {
+		if err := b.Open(cmd.client.Config()); err != nil && err != sarama.ErrAlreadyConnected {
+			info.Error = err.Error()
+			return info
+		}
+	}
+
+	res, err := b.ApiVersions(&sarama.ApiVersionsRequest{})
+	switch {
+	case err != nil:
+		info.Error = err.Error()
+	case res.Err != sarama.ErrNoError:
+		info.Error = res.Err.Error()
+	default:
+		info.APIVersions = newAPIVersions(res.ApiVersions)
+	}
+	return info
+}
+
+var brokerDocString = `
+The value for -brokers can also be set via the environment variable KT_BROKERS.
+The value supplied on the command line wins over the environment variable value.
+
+The broker command prints the brokers of the cluster keyed by their id:
+
+  $ kt broker
+  {
+    "1": {
+      "address": "kafka-1:9092"
+    },
+    "2": {
+      "address": "kafka-2:9092"
+    }
+  }
+
+With -api-versions kt asks each broker for the versions of the APIs it
+supports, via the ApiVersions request, and lists the min and max version per
+API key and name. This shows why a feature isn't available, and whether
+brokers differ mid-way through a rolling upgrade:
+
+  $ kt broker -api-versions -pretty=false
+  {"1":{"address":"kafka-1:9092","apiVersions":[{"key":0,"name":"Produce","min":0,"max":2},...]},...}
+
+Brokers before v0.10.0.0 don't support ApiVersions, their error is included
+instead.
+`
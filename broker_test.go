@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIName(t *testing.T) {
+	require.Equal(t, "Produce", apiName(0))
+	require.Equal(t, "ApiVersions", apiName(18))
+	require.Equal(t, "DescribeConfigs", apiName(32))
+	require.Equal(t, "Unknown1000", apiName(1000))
+	require.Equal(t, "Unknown-1", apiName(-1))
+}
+
+func TestNewAPIVersions(t *testing.T) {
+	blocks := []*sarama.ApiVersionsResponseBlock{
+		{ApiKey: 18, MinVersion: 0, MaxVersion: 1},
+		{ApiKey: 0, MinVersion: 0, MaxVersion: 3},
+		{ApiKey: 3, MinVersion: 0, MaxVersion: 5},
+	}
+	expected := []apiVersion{
+		{Key: 0, Name: "Produce", Min: 0, Max: 3},
+		{Key: 3, Name: "Metadata", Min: 0, Max: 5},
+		{Key: 18, Name: "ApiVersions", Min: 0, Max: 1},
+	}
+	require.Equal(t, expected, newAPIVersions(blocks))
+}
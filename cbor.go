@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// CBOR major types, see RFC 7049 section 2.1.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// cborFromJSON encodes the JSON document str as CBOR. Integers are encoded as
+// CBOR integers, other numbers as 64-bit floats and map keys in sorted order,
+// so equal documents encode to equal bytes.
+func cborFromJSON(str string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewBufferString(str))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON err=%v", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("invalid JSON, more than one document")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeCBOR(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			buf.WriteByte(cborSimple<<5 | 21)
+		} else {
+			buf.WriteByte(cborSimple<<5 | 20)
+		}
+	case json.Number:
+		return writeCBORNumber(buf, v)
+	case string:
+		writeCBORHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := writeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeCBORHead(buf, cborMap, uint64(len(v)))
+		for _, k := range keys {
+			writeCBORHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := writeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported JSON value %#v", v)
+	}
+	return nil
+}
+
+func writeCBORNumber(buf *bytes.Buffer, n json.Number) error {
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		writeCBORHead(buf, cborUint, u)
+		return nil
+	}
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		writeCBORHead(buf, cborNegInt, uint64(-1-i))
+		return nil
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("invalid number %v err=%v", n, err)
+	}
+	buf.WriteByte(cborSimple<<5 | 27)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	return nil
+}
+
+// writeCBORHead writes the initial byte of a data item of major type major,
+// followed by n in the fewest bytes that hold it.
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// cborToJSON decodes the single CBOR data item in data to JSON. Byte strings
+// become base64url strings as suggested by RFC 7049 section 4.1, tags are
+// dropped and undefined becomes null. Map keys have to be text strings, and
+// floats that aren't valid JSON numbers, such as NaN, are rejected.
+func cborToJSON(data []byte) (string, error) {
+	r := &cborReader{data: data}
+	v, err := r.read()
+	if err != nil {
+		return "", err
+	}
+	if r.pos != len(data) {
+		return "", fmt.Errorf("unexpected %v bytes after CBOR data item", len(data)-r.pos)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+// errCBORBreak is returned by read for the break stop code that ends
+// indefinite length items.
+var errCBORBreak = fmt.Errorf("unexpected CBOR break")
+
+func (r *cborReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, fmt.Errorf("unexpected end of CBOR data at byte %v", r.pos)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// head reads the initial byte of a data item and its argument. For
+// indefinite lengths info is cborIndefinite and arg is 0.
+func (r *cborReader) head() (major byte, info byte, arg uint64, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if b, err = r.next(size); err != nil {
+			return 0, 0, 0, err
+		}
+		for _, x := range b {
+			arg = arg<<8 | uint64(x)
+		}
+		return major, info, arg, nil
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid CBOR additional information %v at byte %v", info, r.pos-1)
+	}
+}
+
+func (r *cborReader) read() (interface{}, error) {
+	if r.pos < len(r.data) && r.data[r.pos] == cborBreak {
+		r.pos++
+		return nil, errCBORBreak
+	}
+
+	major, info, arg, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+
+	switch major {
+	case cborUint:
+		if indefinite {
+			return nil, fmt.Errorf("invalid indefinite length integer at byte %v", r.pos-1)
+		}
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+
+	case cborNegInt:
+		if indefinite {
+			return nil, fmt.Errorf("invalid indefinite length integer at byte %v", r.pos-1)
+		}
+		if arg <= math.MaxInt64 {
+			return json.Number(strconv.FormatInt(-1-int64(arg), 10)), nil
+		}
+		n := new(big.Int).SetUint64(arg)
+		return json.Number(n.Neg(n.Add(n, big.NewInt(1))).String()), nil
+
+	case cborBytes, cborText:
+		data, err := r.readString(major, indefinite, arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return base64.RawURLEncoding.EncodeToString(data), nil
+		}
+		return string(data), nil
+
+	case cborArray:
+		result := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			v, err := r.read()
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, nil
+
+	case cborMap:
+		result := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := r.read()
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported CBOR map key %v, only text strings are supported", k)
+			}
+			if result[key], err = r.read(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+
+	case cborTag:
+		return r.read()
+
+	default: // cborSimple
+		return r.readSimple(info, arg)
+	}
+}
+
+// readString reads the content of a byte or text string, concatenating the
+// chunks of indefinite length strings.
+func (r *cborReader) readString(major byte, indefinite bool, n uint64) ([]byte, error) {
+	if !indefinite {
+		if n > uint64(len(r.data)) {
+			return nil, fmt.Errorf("unexpected end of CBOR data at byte %v", r.pos)
+		}
+		return r.next(int(n))
+	}
+
+	var result []byte
+	for {
+		if r.pos < len(r.data) && r.data[r.pos] == cborBreak {
+			r.pos++
+			return result, nil
+		}
+		m, info, arg, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == cborIndefinite {
+			return nil, fmt.Errorf("invalid chunk in indefinite length CBOR string at byte %v", r.pos-1)
+		}
+		chunk, err := r.readString(major, false, arg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk...)
+	}
+}
+
+func (r *cborReader) readSimple(info byte, arg uint64) (interface{}, error) {
+	var f float64
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		f = float64(halfToFloat32(uint16(arg)))
+	case 26:
+		f = float64(math.Float32frombits(uint32(arg)))
+	case 27:
+		f = math.Float64frombits(arg)
+	default:
+		return nil, fmt.Errorf("unsupported CBOR simple value %v at byte %v", arg, r.pos-1)
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("unsupported CBOR float %v, not a valid JSON number", f)
+	}
+	return f, nil
+}
+
+// halfToFloat32 converts an IEEE 754 half-precision float to a float32.
+func halfToFloat32(h uint16) float32 {
+	var (
+		sign     = uint32(h>>15) << 31
+		exponent = uint32(h>>10) & 0x1f
+		mantissa = uint32(h) & 0x3ff
+	)
+
+	switch exponent {
+	case 0:
+		// zero or subnormal, the value is mantissa * 2^-24.
+		f := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mantissa<<13)
+	default:
+		return math.Float32frombits(sign | (exponent+127-15)<<23 | mantissa<<13)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCBORFromJSON(t *testing.T) {
+	data := []struct {
+		in       string
+		expected string
+	}{
+		// examples from RFC 7049 appendix A
+		{in: `0`, expected: "00"},
+		{in: `23`, expected: "17"},
+		{in: `24`, expected: "1818"},
+		{in: `1000000`, expected: "1a000f4240"},
+		{in: `18446744073709551615`, expected: "1bffffffffffffffff"},
+		{in: `-1`, expected: "20"},
+		{in: `-1000`, expected: "3903e7"},
+		{in: `1.1`, expected: "fb3ff199999999999a"},
+		{in: `false`, expected: "f4"},
+		{in: `true`, expected: "f5"},
+		{in: `null`, expected: "f6"},
+		{in: `""`, expected: "60"},
+		{in: `"IETF"`, expected: "6449455446"},
+		{in: `"ü"`, expected: "62c3bc"},
+		{in: `[1, [2, 3], [4, 5]]`, expected: "8301820203820405"},
+		{in: `{"b": [2, 3], "a": 1}`, expected: "a26161016162820203"},
+	}
+
+	for _, d := range data {
+		actual, err := cborFromJSON(d.in)
+		require.NoError(t, err, d.in)
+		require.Equal(t, d.expected, hex.EncodeToString(actual), d.in)
+	}
+
+	for _, in := range []string{``, `{"a":`, `1 2`, `nope`} {
+		_, err := cborFromJSON(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestCBORToJSON(t *testing.T) {
+	data := []struct {
+		in       string
+		expected string
+	}{
+		{in: "00", expected: `0`},
+		{in: "1bffffffffffffffff", expected: `18446744073709551615`},
+		{in: "3bffffffffffffffff", expected: `-18446744073709551616`},
+		{in: "3903e7", expected: `-1000`},
+		{in: "f93e00", expected: `1.5`},
+		{in: "f90400", expected: `0.00006103515625`},
+		{in: "f90001", expected: `5.960464477539063e-8`},
+		{in: "fa47c35000", expected: `100000`},
+		{in: "fb3ff199999999999a", expected: `1.1`},
+		{in: "f7", expected: `null`},
+		{in: "4401020304", expected: `"AQIDBA"`},
+		{in: "6449455446", expected: `"IETF"`},
+		{in: "c074323031332d30332d32315432303a30343a30305a", expected: `"2013-03-21T20:04:00Z"`},
+		{in: "7f657374726561646d696e67ff", expected: `"streaming"`},
+		{in: "9f018202039f0405ffff", expected: `[1,[2,3],[4,5]]`},
+		{in: "bf61610161629f0203ffff", expected: `{"a":1,"b":[2,3]}`},
+		{in: "a1613c613e", expected: `{"<":">"}`},
+	}
+
+	for _, d := range data {
+		in, err := hex.DecodeString(d.in)
+		require.NoError(t, err)
+		actual, err := cborToJSON(in)
+		require.NoError(t, err, d.in)
+		require.Equal(t, d.expected, actual, d.in)
+	}
+
+	invalid := []string{
+		"",           // no data item
+		"18",         // missing argument
+		"62c3",       // short text string
+		"0000",       // trailing data
+		"8201",       // short array
+		"a10102",     // integer map key
+		"f97e00",     // NaN
+		"1c",         // reserved additional information
+		"ff",         // break outside of indefinite item
+		"7f4161ff",   // byte string chunk in text string
+		"5bffffffff", // length beyond data
+	}
+	for _, d := range invalid {
+		in, err := hex.DecodeString(d)
+		require.NoError(t, err)
+		_, err = cborToJSON(in)
+		require.Error(t, err, d)
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		`{"device":"sensor-7","readings":[21.5,-3,0],"ok":true,"meta":null}`,
+		`[]`,
+		`{}`,
+		`"plain"`,
+		`-9223372036854775808`,
+	} {
+		encoded, err := cborFromJSON(in)
+		require.NoError(t, err, in)
+		actual, err := cborToJSON(encoded)
+		require.NoError(t, err, in)
+		require.JSONEq(t, in, actual)
+	}
+}
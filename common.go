@@ -2,14 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode/utf16"
@@ -28,6 +37,8 @@ func listenForInterrupt(q chan struct{}) {
 	signal.Notify(signals, os.Kill, os.Interrupt)
 	sig := <-signals
 	fmt.Fprintf(os.Stderr, "received signal %s\n", sig)
+	// restore the default handling, so a second signal exits immediately.
+	signal.Stop(signals)
 	close(q)
 }
 
@@ -56,22 +67,121 @@ func kafkaVersion(s string) sarama.KafkaVersion {
 		return dflt
 	}
 
-	failf("unsupported kafka version %#v - supported: v0.8.2.0, v0.8.2.1, v0.8.2.2, v0.9.0.0, v0.9.0.1, v0.10.0.0, v0.10.0.1, v0.10.1.0, v0.10.2.0", s)
+	failf("unsupported kafka version %#v - supported: auto, v0.8.2.0, v0.8.2.1, v0.8.2.2, v0.9.0.0, v0.9.0.1, v0.10.0.0, v0.10.0.1, v0.10.1.0, v0.10.2.0", s)
 	return dflt
 }
 
+const (
+	kafkaOffsetStorage     = "kafka"
+	zookeeperOffsetStorage = "zookeeper"
+)
+
+// offsetStorageVersion returns the version of the OffsetFetch and OffsetCommit
+// requests that read and commit group offsets in storage. Brokers keep the
+// offsets of version 0 requests in ZooKeeper, and those of later versions in
+// Kafka itself, which requires v0.8.2.0 or later.
+func offsetStorageVersion(storage string, version sarama.KafkaVersion) (int16, error) {
+	switch storage {
+	case zookeeperOffsetStorage:
+		return 0, nil
+	case kafkaOffsetStorage, "":
+		if !version.IsAtLeast(sarama.V0_8_2_0) {
+			return 0, fmt.Errorf("kafka offset storage requires -version v0.8.2.0 or later, use -offset-storage zookeeper for older clusters")
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unsupported offset storage %#v - supported: kafka, zookeeper", storage)
+}
+
+const defaultBrokerPort = "9092"
+
+// parseBrokers parses a comma separated list of broker addresses. Entries may
+// be surrounded by whitespace, IPv6 addresses may be given in brackets, and
+// the port defaults to 9092 when omitted. Duplicate entries are dropped.
+func parseBrokers(s string) ([]string, error) {
+	var (
+		result []string
+		seen   = map[string]struct{}{}
+	)
+
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+
+		addr, err := parseBroker(b)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			result = append(result, addr)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no brokers found in %#v", s)
+	}
+
+	return result, nil
+}
+
+func parseBroker(b string) (string, error) {
+	host, port := b, defaultBrokerPort
+
+	switch {
+	case strings.HasPrefix(b, "["):
+		end := strings.Index(b, "]")
+		if end < 0 {
+			return "", fmt.Errorf("invalid broker %#v, missing closing bracket", b)
+		}
+		host = b[1:end]
+		switch rest := b[end+1:]; {
+		case rest == "":
+		case strings.HasPrefix(rest, ":"):
+			port = rest[1:]
+		default:
+			return "", fmt.Errorf("invalid broker %#v, unexpected %#v after address", b, rest)
+		}
+	case strings.Count(b, ":") > 1:
+		if net.ParseIP(b) == nil {
+			return "", fmt.Errorf("invalid broker %#v, IPv6 addresses with a port must be in brackets", b)
+		}
+	case strings.Contains(b, ":"):
+		i := strings.LastIndex(b, ":")
+		host, port = b[:i], b[i+1:]
+	}
+
+	if host == "" || strings.ContainsAny(host, " \t/[]") {
+		return "", fmt.Errorf("invalid broker %#v, invalid host %#v", b, host)
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid broker %#v, invalid port %#v", b, port)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
 func logClose(name string, c io.Closer) {
 	if err := c.Close(); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to close %#v err=%v", name, err)
 	}
 }
 
+// rawOutput is written to stdout as is, rather than marshaled as JSON.
+type rawOutput []byte
+
 type printContext struct {
 	output interface{}
 	done   chan struct{}
 }
 
-func print(in <-chan printContext, pretty bool) {
+// print writes the outputs sent on in to stdout. color is the resolved -color
+// setting, for output that highlights parts of it with ANSI escape codes; none
+// of kt's output does so far, so it's never colored.
+func print(in <-chan printContext, pretty, color bool) {
 	var (
 		buf     []byte
 		err     error
@@ -84,6 +194,12 @@ func print(in <-chan printContext, pretty bool) {
 
 	for {
 		ctx := <-in
+		if raw, ok := ctx.output.(rawOutput); ok {
+			os.Stdout.Write(raw)
+			close(ctx.done)
+			continue
+		}
+
 		if buf, err = marshal(ctx.output); err != nil {
 			failf("failed to marshal output %#v, err=%v", ctx.output, err)
 		}
@@ -93,23 +209,318 @@ func print(in <-chan printContext, pretty bool) {
 	}
 }
 
+func addColorFlag(flags *flag.FlagSet, mode *string) {
+	flags.StringVar(mode, "color", "auto", "Color output (auto|always|never), auto colors output to a terminal unless NO_COLOR is set.")
+}
+
+// resolveColor returns whether output should be colored for the -color mode.
+// auto follows https://no-color.org: no colors when NO_COLOR is set to
+// anything, or when stdout isn't a terminal.
+func resolveColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto", "":
+		return os.Getenv("NO_COLOR") == "" && terminal.IsTerminal(int(syscall.Stdout)), nil
+	default:
+		return false, fmt.Errorf(`unsupported -color %#v, only auto, always and never are supported`, mode)
+	}
+}
+
+// defaultOffsetConcurrency is the default number of concurrent offset lookups.
+const defaultOffsetConcurrency = 16
+
+type watermarks struct {
+	oldest int64
+	newest int64
+	err    error
+}
+
+// fetchWatermarks looks up the oldest and newest offsets for the given
+// partitions in parallel. Each lookup holds a slot in limit while its requests
+// are in flight, so the capacity of limit bounds the number of concurrent
+// lookups. Errors are reported per partition.
+func fetchWatermarks(client sarama.Client, topic string, partitions []int32, limit chan struct{}) map[int32]watermarks {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result = make(map[int32]watermarks, len(partitions))
+	)
+
+	wg.Add(len(partitions))
+	for _, p := range partitions {
+		go func(p int32) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			var wm watermarks
+			if wm.oldest, wm.err = client.GetOffset(topic, p, sarama.OffsetOldest); wm.err == nil {
+				wm.newest, wm.err = client.GetOffset(topic, p, sarama.OffsetNewest)
+			}
+
+			mu.Lock()
+			result[p] = wm
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// offsetForTime returns the offset of the first message with a timestamp at or
+// after t. If there is no such message, it returns the newest offset.
+// If t is before the partition's retention, the broker returns the oldest
+// offset which is what we want.
+func offsetForTime(client sarama.Client, topic string, partition int32, t time.Time) (int64, error) {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	res, err := client.GetOffset(topic, partition, ms)
+	if err != nil {
+		return 0, err
+	}
+
+	if res == -1 {
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+
+	return res, nil
+}
+
+var (
+	probedVersionsMu sync.Mutex
+	probedVersions   = map[string]sarama.KafkaVersion{}
+)
+
+// commitGroupOffsets commits offsets for the partitions of topic to grp with a
+// direct OffsetCommit request of version, which brokers store in ZooKeeper for
+// version 0 and in Kafka otherwise. kt isn't a member of the group, so brokers
+// reject the commit while the group has active members.
+func commitGroupOffsets(client sarama.Client, grp string, version int16, topic string, offsets map[int32]int64) error {
+	broker, err := client.Coordinator(grp)
+	if err != nil {
+		return fmt.Errorf("failed to find coordinator for group=%s err=%v", grp, err)
+	}
+
+	req := &sarama.OffsetCommitRequest{ConsumerGroup: grp, Version: version}
+	var timestamp int64
+	if version > 0 {
+		req.ConsumerGroupGeneration = sarama.GroupGenerationUndefined
+		timestamp = sarama.ReceiveTime
+	}
+	for p, off := range offsets {
+		req.AddBlock(topic, p, off, timestamp, "")
+	}
+	resp, err := broker.CommitOffset(req)
+	if err != nil {
+		return fmt.Errorf("failed to commit offsets for group=%s topic=%s err=%v", grp, topic, err)
+	}
+	for p := range offsets {
+		if kerr, ok := resp.Errors[topic][p]; ok && kerr != sarama.ErrNoError {
+			return fmt.Errorf("failed to commit offset for group=%s topic=%s partition=%d err=%v", grp, topic, p, kerr)
+		}
+	}
+	return nil
+}
+
+// resolveKafkaVersion returns the version for -version s, probing brokers for
+// the version they support when s is auto. Probe results are cached per run.
+func resolveKafkaVersion(s string, brokers []string, tlsConfig *tls.Config) sarama.KafkaVersion {
+	if s != "auto" {
+		return kafkaVersion(s)
+	}
+
+	probedVersionsMu.Lock()
+	defer probedVersionsMu.Unlock()
+
+	key := strings.Join(brokers, ",")
+	if v, ok := probedVersions[key]; ok {
+		return v
+	}
+
+	v, err := probeKafkaVersion(brokers, tlsConfig)
+	if err != nil {
+		v = sarama.V0_10_0_0
+		fmt.Fprintf(os.Stderr, "failed to probe kafka version, falling back to the default v0.10.0.0 err=%v\n", err)
+	}
+	probedVersions[key] = v
+	return v
+}
+
+// probeKafkaVersion asks the first responsive broker for the API versions it
+// supports. Brokers before v0.10.0.0 don't support this request.
+func probeKafkaVersion(brokers []string, tlsConfig *tls.Config) (sarama.KafkaVersion, error) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_0_0
+	applyTLS(cfg, tlsConfig)
+
+	var err error
+	for _, addr := range brokers {
+		var res *sarama.ApiVersionsResponse
+		b := sarama.NewBroker(addr)
+		if err = b.Open(cfg); err != nil {
+			continue
+		}
+		res, err = b.ApiVersions(&sarama.ApiVersionsRequest{})
+		logClose(fmt.Sprintf("broker %v", addr), b)
+		if err != nil {
+			continue
+		}
+		if res.Err != sarama.ErrNoError {
+			err = res.Err
+			continue
+		}
+		return versionFromApiVersions(res.ApiVersions), nil
+	}
+
+	return sarama.V0_10_0_0, err
+}
+
+// versionFromApiVersions maps the API versions a broker supports to the newest
+// sarama.KafkaVersion that's compatible, newer brokers are capped at v0.10.2.0
+// which is the newest version this build of kt knows.
+func versionFromApiVersions(blocks []*sarama.ApiVersionsResponseBlock) sarama.KafkaVersion {
+	max := map[int16]int16{}
+	for _, b := range blocks {
+		max[b.ApiKey] = b.MaxVersion
+	}
+
+	const (
+		listOffsetsKey = 2
+		offsetFetchKey = 9
+	)
+
+	switch {
+	case max[offsetFetchKey] >= 2:
+		return sarama.V0_10_2_0
+	case max[listOffsetsKey] >= 1:
+		return sarama.V0_10_1_0
+	default:
+		return sarama.V0_10_0_0
+	}
+}
+
+type tlsArgs struct {
+	enable     bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	insecure   bool
+}
+
+func addTLSFlags(flags *flag.FlagSet, args *tlsArgs) {
+	addPrefixedTLSFlags(flags, "", args)
+}
+
+// addPrefixedTLSFlags adds the TLS flags with their names prefixed by prefix,
+// for commands that connect to a second cluster.
+func addPrefixedTLSFlags(flags *flag.FlagSet, prefix string, args *tlsArgs) {
+	p := "-" + prefix
+	flags.BoolVar(&args.enable, prefix+"tls", false, "Connect to "+prefix+"brokers via TLS, verifying their certificates against the system's CAs unless "+p+"tls-ca is given.")
+	flags.StringVar(&args.caFile, prefix+"tls-ca", "", "Path to a PEM file of CA certificates to verify "+prefix+"brokers against, implies "+p+"tls.")
+	flags.StringVar(&args.certFile, prefix+"tls-cert", "", "Path to a PEM client certificate to authenticate with, requires "+p+"tls-key and implies "+p+"tls.")
+	flags.StringVar(&args.keyFile, prefix+"tls-key", "", "Path to the PEM private key of "+p+"tls-cert.")
+	flags.StringVar(&args.serverName, prefix+"tls-servername", "", "Name to verify broker certificates against and to send via SNI instead of the broker host, implies "+p+"tls.")
+	flags.BoolVar(&args.insecure, prefix+"tls-insecure-skip-verify", false, "Don't verify broker certificates at all, implies "+p+"tls. This allows man-in-the-middle attacks, prefer "+p+"tls-ca and "+p+"tls-servername.")
+}
+
+// newTLSConfig returns the TLS configuration for args, or nil if TLS isn't
+// enabled.
+func newTLSConfig(args tlsArgs) (*tls.Config, error) {
+	if !args.enable && args.caFile == "" && args.certFile == "" && args.keyFile == "" && args.serverName == "" && !args.insecure {
+		return nil, nil
+	}
+
+	conf := &tls.Config{ServerName: args.serverName, InsecureSkipVerify: args.insecure}
+
+	if args.caFile != "" {
+		buf, err := ioutil.ReadFile(args.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -tls-ca file err=%v", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no PEM certificates found in -tls-ca file %#v", args.caFile)
+		}
+	}
+
+	if (args.certFile == "") != (args.keyFile == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if args.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(args.certFile, args.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate err=%v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+func applyTLS(cfg *sarama.Config, conf *tls.Config) {
+	if conf != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = conf
+	}
+}
+
+var tlsDocString = `
+TLS is used when any of the -tls flags is given. Broker certificates are
+verified against the broker host by default. When brokers are reached via a
+proxy or an address their certificates don't list, pass the expected name via
+-tls-servername; it keeps verification in place and sets the SNI name sent to
+the broker. -tls-insecure-skip-verify disables verification altogether and
+should remain a last resort, as anyone on the network path can then
+impersonate the brokers.
+`
+
 func failf(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", args...)
 	os.Exit(1)
 }
 
 func readStdinLines(max int, out chan string) {
-	scanner := bufio.NewScanner(os.Stdin)
+	if err := readLines(os.Stdin, max, out); err != nil {
+		fmt.Fprintf(os.Stderr, "scanning input failed err=%v\n", err)
+	}
+}
+
+// readLines sends the lines of r to out and closes it, decompressing r first
+// when it starts with the gzip magic bytes. Lines, after decompression, may be
+// at most max bytes long, longer lines stop reading with bufio.ErrTooLong.
+func readLines(r io.Reader, max int, out chan string) error {
+	defer close(out)
+
+	in, err := gunzipIfCompressed(r)
+	if err != nil {
+		return fmt.Errorf("reading gzip input failed err=%v", err)
+	}
+
+	scanner := bufio.NewScanner(in)
 	scanner.Buffer(make([]byte, max), max)
 
 	for scanner.Scan() {
 		out <- scanner.Text()
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "scanning input failed err=%v\n", err)
+	return scanner.Err()
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipIfCompressed returns a reader of the decompressed content of r if it
+// starts with the gzip magic bytes, otherwise a reader of r as is.
+func gunzipIfCompressed(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil || !bytes.Equal(magic, gzipMagic) {
+		return br, nil
 	}
-	close(out)
+	return gzip.NewReader(br)
 }
 
 // hashCode imitates the behavior of the JDK's String#hashCode method.
@@ -148,6 +559,53 @@ func hashCodePartition(key string, partitions int32) int32 {
 	return kafkaAbs(hashCode(key)) % partitions
 }
 
+// murmur2 is the hash of the Java producer's default partitioner.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// murmur2Partition returns the partition the Java producer's default
+// partitioner picks for key: toPositive(murmur2(key)) % partitions.
+func murmur2Partition(key []byte, partitions int32) int32 {
+	if partitions <= 0 {
+		return -1
+	}
+	return (murmur2(key) & 0x7fffffff) % partitions
+}
+
 func sanitizeUsername(u string) string {
 	// Windows user may have format "DOMAIN|MACHINE\username", remove domain/machine if present
 	s := strings.Split(u, "\\")
@@ -164,17 +622,25 @@ func randomString(length int) string {
 	return fmt.Sprintf("%x", buf)[:length]
 }
 
-func getTransformValue(name, envvar, argvalue string) (string, error) {
-	value := argvalue
+// getTransformValue returns the first non-empty of argvalues, falling back to
+// the environment variable envvar and finally to string.
+func getTransformValue(name, envvar string, argvalues ...string) (string, error) {
+	var value string
+	for _, v := range argvalues {
+		if v != "" {
+			value = v
+			break
+		}
+	}
 	if value == "" {
 		value = os.Getenv(envvar)
 	}
 	switch value {
-	case "string", "hex", "base64":
+	case "string", "hex", "base64", "base64url", "cbor":
 		return value, nil
 	case "":
 		return "string", nil
 	default:
-		return "", fmt.Errorf(`unsupported %s argument %#v, only string, hex and base64 are supported`, name, value)
+		return "", fmt.Errorf(`unsupported %s argument %#v, only string, hex, base64, base64url and cbor are supported`, name, value)
 	}
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBrokers(t *testing.T) {
+	data := []struct {
+		in       string
+		expected []string
+		err      bool
+	}{
+		{in: "localhost", expected: []string{"localhost:9092"}},
+		{in: "hans:9093,peter", expected: []string{"hans:9093", "peter:9092"}},
+		{in: " hans:9093 , peter ,", expected: []string{"hans:9093", "peter:9092"}},
+		{in: "hans,hans:9092", expected: []string{"hans:9092"}},
+		{in: "[::1]:9093", expected: []string{"[::1]:9093"}},
+		{in: "[::1]", expected: []string{"[::1]:9092"}},
+		{in: "::1", expected: []string{"[::1]:9092"}},
+		{in: "[fe80::1%eth0]:9092,10.0.0.1", expected: []string{"[fe80::1%eth0]:9092", "10.0.0.1:9092"}},
+		{in: "", err: true},
+		{in: " , ", err: true},
+		{in: "hans:", err: true},
+		{in: "hans:port", err: true},
+		{in: "hans:70000", err: true},
+		{in: ":9092", err: true},
+		{in: "[::1", err: true},
+		{in: "[::1]9092", err: true},
+		{in: "fe80::1:9092:x", err: true},
+		{in: "hans peter:9092", err: true},
+	}
+
+	for _, d := range data {
+		actual, err := parseBrokers(d.in)
+		if d.err {
+			if err == nil {
+				t.Errorf("expected error for %#v, got %#v", d.in, actual)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(actual, d.expected) {
+			t.Errorf("expected %#v for %#v, got %#v err=%v", d.expected, d.in, actual, err)
+		}
+	}
+}
+
+func TestGetTransformValue(t *testing.T) {
+	os.Setenv("KT_TEST_ENCODE", "hex")
+	defer os.Unsetenv("KT_TEST_ENCODE")
+
+	data := []struct {
+		args     []string
+		envvar   string
+		expected string
+		err      bool
+	}{
+		{args: []string{"", ""}, expected: "string"},
+		{args: []string{"", ""}, envvar: "KT_TEST_ENCODE", expected: "hex"},
+		{args: []string{"", "base64url"}, envvar: "KT_TEST_ENCODE", expected: "base64url"},
+		{args: []string{"base64", "base64url"}, envvar: "KT_TEST_ENCODE", expected: "base64"},
+		{args: []string{"cbor", ""}, expected: "cbor"},
+		{args: []string{"", "foo"}, err: true},
+		{args: []string{"cobr", ""}, err: true},
+	}
+
+	for _, d := range data {
+		actual, err := getTransformValue("encodevalue", d.envvar, d.args...)
+		if d.err {
+			if err == nil {
+				t.Errorf("expected error for %#v, got %#v", d.args, actual)
+			}
+			continue
+		}
+		if err != nil || actual != d.expected {
+			t.Errorf("expected %#v for %#v, got %#v err=%v", d.expected, d.args, actual, err)
+		}
+	}
+}
+
+func TestReadLinesGzip(t *testing.T) {
+	ndjson := "{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"b\",\"value\":\"2\"}\n"
+	var fixture bytes.Buffer
+	zw := gzip.NewWriter(&fixture)
+	_, err := zw.Write([]byte(ndjson))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for _, in := range []*bytes.Reader{bytes.NewReader(fixture.Bytes()), bytes.NewReader([]byte(ndjson))} {
+		out := make(chan string)
+		go func() { require.NoError(t, readLines(in, 1024, out)) }()
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+		}
+		require.Equal(t, strings.Split(strings.TrimSpace(ndjson), "\n"), actual)
+	}
+
+	// lines longer than max after decompression are not emitted
+	out := make(chan string)
+	errs := make(chan error, 1)
+	go func() { errs <- readLines(bytes.NewReader(fixture.Bytes()), 8, out) }()
+	for l := range out {
+		t.Errorf("unexpected line %#v", l)
+	}
+	require.Equal(t, bufio.ErrTooLong, <-errs)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	conf, err := newTLSConfig(tlsArgs{})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	conf, err = newTLSConfig(tlsArgs{serverName: "kafka.internal"})
+	require.NoError(t, err)
+	require.Equal(t, "kafka.internal", conf.ServerName)
+	require.False(t, conf.InsecureSkipVerify)
+
+	conf, err = newTLSConfig(tlsArgs{insecure: true})
+	require.NoError(t, err)
+	require.True(t, conf.InsecureSkipVerify)
+
+	_, err = newTLSConfig(tlsArgs{certFile: "client.pem"})
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "kt-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(ca, []byte("not a certificate"), 0644))
+
+	_, err = newTLSConfig(tlsArgs{caFile: ca})
+	require.Error(t, err)
+	_, err = newTLSConfig(tlsArgs{caFile: filepath.Join(dir, "missing.pem")})
+	require.Error(t, err)
+
+	cfg := sarama.NewConfig()
+	applyTLS(cfg, nil)
+	require.False(t, cfg.Net.TLS.Enable)
+	applyTLS(cfg, &tls.Config{ServerName: "kafka.internal"})
+	require.True(t, cfg.Net.TLS.Enable)
+	require.Equal(t, "kafka.internal", cfg.Net.TLS.Config.ServerName)
+}
+
+func TestVersionFromApiVersions(t *testing.T) {
+	block := func(key, max int16) *sarama.ApiVersionsResponseBlock {
+		return &sarama.ApiVersionsResponseBlock{ApiKey: key, MaxVersion: max}
+	}
+
+	require.Equal(t, sarama.V0_10_0_0, versionFromApiVersions(nil))
+	require.Equal(t, sarama.V0_10_0_0, versionFromApiVersions([]*sarama.ApiVersionsResponseBlock{block(2, 0), block(9, 1)}))
+	require.Equal(t, sarama.V0_10_1_0, versionFromApiVersions([]*sarama.ApiVersionsResponseBlock{block(2, 1), block(9, 1)}))
+	require.Equal(t, sarama.V0_10_2_0, versionFromApiVersions([]*sarama.ApiVersionsResponseBlock{block(2, 1), block(9, 2)}))
+	require.Equal(t, sarama.V0_10_2_0, versionFromApiVersions([]*sarama.ApiVersionsResponseBlock{block(2, 5), block(9, 7)}))
+}
+
+func TestResolveKafkaVersion(t *testing.T) {
+	require.Equal(t, sarama.V0_9_0_1, resolveKafkaVersion("v0.9.0.1", nil, nil))
+
+	probedVersions["cached:9092"] = sarama.V0_10_1_0
+	defer delete(probedVersions, "cached:9092")
+	require.Equal(t, sarama.V0_10_1_0, resolveKafkaVersion("auto", []string{"cached:9092"}, nil))
+
+	defer delete(probedVersions, "127.0.0.1:1")
+	require.Equal(t, sarama.V0_10_0_0, resolveKafkaVersion("auto", []string{"127.0.0.1:1"}, nil))
+}
+
+func TestOffsetStorageVersion(t *testing.T) {
+	v, err := offsetStorageVersion("kafka", sarama.V0_8_2_0)
+	require.NoError(t, err)
+	require.Equal(t, int16(1), v)
+
+	v, err = offsetStorageVersion("zookeeper", sarama.V0_10_0_0)
+	require.NoError(t, err)
+	require.Equal(t, int16(0), v)
+
+	_, err = offsetStorageVersion("kafka", sarama.KafkaVersion{})
+	require.EqualError(t, err, "kafka offset storage requires -version v0.8.2.0 or later, use -offset-storage zookeeper for older clusters")
+
+	_, err = offsetStorageVersion("etcd", sarama.V0_10_0_0)
+	require.EqualError(t, err, `unsupported offset storage "etcd" - supported: kafka, zookeeper`)
+}
+
+func TestMurmur2(t *testing.T) {
+	// expected values from the Java client's Utils.murmur2 tests.
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for in, expected := range cases {
+		require.Equal(t, expected, murmur2([]byte(in)), in)
+	}
+	require.Equal(t, (murmur2([]byte("abc"))&0x7fffffff)%3, murmur2Partition([]byte("abc"), 3))
+}
+
+func TestResolveColor(t *testing.T) {
+	defer os.Unsetenv("NO_COLOR")
+
+	os.Setenv("NO_COLOR", "1")
+	for mode, expected := range map[string]bool{"always": true, "never": false, "auto": false, "": false} {
+		actual, err := resolveColor(mode)
+		require.NoError(t, err, mode)
+		require.Equal(t, expected, actual, mode)
+	}
+
+	// stdout isn't a terminal under go test.
+	os.Unsetenv("NO_COLOR")
+	actual, err := resolveColor("auto")
+	require.NoError(t, err)
+	require.False(t, actual)
+
+	_, err = resolveColor("yes")
+	require.Error(t, err)
+}
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
 )
@@ -27,15 +41,112 @@ type consumeCmd struct {
 	encodeValue string
 	encodeKey   string
 	pretty      bool
+	color       bool
+	group       string
+	output      string
+	dedup       bool
+	nullKey     string
+	showCRC     bool
+	lagWarn     time.Duration
+	refresh     time.Duration
+	count       bool
+	checkOrder  bool
+	histogram   bool
+	sortBy      string
+	compact     bool
+	tlsConfig   *tls.Config
+	toTopic     string
+	toBrokers   []string
+	toTLSConfig *tls.Config
+	toVersion   sarama.KafkaVersion
+	keepTime    bool
+	separator   string
+	nullValue   string
+	timeFormat  string
+	timeZone    *time.Location
+	maxWait     time.Duration
+	exitAfter   time.Duration
+	chanBuffer  int
+	embedJSON   bool
+	unescape    int
+	stripSchema bool
+	valueSchema *avroSchema
+	guess       []string
+	leaderOnly  bool
+	leaderID    int32
+	keyFrames   bool
+	dedupWindow int
+	dedupFile   string
+	cpFile      string
+	cpInterval  time.Duration
+	fetchList   []partitionOffset
 
 	client   sarama.Client
 	consumer sarama.Consumer
+	producer sarama.SyncProducer
+	// resumeOffsets are the offsets to start partitions at instead of their
+	// -offsets start, read from -from-group or -checkpoint-file.
+	resumeOffsets map[int32]int64
+	window        *seenWindow
+	// offsetVersion is the version of the OffsetFetch request for
+	// -offset-storage, 0 for offsets stored in ZooKeeper.
+	offsetVersion int16
+
+	seenMu sync.Mutex
+	seen   map[string]struct{}
+
+	positionsMu sync.Mutex
+	positions   map[int32]int64
+	starts      map[int32]int64
+
+	// commitInterval is how often offsets are committed to -from-group, 0 to
+	// not commit. With manualCommit those are the positions after the last
+	// handled message, otherwise consumed, the offsets after the last
+	// received message per partition.
+	commitInterval time.Duration
+	manualCommit   bool
+	commitMu       sync.Mutex
+	consumed       map[int32]int64
+	committed      map[int32]int64
+
+	countsMu sync.Mutex
+	counts   map[int32]int64
+
+	orderingMu sync.Mutex
+	ordering   map[int32]*partitionOrdering
+
+	sizeBounds   []int64
+	histogramsMu sync.Mutex
+	histograms   map[int32]*sizeHistogram
+
+	mirroredMu sync.Mutex
+	mirrored   map[int32]*mirroredPartition
+
+	bufferedMu sync.Mutex
+	buffered   []*sarama.ConsumerMessage
+
+	// lastActivity is the time in nanoseconds since the epoch when the last
+	// message was received on any partition, stop is closed to stop all
+	// partition consumers once that is longer than maxWait ago.
+	lastActivity int64
+	stop         chan struct{}
+	stopOnce     sync.Once
 }
 
 type offset struct {
 	relative bool
 	start    int64
 	diff     int64
+
+	// ago is set for offsets relative to the current time, e.g. last:1h,
+	// which are resolved via the message timestamps.
+	ago time.Duration
+	// at is set for offsets at an absolute point in time, e.g. via -since.
+	at time.Time
+}
+
+func (o offset) timeBased() bool {
+	return o.ago > 0 || !o.at.IsZero()
 }
 
 func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
@@ -48,6 +159,14 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 		err error
 	)
 
+	if o.ago > 0 {
+		return cmd.resolveTime(time.Now().Add(-o.ago), partition)
+	}
+
+	if !o.at.IsZero() {
+		return cmd.resolveTime(o.at, partition)
+	}
+
 	if o.start == sarama.OffsetNewest || o.start == sarama.OffsetOldest {
 		if res, err = cmd.client.GetOffset(cmd.topic, partition, o.start); err != nil {
 			return 0, err
@@ -63,6 +182,10 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 	return o.start + o.diff, nil
 }
 
+func (cmd *consumeCmd) resolveTime(t time.Time, partition int32) (int64, error) {
+	return offsetForTime(cmd.client, cmd.topic, partition, t)
+}
+
 type interval struct {
 	start offset
 	end   offset
@@ -77,13 +200,70 @@ type consumeArgs struct {
 	version     string
 	encodeValue string
 	encodeKey   string
+	encode      string
 	pretty      bool
+	color       string
+	group       string
+	output      string
+	outputGiven bool
+	msgFormat   string
+	msgGiven    bool
+	dedup       bool
+	nullKey     string
+	showCRC     bool
+	lagWarn     time.Duration
+	refresh     time.Duration
+	count       bool
+	checkOrder  bool
+	histogram   bool
+	sizeBuckets string
+	sortBy      string
+	compact     bool
+	tls         tlsArgs
+	toTopic     string
+	toBrokers   string
+	toTLS       tlsArgs
+	toVersion   string
+	keepTime    bool
+	separator   string
+	nullValue   string
+	since       string
+	until       string
+	timeFormat  string
+	timeZone    string
+	maxWait     time.Duration
+	exitAfter   time.Duration
+	embedJSON   bool
+	unescape    int
+	stripSchema bool
+	valueSchema string
+	guess       string
+	leaderOnly  bool
+	leaderID    int
+	keyFrames   bool
+	dedupWindow int
+	dedupFile   string
+	cpFile      string
+	cpInterval  time.Duration
+	fetchFile   string
+	storage     string
+	buffer      int
+
+	commitInterval time.Duration
+	manualCommit   bool
 }
 
 func parseOffset(str string) (offset, error) {
 	result := offset{}
-	re := regexp.MustCompile("(oldest|newest)?(-|\\+)?(\\d+)?")
-	matches := re.FindAllStringSubmatch(str, -1)
+
+	if strings.HasPrefix(str, "last") {
+		ago, err := time.ParseDuration(strings.TrimPrefix(str, "last"))
+		if err != nil || ago <= 0 {
+			return result, fmt.Errorf("Invalid duration in offset [%v]", str)
+		}
+		return offset{relative: true, ago: ago}, nil
+	}
+	matches := offsetRegExp.FindAllStringSubmatch(strings.Join(strings.Fields(str), ""), -1)
 
 	if len(matches) == 0 || len(matches[0]) < 4 {
 		return result, fmt.Errorf("Could not parse offset [%v]", str)
@@ -120,65 +300,113 @@ func parseOffset(str string) (offset, error) {
 	return result, nil
 }
 
+var (
+	offsetRegExp        = regexp.MustCompile(`^(oldest|newest)?(-|\+)?(\d+)?$`)
+	partitionOnlyRegExp = regexp.MustCompile(`^(all|-1|\d+)$`)
+)
+
 func parseOffsets(str string) (map[int32]interval, error) {
 	defaultInterval := interval{
 		start: offset{relative: true, start: sarama.OffsetOldest},
 		end:   offset{start: 1<<63 - 1},
 	}
 
-	if len(str) == 0 {
+	if len(strings.TrimSpace(str)) == 0 {
 		return map[int32]interval{-1: defaultInterval}, nil
 	}
 
 	result := map[int32]interval{}
 	for _, partitionInfo := range strings.Split(str, ",") {
-		re := regexp.MustCompile("(all|\\d+)?=?([^:]+)?:?(.+)?")
-		matches := re.FindAllStringSubmatch(strings.TrimSpace(partitionInfo), -1)
-		if len(matches) != 1 || len(matches[0]) < 3 {
-			return result, fmt.Errorf("Invalid partition info [%v]", partitionInfo)
+		partitionInfo = strings.TrimSpace(partitionInfo)
+		if len(partitionInfo) == 0 {
+			continue
 		}
 
-		var partition int32
-		start := defaultInterval.start
-		end := defaultInterval.end
-		partitionMatches := matches[0]
+		// A token without "=" is either only a partition, e.g. 2, or only an
+		// offset range for all partitions, e.g. newest-10:.
+		partitionStr, rangeStr := partitionInfo, ""
+		if i := strings.Index(partitionInfo, "="); i >= 0 {
+			partitionStr, rangeStr = partitionInfo[:i], partitionInfo[i+1:]
+		} else if !partitionOnlyRegExp.MatchString(partitionInfo) {
+			partitionStr, rangeStr = "", partitionInfo
+		}
 
-		// partition
-		partitionStr := partitionMatches[1]
-		if partitionStr == "all" || len(partitionStr) == 0 {
-			partition = -1
-		} else {
-			i, err := strconv.Atoi(partitionStr)
-			if err != nil {
-				return result, fmt.Errorf("Invalid partition [%v]", partitionStr)
-			}
-			partition = int32(i)
+		partition, err := parsePartition(strings.TrimSpace(partitionStr))
+		if err != nil {
+			return result, fmt.Errorf("%v in [%v]", err, partitionInfo)
+		}
+		if _, ok := result[partition]; ok {
+			return result, fmt.Errorf("Duplicate partition [%v] in [%v]", strings.TrimSpace(partitionStr), partitionInfo)
 		}
 
-		// start
-		if len(partitionMatches) > 2 && len(strings.TrimSpace(partitionMatches[2])) > 0 {
-			startStr := strings.TrimSpace(partitionMatches[2])
-			o, err := parseOffset(startStr)
-			if err == nil {
-				start = o
+		startStr, endStr := splitOffsetRange(strings.TrimSpace(rangeStr))
+		i := defaultInterval
+		if len(startStr) > 0 {
+			if i.start, err = parseOffset(startStr); err != nil {
+				return result, fmt.Errorf("Invalid start offset [%v] in [%v]", startStr, partitionInfo)
 			}
 		}
-
-		// end
-		if len(partitionMatches) > 3 && len(strings.TrimSpace(partitionMatches[3])) > 0 {
-			endStr := strings.TrimSpace(partitionMatches[3])
-			o, err := parseOffset(endStr)
-			if err == nil {
-				end = o
+		if len(endStr) > 0 {
+			if i.end, err = parseOffset(endStr); err != nil {
+				return result, fmt.Errorf("Invalid end offset [%v] in [%v]", endStr, partitionInfo)
 			}
 		}
 
-		result[partition] = interval{start, end}
+		result[partition] = i
 	}
 
 	return result, nil
 }
 
+// parsePartition returns the partition identifier for str, -1 for all
+// partitions when str is all, -1 or empty.
+func parsePartition(str string) (int32, error) {
+	if str == "all" || str == "-1" || len(str) == 0 {
+		return -1, nil
+	}
+
+	p, err := strconv.ParseInt(str, 10, 32)
+	if err != nil || p < 0 {
+		return 0, fmt.Errorf("Invalid partition [%v]", str)
+	}
+	return int32(p), nil
+}
+
+// splitOffsetRange splits start:end into its trimmed parts. last:DUR is a
+// single start offset, its colon isn't taken for the separator between start
+// and end.
+func splitOffsetRange(str string) (string, string) {
+	prefix := ""
+	if strings.HasPrefix(str, "last:") {
+		prefix, str = "last", strings.TrimPrefix(str, "last:")
+	}
+
+	start, end := str, ""
+	if i := strings.Index(str, ":"); i >= 0 {
+		start, end = str[:i], str[i+1:]
+	}
+
+	start = strings.TrimSpace(start)
+	if prefix != "" {
+		start = prefix + start
+	}
+	return start, strings.TrimSpace(end)
+}
+
+// parseTimeOffset parses an RFC3339 time, or a positive duration to go back
+// from now, into a time based offset.
+func parseTimeOffset(str string) (offset, error) {
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return offset{relative: true, at: t}, nil
+	}
+
+	ago, err := time.ParseDuration(str)
+	if err != nil || ago <= 0 {
+		return offset{}, fmt.Errorf("expected an RFC3339 time or a positive duration, got %#v", str)
+	}
+	return offset{relative: true, ago: ago}, nil
+}
+
 func (cmd *consumeCmd) failStartup(msg string) {
 	fmt.Fprintln(os.Stderr, msg)
 	failf("use \"kt consume -help\" for more information")
@@ -200,21 +428,151 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 	}
 	cmd.topic = args.topic
 	cmd.timeout = args.timeout
+	cmd.maxWait = args.maxWait
+	cmd.exitAfter = args.exitAfter
+	if args.buffer < 0 {
+		cmd.failStartup("-buffer cannot be negative.")
+	}
+	cmd.chanBuffer = args.buffer
+	cmd.leaderOnly = args.leaderOnly
+	if args.leaderID < -1 {
+		cmd.failStartup("-leader-broker needs to be a broker id.")
+	}
+	cmd.leaderID = int32(args.leaderID)
 	cmd.verbose = args.verbose
 	cmd.pretty = args.pretty
-	cmd.version = kafkaVersion(args.version)
+	if cmd.color, err = resolveColor(args.color); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	cmd.group = args.group
+
+	if args.msgGiven {
+		if args.outputGiven {
+			cmd.failStartup("-message-format cannot be combined with -output.")
+		}
+		if err = applyMessageFormat(&args); err != nil {
+			cmd.failStartup(err.Error())
+		}
+	}
+
+	switch args.output {
+	case "json", "keys", "values", "key-value", "logfmt", "frames", "connect":
+		cmd.output = args.output
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported output %#v, only json, keys, values, key-value, logfmt, frames and connect are supported`, args.output))
+	}
+	if args.keyFrames && cmd.output != "frames" {
+		cmd.failStartup("-key-frames is only supported for frames output.")
+	}
+	cmd.keyFrames = args.keyFrames
+
+	if args.dedup && cmd.output != "keys" {
+		cmd.failStartup("-dedup is only supported for keys output.")
+	}
+	if args.nullKey != "" && cmd.output != "keys" && cmd.output != "key-value" {
+		cmd.failStartup("-null-key is only supported for keys and key-value output.")
+	}
+	if args.nullValue != "" && cmd.output != "values" && cmd.output != "key-value" {
+		cmd.failStartup("-null-value is only supported for values and key-value output.")
+	}
+	if args.separator != "\t" && cmd.output != "key-value" {
+		cmd.failStartup("-separator is only supported for key-value output.")
+	}
+	cmd.dedup = args.dedup
+	cmd.nullKey = args.nullKey
+	cmd.nullValue = args.nullValue
+	cmd.separator = args.separator
+
+	cmd.timeFormat = args.timeFormat
+	if args.timeZone != "" {
+		if cmd.timeZone, err = time.LoadLocation(args.timeZone); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -time-zone err=%v", err))
+		}
+	}
+	cmd.showCRC = args.showCRC
+	cmd.lagWarn = args.lagWarn
+	if args.refresh < 0 {
+		cmd.failStartup("-metadata-refresh should not be negative.")
+	}
+	cmd.refresh = args.refresh
+	cmd.count = args.count
+	if args.checkOrder && cmd.count {
+		cmd.failStartup("-check-ordering cannot be combined with -count.")
+	}
+	cmd.checkOrder = args.checkOrder
+	if args.histogram {
+		if cmd.count || cmd.checkOrder {
+			cmd.failStartup("-size-histogram cannot be combined with -count or -check-ordering.")
+		}
+		if cmd.sizeBounds, err = parseSizeBuckets(args.sizeBuckets); err != nil {
+			cmd.failStartup(err.Error())
+		}
+	}
+	cmd.histogram = args.histogram
+
+	if _, err := getTransformValue("encode", "", args.encode); err != nil {
+		cmd.failStartup(err.Error())
+	}
 
-	if encodeValue, err := getTransformValue("encodevalue", "KT_ENCODE_VALUE", args.encodeValue); err == nil {
+	if encodeValue, err := getTransformValue("encodevalue", "KT_ENCODE_VALUE", args.encodeValue, args.encode); err == nil {
 		cmd.encodeValue = encodeValue
 	} else {
 		cmd.failStartup(err.Error())
 	}
 
-	if encodeKey, err := getTransformValue("encodekey", "KT_ENCODE_KEY", args.encodeKey); err == nil {
+	if args.stripSchema {
+		if cmd.output != "json" || args.embedJSON || args.guess != "" {
+			cmd.failStartup("-strip-schema-id is only supported for json output, without -embed-json and -guess.")
+		}
+		if args.encodeValue == "" && args.encode == "" {
+			cmd.encodeValue = "base64"
+		}
+	}
+	cmd.stripSchema = args.stripSchema
+
+	if args.embedJSON && (cmd.output != "json" || cmd.encodeValue != "string") {
+		cmd.failStartup("-embed-json is only supported for json output with string values.")
+	}
+	cmd.embedJSON = args.embedJSON
+
+	if args.unescape < 0 {
+		cmd.failStartup("-unescape-json must not be negative.")
+	}
+	if args.unescape > 0 && (cmd.output != "json" || cmd.encodeValue != "string" || cmd.stripSchema) {
+		cmd.failStartup("-unescape-json is only supported for json output with string values, without -strip-schema-id.")
+	}
+	cmd.unescape = args.unescape
+
+	if args.valueSchema != "" {
+		if cmd.output != "json" || args.encodeValue != "" || args.encode != "" || cmd.stripSchema || cmd.embedJSON || cmd.unescape > 0 || args.guess != "" {
+			cmd.failStartup("-value-schema is only supported for json output, without -encodevalue, -encode, -strip-schema-id, -embed-json, -unescape-json and -guess.")
+		}
+		if cmd.valueSchema, err = readAvroSchema(args.valueSchema); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -value-schema err=%v", err))
+		}
+	}
+
+	if args.guess != "" {
+		if cmd.output != "json" || args.embedJSON || args.encode != "" || args.encodeKey != "" || args.encodeValue != "" {
+			cmd.failStartup("-guess is only supported for json output, without -embed-json and -encode flags.")
+		}
+		if cmd.guess, err = parseGuessOrder(args.guess); err != nil {
+			cmd.failStartup(err.Error())
+		}
+	}
+
+	if encodeKey, err := getTransformValue("encodekey", "KT_ENCODE_KEY", args.encodeKey, args.encode); err == nil {
 		cmd.encodeKey = encodeKey
 	} else {
 		cmd.failStartup(err.Error())
 	}
+	if cmd.output == "connect" {
+		for _, e := range []string{cmd.encodeKey, cmd.encodeValue} {
+			if e != "string" && e != "base64" {
+				cmd.failStartup("connect output only supports string and base64 encodings, Connect's JSON converter represents bytes as base64.")
+			}
+		}
+	}
 
 	envBrokers := os.Getenv("KT_BROKERS")
 	if args.brokers == "" {
@@ -224,17 +582,211 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 			args.brokers = "localhost:9092"
 		}
 	}
-	cmd.brokers = strings.Split(args.brokers, ",")
-	for i, b := range cmd.brokers {
-		if !strings.Contains(b, ":") {
-			cmd.brokers[i] = b + ":9092"
+	if cmd.brokers, err = parseBrokers(args.brokers); err != nil {
+		cmd.failStartup(err.Error())
+	}
+
+	if cmd.tlsConfig, err = newTLSConfig(args.tls); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	cmd.version = resolveKafkaVersion(args.version, cmd.brokers, cmd.tlsConfig)
+	if cmd.offsetVersion, err = offsetStorageVersion(args.storage, cmd.version); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	if args.storage == zookeeperOffsetStorage && args.group == "" {
+		cmd.failStartup("-offset-storage zookeeper requires -from-group.")
+	}
+
+	if args.toTopic == "" && (args.toBrokers != "" || args.toVersion != "" || args.keepTime) {
+		cmd.failStartup("-to-brokers, -to-version and -keep-timestamp require -to-topic.")
+	}
+	if args.toTopic != "" {
+		if args.count || args.checkOrder || args.histogram || args.sortBy != "" || args.compact {
+			cmd.failStartup("-to-topic cannot be combined with -count, -check-ordering, -size-histogram, -sort or -compact.")
+		}
+		if args.toTopic == cmd.topic && args.toBrokers == "" {
+			cmd.failStartup("-to-topic needs to differ from -topic unless -to-brokers is given.")
+		}
+		cmd.toTopic = args.toTopic
+		cmd.toBrokers = cmd.brokers
+		if args.toBrokers != "" {
+			if cmd.toBrokers, err = parseBrokers(args.toBrokers); err != nil {
+				cmd.failStartup(err.Error())
+			}
+		}
+		if cmd.toTLSConfig, err = newTLSConfig(args.toTLS); err != nil {
+			cmd.failStartup(err.Error())
+		}
+		cmd.toVersion = cmd.version
+		if args.toVersion == "" {
+			args.toVersion = args.version
+		}
+		if args.toBrokers != "" || args.toVersion != args.version {
+			cmd.toVersion = resolveKafkaVersion(args.toVersion, cmd.toBrokers, cmd.toTLSConfig)
 		}
+		if args.keepTime && !cmd.toVersion.IsAtLeast(sarama.V0_10_0_0) {
+			cmd.failStartup("-keep-timestamp requires -to-version v0.10.0.0 or later.")
+		}
+		cmd.keepTime = args.keepTime
 	}
 
 	cmd.offsets, err = parseOffsets(args.offsets)
 	if err != nil {
 		cmd.failStartup(fmt.Sprintf("%s", err))
 	}
+
+	if args.since != "" || args.until != "" {
+		if args.offsets != "" {
+			cmd.failStartup("-since and -until cannot be combined with -offsets.")
+		}
+		i := cmd.offsets[-1]
+		if args.since != "" {
+			if i.start, err = parseTimeOffset(args.since); err != nil {
+				cmd.failStartup(fmt.Sprintf("invalid -since: %v", err))
+			}
+		}
+		if args.until != "" {
+			if i.end, err = parseTimeOffset(args.until); err != nil {
+				cmd.failStartup(fmt.Sprintf("invalid -until: %v", err))
+			}
+		}
+		cmd.offsets = map[int32]interval{-1: i}
+	}
+
+	for _, i := range cmd.offsets {
+		if (i.start.timeBased() || i.end.timeBased()) && !cmd.version.IsAtLeast(sarama.V0_10_1_0) {
+			cmd.failStartup("Time based offsets require -version v0.10.1.0 or later.")
+		}
+	}
+
+	switch args.sortBy {
+	case "", "offset", "timestamp", "key":
+		cmd.sortBy = args.sortBy
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -sort %#v, only offset, timestamp and key are supported`, args.sortBy))
+	}
+	cmd.compact = args.compact
+	if cmd.sortBy != "" || cmd.compact {
+		if cmd.count || cmd.checkOrder || cmd.histogram {
+			cmd.failStartup("-sort and -compact cannot be combined with -count, -check-ordering or -size-histogram.")
+		}
+		if !cmd.bounded() {
+			cmd.failStartup("-sort and -compact require a bounded read: an end offset for all partitions or a -timeout.")
+		}
+	}
+
+	if cmd.histogram && !cmd.bounded() {
+		cmd.failStartup("-size-histogram requires a bounded read: an end offset for all partitions or a -timeout.")
+	}
+
+	if args.dedupWindow < 0 {
+		cmd.failStartup("-dedup-window cannot be negative.")
+	}
+	cmd.dedupWindow = args.dedupWindow
+	cmd.dedupFile = args.dedupFile
+	if cmd.dedupFile == "" {
+		cmd.dedupFile = filepath.Join(os.TempDir(), "kt-consume-"+cmd.topic+".seen")
+	}
+
+	if args.cpFile != "" {
+		if cmd.group != "" {
+			cmd.failStartup("-checkpoint-file cannot be combined with -from-group.")
+		}
+		if cmd.sortBy != "" || cmd.compact {
+			cmd.failStartup("-checkpoint-file cannot be combined with -sort or -compact.")
+		}
+		if args.cpInterval <= 0 {
+			cmd.failStartup("-checkpoint-interval needs to be positive.")
+		}
+	}
+	cmd.cpFile = args.cpFile
+	cmd.cpInterval = args.cpInterval
+
+	if args.commitInterval != 0 || args.manualCommit {
+		if cmd.group == "" {
+			cmd.failStartup("-commit-interval and -manual-commit require -from-group.")
+		}
+		if cmd.count || cmd.checkOrder || cmd.histogram || cmd.sortBy != "" || cmd.compact {
+			cmd.failStartup("-commit-interval and -manual-commit cannot be combined with -count, -check-ordering, -size-histogram, -sort or -compact.")
+		}
+		if args.commitInterval < 0 {
+			cmd.failStartup("-commit-interval should not be negative.")
+		}
+	}
+	cmd.commitInterval = args.commitInterval
+	cmd.manualCommit = args.manualCommit
+	if cmd.manualCommit && cmd.commitInterval == 0 {
+		cmd.commitInterval = time.Second
+	}
+
+	if args.fetchFile != "" {
+		if args.offsets != "" || args.since != "" || args.until != "" || cmd.group != "" || cmd.cpFile != "" {
+			cmd.failStartup("-fetch-offsets cannot be combined with -offsets, -since, -until, -from-group or -checkpoint-file.")
+		}
+		if cmd.count || cmd.checkOrder || cmd.histogram || cmd.sortBy != "" || cmd.compact || cmd.toTopic != "" || cmd.dedupWindow > 0 {
+			cmd.failStartup("-fetch-offsets cannot be combined with -count, -check-ordering, -size-histogram, -sort, -compact, -to-topic or -dedup-window.")
+		}
+		f, err := os.Open(args.fetchFile)
+		if err != nil {
+			cmd.failStartup(fmt.Sprintf("failed to open -fetch-offsets file err=%v", err))
+		}
+		defer logClose("-fetch-offsets file", f)
+		if cmd.fetchList, err = parseOffsetList(f); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -fetch-offsets file %v: %v", args.fetchFile, err))
+		}
+		if len(cmd.fetchList) == 0 {
+			cmd.failStartup(fmt.Sprintf("-fetch-offsets file %v lists no offsets.", args.fetchFile))
+		}
+	}
+}
+
+// parseOffsetList reads one partition:offset pair per line from r, skipping
+// empty lines and comments starting with #.
+func parseOffsetList(r io.Reader) ([]partitionOffset, error) {
+	var (
+		result  []partitionOffset
+		line    int
+		scanner = bufio.NewScanner(r)
+	)
+
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %v: expected partition:offset, got %#v", line, l)
+		}
+		p, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("line %v: invalid partition %#v", line, parts[0])
+		}
+		o, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || o < 0 {
+			return nil, fmt.Errorf("line %v: invalid offset %#v", line, parts[1])
+		}
+		result = append(result, partitionOffset{partition: int32(p), offset: o})
+	}
+
+	return result, scanner.Err()
+}
+
+// bounded reports whether consuming stops on its own, rather than tailing the
+// topic until interrupted.
+func (cmd *consumeCmd) bounded() bool {
+	if cmd.timeout > 0 || cmd.maxWait > 0 || cmd.exitAfter > 0 {
+		return true
+	}
+
+	for _, i := range cmd.offsets {
+		if !i.end.relative && i.end.start == 1<<63-1 {
+			return false
+		}
+	}
+	return true
 }
 
 func (cmd *consumeCmd) parseFlags(as []string) consumeArgs {
@@ -243,24 +795,109 @@ func (cmd *consumeCmd) parseFlags(as []string) consumeArgs {
 	flags.StringVar(&args.topic, "topic", "", "Topic to consume (required).")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by partition and offset range (defaults to all).")
+	flags.StringVar(&args.since, "since", "", "Start reading all partitions at this RFC3339 time, or this long ago, e.g. 2h, instead of -offsets.")
+	flags.StringVar(&args.until, "until", "", "Stop reading all partitions before this RFC3339 time, or this long ago, e.g. 1h, instead of -offsets.")
 	flags.DurationVar(&args.timeout, "timeout", time.Duration(0), "Timeout after not reading messages (default 0 to disable).")
+	flags.DurationVar(&args.maxWait, "max-wait", 0, "Stop consuming all partitions after not reading messages from any partition for this long (default 0 to disable).")
+	flags.DurationVar(&args.exitAfter, "exit-after", 0, "Stop consuming all partitions after this long, regardless of messages still arriving (default 0 to disable).")
+	flags.IntVar(&args.buffer, "buffer", 256, "Number of messages to buffer per partition while waiting for output, smaller values bound memory at the cost of throughput.")
+	flags.BoolVar(&args.leaderOnly, "partition-leader-only", false, "Wait for partitions without a leader and keep consuming through leadership changes, warning on stderr, rather than giving up on the partition.")
+	flags.IntVar(&args.leaderID, "leader-broker", -1, "Only consume the partitions that the broker with this id leads at startup (default -1 for all).")
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
-	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
-	flags.StringVar(&args.encodeValue, "encodevalue", "", "Present message value as (string|hex|base64), defaults to string.")
-	flags.StringVar(&args.encodeKey, "encodekey", "", "Present message key as (string|hex|base64), defaults to string.")
+	addColorFlag(flags, &args.color)
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version, or auto to probe the brokers for it (defaults to v0.10.0.0).")
+	flags.StringVar(&args.encodeValue, "encodevalue", "", "Present message value as (string|hex|base64|base64url|cbor), defaults to -encode.")
+	flags.StringVar(&args.encodeKey, "encodekey", "", "Present message key as (string|hex|base64|base64url|cbor), defaults to -encode.")
+	flags.StringVar(&args.encode, "encode", "", "Present both message key and value as (string|hex|base64|base64url|cbor), defaults to string.")
+	flags.StringVar(&args.group, "from-group", "", "Start from the offsets committed by this consumer group, without joining it or committing unless -commit-interval or -manual-commit is given.")
+	flags.DurationVar(&args.commitInterval, "commit-interval", 0, "Interval to commit the offsets of received messages to -from-group at (default 0 to not commit, 1s with -manual-commit).")
+	flags.BoolVar(&args.manualCommit, "manual-commit", false, "Commit the offsets of messages to -from-group only once they're written to stdout, every -commit-interval.")
+	flags.StringVar(&args.storage, "offset-storage", kafkaOffsetStorage, "Where the -from-group offsets are stored: kafka or zookeeper (for clusters before v0.9.0.0).")
+	flags.StringVar(&args.output, "output", "json", "Output mode (json|keys|values|key-value|logfmt|frames|connect), keys and values print only the message keys or values and key-value keys and values separated by -separator, one message per line, logfmt prints messages as logfmt lines, frames prints values as length prefixed binary frames, connect wraps messages in Kafka Connect style JSON envelopes.")
+	flags.StringVar(&args.msgFormat, "message-format", "json", "Preset for the output layout (json|kafka-console|logfmt|raw), cannot be combined with -output.")
+	flags.BoolVar(&args.keyFrames, "key-frames", false, "Print each message as a key frame followed by a value frame for frames output.")
+	flags.BoolVar(&args.dedup, "dedup", false, "Print each key only once for keys output.")
+	flags.StringVar(&args.nullKey, "null-key", "", "Literal to print for null keys for keys and key-value output (defaults to skipping null keys for keys and an empty key for key-value output).")
+	flags.StringVar(&args.nullValue, "null-value", "", "Literal to print for null values for values and key-value output (defaults to an empty value).")
+	flags.StringVar(&args.timeFormat, "time-format", "", "Format of message timestamps: a Go time layout, unix or unixmilli (defaults to RFC 3339).")
+	flags.StringVar(&args.timeZone, "time-zone", "", "Time zone to present message timestamps in, e.g. UTC, Local or Europe/Berlin (defaults to Local).")
+	flags.StringVar(&args.separator, "separator", "\t", "Separator between key and value for key-value output.")
+	flags.BoolVar(&args.stripSchema, "strip-schema-id", false, "Remove the magic byte and schema id of Confluent framed values, presenting the id as schemaId and the remaining Avro data as base64 unless -encodevalue is given.")
+	flags.BoolVar(&args.embedJSON, "embed-json", false, "Nest values that are valid JSON as is under \"value\", rather than as a quoted string.")
+	flags.StringVar(&args.valueSchema, "value-schema", "", "Avro schema, inline or a path to an .avsc file, to decode plain Avro values without Confluent framing with, nesting them as JSON under \"value\".")
+	flags.IntVar(&args.unescape, "unescape-json", 0, "Decode values that are JSON strings up to this many times, to flatten double-encoded JSON.")
+	flags.StringVar(&args.guess, "guess", "", "Comma separated encodings to try in order for each key and value, labelling the first that fits, e.g. json,hex,base64,string.")
+	flags.BoolVar(&args.showCRC, "show-crc", false, "Include the CRC-32 (IEEE) checksum of the message value in the output.")
+	flags.BoolVar(&args.count, "count", false, "Only print the number of consumed messages, in total and per partition, once consuming stops.")
+	flags.BoolVar(&args.histogram, "size-histogram", false, "Only print a histogram of value sizes, in total and per partition, once a bounded read stops.")
+	flags.StringVar(&args.sizeBuckets, "size-buckets", "100,1000,10000,100000,1000000", "Comma separated upper bounds in bytes of the -size-histogram buckets.")
+	flags.BoolVar(&args.checkOrder, "check-ordering", false, "Only check that offsets per partition increase without gaps, warning on stderr about gaps and anomalies and printing a summary once consuming stops.")
+	flags.StringVar(&args.sortBy, "sort", "", "Buffer all messages of a bounded read and print them sorted by (offset|timestamp|key).")
+	addTLSFlags(flags, &args.tls)
+	flags.StringVar(&args.toTopic, "to-topic", "", "Produce the consumed messages to this topic, to the same partition, instead of printing them.")
+	flags.StringVar(&args.toBrokers, "to-brokers", "", "Comma separated list of brokers to produce to for -to-topic (defaults to -brokers).")
+	flags.StringVar(&args.toVersion, "to-version", "", "Kafka protocol version of -to-brokers, or auto to probe them for it (defaults to -version).")
+	flags.BoolVar(&args.keepTime, "keep-timestamp", false, "Keep the timestamps of messages produced to -to-topic, rather than having them set on send.")
+	addPrefixedTLSFlags(flags, "to-", &args.toTLS)
+	flags.BoolVar(&args.compact, "compact", false, "Buffer all messages of a bounded read and print only the last message per key, dropping keys whose last value is null.")
+	flags.IntVar(&args.dedupWindow, "dedup-window", 0, "Skip messages among the last N partition and offset pairs emitted by earlier runs, as recorded in -dedup-file (default 0 to disable).")
+	flags.StringVar(&args.dedupFile, "dedup-file", "", "File to record emitted partition and offset pairs in for -dedup-window (defaults to a file per topic in the temp dir).")
+	flags.StringVar(&args.cpFile, "checkpoint-file", "", "File to periodically record the offsets to resume from in, and to resume from when it exists.")
+	flags.DurationVar(&args.cpInterval, "checkpoint-interval", 5*time.Second, "Interval to write -checkpoint-file at.")
+	flags.StringVar(&args.fetchFile, "fetch-offsets", "", "File listing partition:offset pairs, one per line, to fetch exactly those messages in that order instead of -offsets.")
+	flags.DurationVar(&args.refresh, "metadata-refresh", 10*time.Minute, "Interval to refresh cluster metadata, such as partition leaders, in the background (default 0 to never refresh).")
+	flags.DurationVar(&args.lagWarn, "lag-warn", 0, "Interval to check if the lag to the newest offset grows, warning on stderr when it does (default 0 to disable).")
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of consume:")
 		flags.PrintDefaults()
-		fmt.Fprintln(os.Stderr, consumeDocString)
+		fmt.Fprintln(os.Stderr, consumeDocString+tlsDocString)
 		os.Exit(2)
 	}
 
 	flags.Parse(as)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "output":
+			args.outputGiven = true
+		case "message-format":
+			args.msgGiven = true
+		}
+	})
+
 	return args
 }
 
+// applyMessageFormat sets the output, separator, null literals and encoding of
+// args according to the -message-format preset. Flags given explicitly win
+// over the preset's choices.
+func applyMessageFormat(args *consumeArgs) error {
+	switch args.msgFormat {
+	case "json":
+		args.output = "json"
+	case "kafka-console":
+		args.output = "key-value"
+		if args.nullKey == "" {
+			args.nullKey = "null"
+		}
+		if args.nullValue == "" {
+			args.nullValue = "null"
+		}
+	case "logfmt":
+		args.output = "logfmt"
+	case "raw":
+		args.output = "values"
+		if args.encode == "" {
+			args.encode = "string"
+		}
+	default:
+		return fmt.Errorf(`unsupported -message-format %#v, only json, kafka-console, logfmt and raw are supported`, args.msgFormat)
+	}
+	return nil
+}
+
 func (cmd *consumeCmd) setupClient() {
 	var (
 		err error
@@ -272,6 +909,10 @@ func (cmd *consumeCmd) setupClient() {
 		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-consume-" + sanitizeUsername(usr.Username)
+	cfg.Consumer.Return.Errors = cmd.leaderOnly || cmd.fetchList != nil
+	cfg.ChannelBufferSize = cmd.chanBuffer
+	cfg.Metadata.RefreshFrequency = cmd.refresh
+	applyTLS(cfg, cmd.tlsConfig)
 	if cmd.verbose {
 		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
 	}
@@ -290,6 +931,13 @@ func (cmd *consumeCmd) run(args []string) {
 		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	if cmd.dedupWindow > 0 {
+		if cmd.window, err = openSeenWindow(cmd.dedupFile, cmd.dedupWindow); err != nil {
+			failf("failed to open -dedup-file err=%v", err)
+		}
+		defer logClose("dedup file", cmd.window)
+	}
+
 	cmd.setupClient()
 
 	if cmd.consumer, err = sarama.NewConsumerFromClient(cmd.client); err != nil {
@@ -297,100 +945,1512 @@ func (cmd *consumeCmd) run(args []string) {
 	}
 	defer logClose("consumer", cmd.consumer)
 
+	if cmd.fetchList != nil {
+		cmd.fetchListed()
+		return
+	}
+
 	partitions := cmd.findPartitions()
+	if cmd.leaderID >= 0 {
+		partitions = cmd.leaderPartitions(partitions)
+	}
 	if len(partitions) == 0 {
 		failf("Found no partitions to consume")
 	}
 
+	if cmd.group != "" {
+		cmd.resumeOffsets = cmd.fetchGroupOffsets(partitions)
+		cmd.committed = map[int32]int64{}
+		for p, o := range cmd.resumeOffsets {
+			cmd.committed[p] = o
+		}
+	}
+	if cmd.cpFile != "" {
+		cp, found, err := readCheckpoint(cmd.cpFile)
+		switch {
+		case err != nil:
+			failf("failed to read -checkpoint-file err=%v", err)
+		case found && cp.Topic != cmd.topic:
+			failf("-checkpoint-file %v is for topic %v, not %v", cmd.cpFile, cp.Topic, cmd.topic)
+		case found:
+			fmt.Fprintf(os.Stderr, "resuming from checkpoint %v\n", cmd.cpFile)
+			cmd.resumeOffsets = cp.Offsets
+		}
+	}
+
+	if cmd.toTopic != "" {
+		cmd.setupProducer()
+		defer logClose("producer", cmd.producer)
+	}
+
 	cmd.consume(partitions)
 }
 
-func (cmd *consumeCmd) consume(partitions []int32) {
+func (cmd *consumeCmd) setupProducer() {
 	var (
-		wg  sync.WaitGroup
-		out = make(chan printContext)
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
 	)
+	cfg.Version = cmd.toVersion
+	if usr, err = user.Current(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-consume-" + sanitizeUsername(usr.Username)
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	applyTLS(cfg, cmd.toTLSConfig)
 
-	go print(out, cmd.pretty)
-
-	wg.Add(len(partitions))
-	for _, p := range partitions {
-		go func(p int32) { defer wg.Done(); cmd.consumePartition(out, p) }(p)
+	if cmd.producer, err = sarama.NewSyncProducer(cmd.toBrokers, cfg); err != nil {
+		failf("failed to create producer for -to-topic err=%v", err)
 	}
-	wg.Wait()
 }
 
-func (cmd *consumeCmd) consumePartition(out chan printContext, partition int32) {
+// fetchGroupOffsets reads the committed offsets of cmd.group directly from
+// its coordinator. It never joins the group or commits, so the real group is
+// left untouched. Partitions without a committed offset are left out.
+func (cmd *consumeCmd) fetchGroupOffsets(partitions []int32) map[int32]int64 {
 	var (
-		offsets interval
-		err     error
-		pcon    sarama.PartitionConsumer
-		start   int64
-		end     int64
-		ok      bool
+		err    error
+		broker *sarama.Broker
+		resp   *sarama.OffsetFetchResponse
+		req    = &sarama.OffsetFetchRequest{ConsumerGroup: cmd.group, Version: cmd.offsetVersion}
+		result = map[int32]int64{}
 	)
 
-	if offsets, ok = cmd.offsets[partition]; !ok {
-		offsets, ok = cmd.offsets[-1]
+	if broker, err = cmd.client.Coordinator(cmd.group); err != nil {
+		failf("failed to find coordinator for group=%s err=%v", cmd.group, err)
 	}
 
-	if start, err = cmd.resolveOffset(offsets.start, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read start offset for partition %v err=%v\n", partition, err)
-		return
+	for _, p := range partitions {
+		req.AddPartition(cmd.topic, p)
 	}
 
-	if end, err = cmd.resolveOffset(offsets.end, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read end offset for partition %v err=%v\n", partition, err)
-		return
+	if resp, err = broker.FetchOffset(req); err != nil {
+		failf("failed to fetch offsets for group=%s err=%v", cmd.group, err)
 	}
 
-	if pcon, err = cmd.consumer.ConsumePartition(cmd.topic, partition, start); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to consume partition %v err=%v\n", partition, err)
-		return
+	for _, p := range partitions {
+		block := resp.GetBlock(cmd.topic, p)
+		switch {
+		case block == nil:
+			fmt.Fprintf(os.Stderr, "no offset for group=%s partition=%v in response, falling back to -offsets\n", cmd.group, p)
+		case block.Err != sarama.ErrNoError:
+			fmt.Fprintf(os.Stderr, "failed to fetch offset for group=%s partition=%v err=%v, falling back to -offsets\n", cmd.group, p, block.Err)
+		case block.Offset < 0:
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "group=%s has no committed offset for partition=%v, falling back to -offsets\n", cmd.group, p)
+			}
+		default:
+			result[p] = block.Offset
+		}
 	}
 
-	cmd.partitionLoop(out, pcon, partition, end)
+	return result
 }
 
-type consumedMessage struct {
-	Partition int32      `json:"partition"`
-	Offset    int64      `json:"offset"`
-	Key       *string    `json:"key"`
-	Value     *string    `json:"value"`
-	Timestamp *time.Time `json:"timestamp,omitempty"`
-}
+// fetchListed prints the messages at the -fetch-offsets in the order listed,
+// one after another, and fails once done if any of them no longer exist.
+func (cmd *consumeCmd) fetchListed() {
+	var (
+		missing    int
+		partitions []int32
+		seen       = map[int32]bool{}
+		out        = make(chan printContext)
+	)
 
-func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string) consumedMessage {
-	result := consumedMessage{
-		Partition: m.Partition,
-		Offset:    m.Offset,
-		Key:       encodeBytes(m.Key, encodeKey),
-		Value:     encodeBytes(m.Value, encodeValue),
+	for _, po := range cmd.fetchList {
+		if !seen[po.partition] {
+			seen[po.partition] = true
+			partitions = append(partitions, po.partition)
+		}
 	}
+	marks := fetchWatermarks(cmd.client, cmd.topic, partitions, make(chan struct{}, defaultOffsetConcurrency))
 
-	if !m.Timestamp.IsZero() {
-		result.Timestamp = &m.Timestamp
-	}
+	go print(out, cmd.pretty, cmd.color)
 
-	return result
-}
+	for _, po := range cmd.fetchList {
+		wm := marks[po.partition]
+		if wm.err != nil {
+			failf("failed to read offsets of partition %v err=%v", po.partition, wm.err)
+		}
+		if po.offset < wm.oldest || po.offset >= wm.newest {
+			fmt.Fprintf(os.Stderr, "offset %v of partition %v no longer exists, the partition holds offsets [%v, %v)\n", po.offset, po.partition, wm.oldest, wm.newest)
+			missing++
+			continue
+		}
 
-func encodeBytes(data []byte, encoding string) *string {
-	if data == nil {
-		return nil
+		msg, err := cmd.fetchMessage(po)
+		if err != nil {
+			failf("failed to fetch offset %v of partition %v err=%v", po.offset, po.partition, err)
+		}
+		if msg.Offset != po.offset {
+			fmt.Fprintf(os.Stderr, "offset %v of partition %v no longer exists, the next message is at offset %v\n", po.offset, po.partition, msg.Offset)
+			missing++
+			continue
+		}
+
+		if m, ok := cmd.format(msg); ok {
+			ctx := printContext{output: m, done: make(chan struct{})}
+			out <- ctx
+			<-ctx.done
+		}
 	}
 
-	var str string
-	switch encoding {
-	case "hex":
-		str = hex.EncodeToString(data)
-	case "base64":
-		str = base64.StdEncoding.EncodeToString(data)
-	default:
-		str = string(data)
+	if missing > 0 {
+		failf("%v of %v listed offsets no longer exist", missing, len(cmd.fetchList))
 	}
+}
 
-	return &str
+// fetchMessage returns the first message at or after po's offset, which is
+// later than the offset when compaction removed it.
+func (cmd *consumeCmd) fetchMessage(po partitionOffset) (*sarama.ConsumerMessage, error) {
+	pc, err := cmd.consumer.ConsumePartition(cmd.topic, po.partition, po.offset)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(fmt.Sprintf("partition consumer %v", po.partition), pc)
+
+	select {
+	case msg := <-pc.Messages():
+		return msg, nil
+	case err := <-pc.Errors():
+		return nil, err
+	case <-time.After(offsetTimeout):
+		return nil, fmt.Errorf("timed out after %s waiting for message", offsetTimeout)
+	}
+}
+
+func (cmd *consumeCmd) consume(partitions []int32) {
+	var (
+		wg  sync.WaitGroup
+		out = make(chan printContext)
+	)
+
+	go print(out, cmd.pretty, cmd.color)
+
+	if cmd.lagWarn > 0 {
+		go cmd.warnOnLagGrowth(partitions)
+	}
+
+	cmd.stop = make(chan struct{})
+	if cmd.maxWait > 0 {
+		cmd.markActivity()
+		go cmd.stopWhenIdle()
+	}
+	if cmd.exitAfter > 0 {
+		time.AfterFunc(cmd.exitAfter, func() {
+			cmd.stopConsuming(fmt.Sprintf("stopped consuming after %s", cmd.exitAfter))
+		})
+	}
+
+	q := make(chan struct{})
+	go listenForInterrupt(q)
+	go func() { <-q; cmd.stopConsuming("stopped consuming") }()
+
+	var cpDone chan struct{}
+	if cmd.cpFile != "" {
+		cpDone = make(chan struct{})
+		go cmd.checkpointPeriodically(cpDone)
+	}
+
+	var commitDone chan struct{}
+	if cmd.commitInterval > 0 {
+		commitDone = make(chan struct{})
+		go cmd.commitPeriodically(commitDone)
+	}
+
+	wg.Add(len(partitions))
+	for _, p := range partitions {
+		go func(p int32) { defer wg.Done(); cmd.consumePartition(out, p) }(p)
+	}
+	wg.Wait()
+
+	if cpDone != nil {
+		close(cpDone)
+		cmd.checkpoint()
+	}
+
+	if commitDone != nil {
+		close(commitDone)
+		cmd.commitOffsets()
+	}
+
+	if cmd.sortBy != "" || cmd.compact {
+		cmd.printBuffered(out)
+	}
+
+	if cmd.count {
+		ctx := printContext{output: cmd.countResult(partitions), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+
+	if cmd.checkOrder {
+		ctx := printContext{output: cmd.orderingResult(partitions), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+
+	if cmd.histogram {
+		ctx := printContext{output: cmd.histogramResult(partitions), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+
+	if cmd.toTopic != "" {
+		ctx := printContext{output: cmd.mirrorResult(partitions), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+}
+
+// checkpoint is the content of -checkpoint-file: the offset to resume from, one
+// past the last message handled, per partition of topic.
+type checkpoint struct {
+	Topic   string          `json:"topic"`
+	Offsets map[int32]int64 `json:"offsets"`
+}
+
+func (cmd *consumeCmd) checkpointPeriodically(done chan struct{}) {
+	ticker := time.NewTicker(cmd.cpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cmd.checkpoint()
+		}
+	}
+}
+
+// checkpoint writes the current positions to -checkpoint-file. Partitions that
+// haven't started yet keep the offset they were resumed from.
+func (cmd *consumeCmd) checkpoint() {
+	cp := checkpoint{Topic: cmd.topic, Offsets: map[int32]int64{}}
+	for p, o := range cmd.resumeOffsets {
+		cp.Offsets[p] = o
+	}
+
+	cmd.positionsMu.Lock()
+	for p, o := range cmd.positions {
+		cp.Offsets[p] = o
+	}
+	cmd.positionsMu.Unlock()
+
+	if err := writeCheckpoint(cmd.cpFile, cp); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write -checkpoint-file err=%v\n", err)
+	}
+}
+
+// readCheckpoint reads the checkpoint in path, found is false when there's no
+// file at path yet.
+func readCheckpoint(path string) (cp checkpoint, found bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+
+	if err = json.Unmarshal(data, &cp); err != nil {
+		return cp, false, fmt.Errorf("invalid checkpoint in %v err=%v", path, err)
+	}
+	return cp, true, nil
+}
+
+// writeCheckpoint replaces path with cp atomically by writing to a temporary
+// file in the same directory and renaming it, so a crash leaves either the
+// previous or the new checkpoint behind.
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(data, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// mirroredPartition counts the messages of a partition produced to -to-topic,
+// next is the offset of the partition to resume mirroring from.
+type mirroredPartition struct {
+	Count int64 `json:"count"`
+	Next  int64 `json:"next"`
+}
+
+type mirrorResult struct {
+	Topic      string                      `json:"topic"`
+	Total      int64                       `json:"total"`
+	Resume     string                      `json:"resume"`
+	Partitions map[int32]mirroredPartition `json:"partitions"`
+}
+
+// mirror produces msg to the same partition of cmd.toTopic. Null keys and
+// values are kept as such.
+func (cmd *consumeCmd) mirror(msg *sarama.ConsumerMessage) error {
+	pm := &sarama.ProducerMessage{Topic: cmd.toTopic, Partition: msg.Partition}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if msg.Value != nil {
+		pm.Value = sarama.ByteEncoder(msg.Value)
+	}
+	if cmd.keepTime {
+		pm.Timestamp = msg.Timestamp
+	}
+
+	if _, _, err := cmd.producer.SendMessage(pm); err != nil {
+		return err
+	}
+
+	cmd.mirroredMu.Lock()
+	defer cmd.mirroredMu.Unlock()
+	if cmd.mirrored == nil {
+		cmd.mirrored = map[int32]*mirroredPartition{}
+	}
+	mp, ok := cmd.mirrored[msg.Partition]
+	if !ok {
+		mp = &mirroredPartition{}
+		cmd.mirrored[msg.Partition] = mp
+	}
+	mp.Count++
+	mp.Next = msg.Offset + 1
+	return nil
+}
+
+// mirrorResult summarizes what was produced to cmd.toTopic. Resume is the
+// -offsets argument to continue mirroring where this run stopped.
+func (cmd *consumeCmd) mirrorResult(partitions []int32) mirrorResult {
+	cmd.mirroredMu.Lock()
+	defer cmd.mirroredMu.Unlock()
+
+	result := mirrorResult{Topic: cmd.toTopic, Partitions: map[int32]mirroredPartition{}}
+	var resume []string
+	for _, p := range partitions {
+		mp, ok := cmd.mirrored[p]
+		if !ok {
+			continue
+		}
+		result.Partitions[p] = *mp
+		result.Total += mp.Count
+		resume = append(resume, fmt.Sprintf("%v=%v", p, mp.Next))
+	}
+	result.Resume = strings.Join(resume, ",")
+	return result
+}
+
+// partitionOrdering summarizes the offsets read from a partition for
+// -check-ordering. Gaps are runs of skipped offsets, missing is the number of
+// offsets skipped, anomalies are offsets that didn't increase.
+type partitionOrdering struct {
+	Messages  int64 `json:"messages"`
+	First     int64 `json:"first"`
+	Last      int64 `json:"last"`
+	Gaps      int64 `json:"gaps"`
+	Missing   int64 `json:"missing"`
+	Anomalies int64 `json:"anomalies"`
+}
+
+// add records offset and returns a warning if it's not the one after the last
+// offset, or start for the partition's first message.
+func (po *partitionOrdering) add(start, offset int64) string {
+	expected := start
+	if po.Messages == 0 {
+		po.First = offset
+	} else {
+		expected = po.Last + 1
+	}
+
+	var warning string
+	switch {
+	case po.Messages > 0 && offset <= po.Last:
+		po.Anomalies++
+		warning = fmt.Sprintf("offset %v after %v does not increase", offset, po.Last)
+	case offset > expected:
+		po.Gaps++
+		po.Missing += offset - expected
+		warning = fmt.Sprintf("gap of %v offsets between %v and %v", offset-expected, expected, offset)
+	}
+
+	po.Messages++
+	if offset > po.Last || po.Messages == 1 {
+		po.Last = offset
+	}
+	return warning
+}
+
+func (cmd *consumeCmd) addOrdering(partition int32, start, offset int64) {
+	cmd.orderingMu.Lock()
+	defer cmd.orderingMu.Unlock()
+
+	if cmd.ordering == nil {
+		cmd.ordering = map[int32]*partitionOrdering{}
+	}
+	po, ok := cmd.ordering[partition]
+	if !ok {
+		po = &partitionOrdering{}
+		cmd.ordering[partition] = po
+	}
+	if warning := po.add(start, offset); warning != "" {
+		fmt.Fprintf(os.Stderr, "partition %v: %v\n", partition, warning)
+	}
+}
+
+type orderingResult struct {
+	Gaps       int64                       `json:"gaps"`
+	Missing    int64                       `json:"missing"`
+	Anomalies  int64                       `json:"anomalies"`
+	Partitions map[int32]partitionOrdering `json:"partitions"`
+}
+
+func (cmd *consumeCmd) orderingResult(partitions []int32) orderingResult {
+	cmd.orderingMu.Lock()
+	defer cmd.orderingMu.Unlock()
+
+	result := orderingResult{Partitions: map[int32]partitionOrdering{}}
+	for _, p := range partitions {
+		po, ok := cmd.ordering[p]
+		if !ok {
+			continue
+		}
+		result.Partitions[p] = *po
+		result.Gaps += po.Gaps
+		result.Missing += po.Missing
+		result.Anomalies += po.Anomalies
+	}
+	return result
+}
+
+// sizeHistogram counts messages by value size. Each bucket counts the values
+// of at most Le bytes that don't fit a smaller bucket, the last bucket with a
+// null Le counts the values larger than all bounds.
+type sizeHistogram struct {
+	Messages int64        `json:"messages"`
+	Bytes    int64        `json:"bytes"`
+	Max      int          `json:"max"`
+	Buckets  []sizeBucket `json:"buckets"`
+}
+
+type sizeBucket struct {
+	Le    *int64 `json:"le"`
+	Count int64  `json:"count"`
+}
+
+func newSizeHistogram(bounds []int64) *sizeHistogram {
+	h := &sizeHistogram{Buckets: make([]sizeBucket, len(bounds)+1)}
+	for i := range bounds {
+		h.Buckets[i].Le = &bounds[i]
+	}
+	return h
+}
+
+func (h *sizeHistogram) add(size int) {
+	h.Messages++
+	h.Bytes += int64(size)
+	if size > h.Max {
+		h.Max = size
+	}
+
+	i := sort.Search(len(h.Buckets)-1, func(i int) bool { return int64(size) <= *h.Buckets[i].Le })
+	h.Buckets[i].Count++
+}
+
+// parseSizeBuckets parses the -size-buckets bounds, which need to increase.
+func parseSizeBuckets(str string) ([]int64, error) {
+	var result []int64
+	for _, s := range strings.Split(str, ",") {
+		b, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || b < 0 || (len(result) > 0 && b <= result[len(result)-1]) {
+			return nil, fmt.Errorf("invalid -size-buckets %#v, expected increasing sizes in bytes", str)
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+func (cmd *consumeCmd) addSize(partition int32, size int) {
+	cmd.histogramsMu.Lock()
+	defer cmd.histogramsMu.Unlock()
+
+	if cmd.histograms == nil {
+		cmd.histograms = map[int32]*sizeHistogram{}
+	}
+	h, ok := cmd.histograms[partition]
+	if !ok {
+		h = newSizeHistogram(cmd.sizeBounds)
+		cmd.histograms[partition] = h
+	}
+	h.add(size)
+}
+
+type histogramResult struct {
+	Total      *sizeHistogram           `json:"total"`
+	Partitions map[int32]*sizeHistogram `json:"partitions"`
+}
+
+func (cmd *consumeCmd) histogramResult(partitions []int32) histogramResult {
+	cmd.histogramsMu.Lock()
+	defer cmd.histogramsMu.Unlock()
+
+	result := histogramResult{Total: newSizeHistogram(cmd.sizeBounds), Partitions: map[int32]*sizeHistogram{}}
+	for _, p := range partitions {
+		h, ok := cmd.histograms[p]
+		if !ok {
+			h = newSizeHistogram(cmd.sizeBounds)
+		}
+		result.Partitions[p] = h
+
+		result.Total.Messages += h.Messages
+		result.Total.Bytes += h.Bytes
+		if h.Max > result.Total.Max {
+			result.Total.Max = h.Max
+		}
+		for i, b := range h.Buckets {
+			result.Total.Buckets[i].Count += b.Count
+		}
+	}
+	return result
+}
+
+type consumeCount struct {
+	Total      int64           `json:"total"`
+	Partitions map[int32]int64 `json:"partitions"`
+}
+
+func (cmd *consumeCmd) markActivity() {
+	atomic.StoreInt64(&cmd.lastActivity, time.Now().UnixNano())
+}
+
+// stopWhenIdle closes cmd.stop once no message was received on any partition
+// for cmd.maxWait.
+func (cmd *consumeCmd) stopWhenIdle() {
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&cmd.lastActivity)))
+		if idle >= cmd.maxWait {
+			cmd.stopConsuming(fmt.Sprintf("stopped consuming after not receiving messages for %s", cmd.maxWait))
+			return
+		}
+		time.Sleep(cmd.maxWait - idle)
+	}
+}
+
+// stopConsuming closes cmd.stop to stop all partition consumers, noting why on
+// stderr. Only the first call has an effect.
+func (cmd *consumeCmd) stopConsuming(reason string) {
+	cmd.stopOnce.Do(func() {
+		fmt.Fprintln(os.Stderr, reason)
+		close(cmd.stop)
+	})
+}
+
+func (cmd *consumeCmd) addCount(partition int32) {
+	cmd.countsMu.Lock()
+	defer cmd.countsMu.Unlock()
+
+	if cmd.counts == nil {
+		cmd.counts = map[int32]int64{}
+	}
+	cmd.counts[partition]++
+}
+
+func (cmd *consumeCmd) countResult(partitions []int32) consumeCount {
+	cmd.countsMu.Lock()
+	defer cmd.countsMu.Unlock()
+
+	result := consumeCount{Partitions: map[int32]int64{}}
+	for _, p := range partitions {
+		result.Partitions[p] = cmd.counts[p]
+		result.Total += cmd.counts[p]
+	}
+	return result
+}
+
+func (cmd *consumeCmd) buffer(msg *sarama.ConsumerMessage) {
+	cmd.bufferedMu.Lock()
+	defer cmd.bufferedMu.Unlock()
+
+	cmd.buffered = append(cmd.buffered, msg)
+}
+
+// printBuffered prints the messages buffered for -sort or -compact in order.
+func (cmd *consumeCmd) printBuffered(out chan printContext) {
+	cmd.bufferedMu.Lock()
+	defer cmd.bufferedMu.Unlock()
+
+	if cmd.compact {
+		cmd.buffered = compactMessages(cmd.buffered)
+	}
+	sortMessages(cmd.buffered, cmd.sortBy)
+	for _, msg := range cmd.buffered {
+		if m, ok := cmd.format(msg); ok {
+			ctx := printContext{output: m, done: make(chan struct{})}
+			out <- ctx
+			<-ctx.done
+		}
+	}
+	cmd.buffered = nil
+}
+
+// compactMessages returns the last message per key of msgs, like log
+// compaction would eventually. Keys whose last message is a tombstone, i.e.
+// has a null value, are dropped, as are messages without a key. The last
+// message is the one with the higher offset within a partition, and the one
+// with the later timestamp across partitions.
+func compactMessages(msgs []*sarama.ConsumerMessage) []*sarama.ConsumerMessage {
+	last := map[string]*sarama.ConsumerMessage{}
+	for _, m := range msgs {
+		if m.Key == nil {
+			continue
+		}
+
+		prev, ok := last[string(m.Key)]
+		switch {
+		case !ok:
+		case prev.Partition == m.Partition && prev.Offset > m.Offset:
+			continue
+		case prev.Partition != m.Partition && prev.Timestamp.After(m.Timestamp):
+			continue
+		}
+		last[string(m.Key)] = m
+	}
+
+	result := []*sarama.ConsumerMessage{}
+	for _, m := range last {
+		if m.Value != nil {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// sortMessages sorts msgs by offset, timestamp or key. Ties are broken by
+// partition and offset so the order is deterministic.
+func sortMessages(msgs []*sarama.ConsumerMessage, by string) {
+	sort.Slice(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		switch by {
+		case "timestamp":
+			if !a.Timestamp.Equal(b.Timestamp) {
+				return a.Timestamp.Before(b.Timestamp)
+			}
+		case "key":
+			if c := bytes.Compare(a.Key, b.Key); c != 0 {
+				return c < 0
+			}
+		}
+
+		if a.Offset != b.Offset {
+			return a.Offset < b.Offset
+		}
+		return a.Partition < b.Partition
+	})
+}
+
+// setStart records that consuming partition starts at offset.
+func (cmd *consumeCmd) setStart(partition int32, offset int64) {
+	cmd.positionsMu.Lock()
+	if cmd.starts == nil {
+		cmd.starts = map[int32]int64{}
+	}
+	cmd.starts[partition] = offset
+	cmd.positionsMu.Unlock()
+
+	cmd.setPosition(partition, offset)
+}
+
+func (cmd *consumeCmd) commitPeriodically(done chan struct{}) {
+	ticker := time.NewTicker(cmd.commitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cmd.commitOffsets()
+		}
+	}
+}
+
+// commitOffsets commits the pending offsets to -from-group, a failed commit
+// is noted on stderr and retried with the next one.
+func (cmd *consumeCmd) commitOffsets() {
+	offsets := cmd.pendingCommits()
+	if len(offsets) == 0 {
+		return
+	}
+
+	if err := commitGroupOffsets(cmd.client, cmd.group, cmd.offsetVersion, cmd.topic, offsets); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	cmd.commitMu.Lock()
+	defer cmd.commitMu.Unlock()
+	if cmd.committed == nil {
+		cmd.committed = map[int32]int64{}
+	}
+	for p, o := range offsets {
+		cmd.committed[p] = o
+	}
+}
+
+// pendingCommits returns the offsets per partition that changed since the last
+// commit: one past the last handled message with -manual-commit, i.e. one
+// that was written, or one past the last received message otherwise.
+func (cmd *consumeCmd) pendingCommits() map[int32]int64 {
+	offsets := map[int32]int64{}
+	if cmd.manualCommit {
+		cmd.positionsMu.Lock()
+		for p, o := range cmd.positions {
+			offsets[p] = o
+		}
+		cmd.positionsMu.Unlock()
+	}
+
+	cmd.commitMu.Lock()
+	defer cmd.commitMu.Unlock()
+	if !cmd.manualCommit {
+		for p, o := range cmd.consumed {
+			offsets[p] = o
+		}
+	}
+	for p, o := range offsets {
+		if c, ok := cmd.committed[p]; ok && c == o {
+			delete(offsets, p)
+		}
+	}
+	return offsets
+}
+
+// setConsumed records offset as the next to commit for partition without
+// -manual-commit.
+func (cmd *consumeCmd) setConsumed(partition int32, offset int64) {
+	cmd.commitMu.Lock()
+	defer cmd.commitMu.Unlock()
+
+	if cmd.consumed == nil {
+		cmd.consumed = map[int32]int64{}
+	}
+	cmd.consumed[partition] = offset
+}
+
+func (cmd *consumeCmd) setPosition(partition int32, offset int64) {
+	cmd.positionsMu.Lock()
+	defer cmd.positionsMu.Unlock()
+
+	if cmd.positions == nil {
+		cmd.positions = map[int32]int64{}
+	}
+	cmd.positions[partition] = offset
+}
+
+// partitionStart returns the offset consuming partition started at.
+func (cmd *consumeCmd) partitionStart(partition int32) int64 {
+	cmd.positionsMu.Lock()
+	defer cmd.positionsMu.Unlock()
+
+	return cmd.starts[partition]
+}
+
+func (cmd *consumeCmd) position(partition int32) (int64, bool) {
+	cmd.positionsMu.Lock()
+	defer cmd.positionsMu.Unlock()
+
+	offset, ok := cmd.positions[partition]
+	return offset, ok
+}
+
+// warnOnLagGrowth compares the position of each partition consumer to the
+// partition's newest offset every cmd.lagWarn and warns when the lag grew
+// since the last check, i.e. we're falling behind the producers.
+func (cmd *consumeCmd) warnOnLagGrowth(partitions []int32) {
+	var (
+		limit = make(chan struct{}, defaultOffsetConcurrency)
+		lags  = map[int32]int64{}
+	)
+
+	for range time.Tick(cmd.lagWarn) {
+		marks := fetchWatermarks(cmd.client, cmd.topic, partitions, limit)
+		for _, p := range partitions {
+			pos, ok := cmd.position(p)
+			if !ok {
+				continue
+			}
+
+			wm := marks[p]
+			if wm.err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read newest offset for partition %v err=%v\n", p, wm.err)
+				continue
+			}
+
+			lag := wm.newest - pos
+			if prev, ok := lags[p]; ok && lag > prev {
+				fmt.Fprintf(os.Stderr, "lag on partition %v grew from %v to %v messages in %s\n", p, prev, lag, cmd.lagWarn)
+			}
+			lags[p] = lag
+		}
+	}
+}
+
+// partitionInterval returns the interval to consume for partition, an interval
+// given for the partition explicitly takes precedence over the one for all.
+func (cmd *consumeCmd) partitionInterval(partition int32) interval {
+	if i, ok := cmd.offsets[partition]; ok {
+		return i
+	}
+	return cmd.offsets[-1]
+}
+
+func (cmd *consumeCmd) consumePartition(out chan printContext, partition int32) {
+	var (
+		offsets interval
+		err     error
+		pcon    sarama.PartitionConsumer
+		start   int64
+		end     int64
+		ok      bool
+	)
+
+	offsets = cmd.partitionInterval(partition)
+
+	if cmd.leaderOnly && !cmd.awaitLeader(partition) {
+		return
+	}
+
+	if start, ok = cmd.resumeOffsets[partition]; !ok {
+		if start, err = cmd.resolveOffset(offsets.start, partition); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read start offset for partition %v err=%v\n", partition, err)
+			return
+		}
+	}
+
+	if end, err = cmd.resolveOffset(offsets.end, partition); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read end offset for partition %v err=%v\n", partition, err)
+		return
+	}
+
+	// A time based end resolves to the first message at or after that time,
+	// the last message to read is the one before it.
+	if offsets.end.timeBased() {
+		end--
+		if end < start {
+			return
+		}
+	}
+
+	if pcon, err = cmd.consumer.ConsumePartition(cmd.topic, partition, start); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to consume partition %v err=%v\n", partition, err)
+		return
+	}
+
+	cmd.setStart(partition, start)
+	cmd.partitionLoop(out, pcon, partition, end)
+}
+
+// leaderRetryInterval is how long to wait before checking again for a leader
+// of a partition that has none.
+var leaderRetryInterval = time.Second
+
+// awaitLeader waits until partition has a leader, refreshing the topic's
+// metadata in between, and reports whether it has one. It returns false if
+// consuming is stopped while waiting.
+func (cmd *consumeCmd) awaitLeader(partition int32) bool {
+	for warned := false; ; warned = true {
+		_, err := cmd.client.Leader(cmd.topic, partition)
+		if err == nil {
+			if warned {
+				fmt.Fprintf(os.Stderr, "partition %v has a leader again\n", partition)
+			}
+			return true
+		}
+		if !warned {
+			fmt.Fprintf(os.Stderr, "partition %v has no leader, waiting for one err=%v\n", partition, err)
+		}
+
+		select {
+		case <-cmd.stop:
+			return false
+		case <-time.After(leaderRetryInterval):
+		}
+		if err = cmd.client.RefreshMetadata(cmd.topic); err != nil && cmd.verbose {
+			fmt.Fprintf(os.Stderr, "failed to refresh metadata for partition %v err=%v\n", partition, err)
+		}
+	}
+}
+
+// isLeaderError reports whether err means a partition's leader moved or is
+// offline, which the partition consumer recovers from on its own.
+func isLeaderError(err error) bool {
+	switch err {
+	case sarama.ErrNotLeaderForPartition, sarama.ErrLeaderNotAvailable, sarama.ErrUnknownTopicOrPartition, sarama.ErrReplicaNotAvailable:
+		return true
+	}
+	return false
+}
+
+// consumedMessage is the json output for a message. Value holds the encoded
+// value as *string, or a json.RawMessage for values embedded via -embed-json.
+type consumedMessage struct {
+	Partition  int32       `json:"partition"`
+	Offset     int64       `json:"offset"`
+	Key        *string     `json:"key"`
+	Value      interface{} `json:"value"`
+	KeyGuess   string      `json:"keyGuess,omitempty"`
+	ValueGuess string      `json:"valueGuess,omitempty"`
+	Timestamp  *timestamp  `json:"timestamp,omitempty"`
+	CRC        *uint32     `json:"crc,omitempty"`
+	SchemaID   *int32      `json:"schemaId,omitempty"`
+}
+
+// timestamp is a message timestamp that's marshalled according to layout: as
+// RFC 3339 by default, as seconds or milliseconds since the epoch for unix and
+// unixmilli, or formatted with layout as a Go time layout otherwise.
+type timestamp struct {
+	time.Time
+	layout string
+}
+
+func (t timestamp) MarshalJSON() ([]byte, error) {
+	switch t.layout {
+	case "":
+		return t.Time.MarshalJSON()
+	case "unix":
+		return []byte(strconv.FormatInt(t.Unix(), 10)), nil
+	case "unixmilli":
+		return []byte(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)), nil
+	default:
+		return json.Marshal(t.Format(t.layout))
+	}
+}
+
+func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string) consumedMessage {
+	result := consumedMessage{
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       encodeBytes(m.Key, encodeKey),
+		Value:     encodeJSONValue(m.Value, encodeValue),
+	}
+
+	if !m.Timestamp.IsZero() {
+		result.Timestamp = &timestamp{Time: m.Timestamp}
+	}
+
+	return result
+}
+
+// connectRecord approximates a Kafka Connect SourceRecord, with key and value
+// as serialized by Connect's JsonConverter with schemas enabled, for connect
+// output. The source partition and offset locate the message in Kafka.
+type connectRecord struct {
+	Topic           string                 `json:"topic"`
+	KafkaPartition  int32                  `json:"kafkaPartition"`
+	SourcePartition connectSourcePartition `json:"sourcePartition"`
+	SourceOffset    connectSourceOffset    `json:"sourceOffset"`
+	Timestamp       *int64                 `json:"timestamp"`
+	Key             connectEnvelope        `json:"key"`
+	Value           connectEnvelope        `json:"value"`
+}
+
+type connectSourcePartition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+}
+
+type connectSourceOffset struct {
+	Offset int64 `json:"offset"`
+}
+
+type connectEnvelope struct {
+	Schema  connectSchema `json:"schema"`
+	Payload *string       `json:"payload"`
+}
+
+type connectSchema struct {
+	Type     string `json:"type"`
+	Optional bool   `json:"optional"`
+}
+
+func newConnectRecord(m *sarama.ConsumerMessage, encodeKey, encodeValue string) connectRecord {
+	result := connectRecord{
+		Topic:           m.Topic,
+		KafkaPartition:  m.Partition,
+		SourcePartition: connectSourcePartition{Topic: m.Topic, Partition: m.Partition},
+		SourceOffset:    connectSourceOffset{Offset: m.Offset},
+		Key:             newConnectEnvelope(m.Key, encodeKey),
+		Value:           newConnectEnvelope(m.Value, encodeValue),
+	}
+
+	if !m.Timestamp.IsZero() {
+		ms := m.Timestamp.UnixNano() / int64(time.Millisecond)
+		result.Timestamp = &ms
+	}
+
+	return result
+}
+
+// newConnectEnvelope returns data with an optional string schema, or an
+// optional bytes schema for base64 as Connect represents bytes in JSON.
+func newConnectEnvelope(data []byte, encoding string) connectEnvelope {
+	typ := "string"
+	if encoding == "base64" {
+		typ = "bytes"
+	}
+	return connectEnvelope{
+		Schema:  connectSchema{Type: typ, Optional: true},
+		Payload: encodeBytes(data, encoding),
+	}
+}
+
+func encodeBytes(data []byte, encoding string) *string {
+	if data == nil {
+		return nil
+	}
+
+	var str string
+	switch encoding {
+	case "hex":
+		str = hex.EncodeToString(data)
+	case "base64":
+		str = base64.StdEncoding.EncodeToString(data)
+	case "base64url":
+		str = base64.RawURLEncoding.EncodeToString(data)
+	case "cbor":
+		var err error
+		if str, err = cborToJSON(data); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode CBOR, presenting as base64 instead err=%v\n", err)
+			str = base64.StdEncoding.EncodeToString(data)
+		}
+	default:
+		str = string(data)
+	}
+
+	return &str
+}
+
+// encodeJSONValue returns data encoded for the value of JSON output: CBOR is
+// embedded as JSON, all other encodings as strings via encodeBytes.
+func encodeJSONValue(data []byte, encoding string) interface{} {
+	if encoding == "cbor" && data != nil {
+		if str, err := cborToJSON(data); err == nil {
+			return json.RawMessage(str)
+		}
+	}
+	return encodeBytes(data, encoding)
+}
+
+// format returns the output for msg according to the configured output mode,
+// and false when msg should be skipped.
+func (cmd *consumeCmd) format(msg *sarama.ConsumerMessage) (interface{}, bool) {
+	switch cmd.output {
+	case "keys":
+		key := encodeBytes(msg.Key, cmd.encodeKey)
+		if key == nil {
+			if cmd.nullKey == "" {
+				return nil, false
+			}
+			key = &cmd.nullKey
+		}
+		if cmd.dedup && !cmd.markSeen(*key) {
+			return nil, false
+		}
+		return rawOutput(*key + "\n"), true
+	case "values":
+		value := cmd.nullValue
+		if v := encodeBytes(msg.Value, cmd.encodeValue); v != nil {
+			value = *v
+		}
+		return rawOutput(value + "\n"), true
+	case "logfmt":
+		return rawOutput(cmd.formatLogfmt(msg)), true
+	case "connect":
+		return newConnectRecord(msg, cmd.encodeKey, cmd.encodeValue), true
+	case "frames":
+		var frames []byte
+		if cmd.keyFrames {
+			frames = appendFrame(frames, msg.Key)
+		}
+		return rawOutput(appendFrame(frames, msg.Value)), true
+	case "key-value":
+		key, value := cmd.nullKey, cmd.nullValue
+		if k := encodeBytes(msg.Key, cmd.encodeKey); k != nil {
+			key = *k
+		}
+		if v := encodeBytes(msg.Value, cmd.encodeValue); v != nil {
+			value = *v
+		}
+		return rawOutput(key + cmd.separator + value + "\n"), true
+	default:
+		m := newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue)
+		if cmd.stripSchema && msg.Value != nil {
+			id, data, err := stripSchemaID(msg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping offset %v of partition %v err=%v\n", msg.Offset, msg.Partition, err)
+				return nil, false
+			}
+			m.Value = encodeJSONValue(data, cmd.encodeValue)
+			m.SchemaID = &id
+		}
+		if cmd.valueSchema != nil && msg.Value != nil {
+			raw, err := avroToJSON(cmd.valueSchema, msg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping offset %v of partition %v, failed to decode value with -value-schema err=%v\n", msg.Offset, msg.Partition, err)
+				return nil, false
+			}
+			m.Value = raw
+		}
+		if cmd.guess != nil {
+			cmd.applyGuess(&m, msg)
+		}
+		value := msg.Value
+		if cmd.unescape > 0 && value != nil {
+			value = unescapeJSON(value, cmd.unescape)
+			m.Value = encodeJSONValue(value, cmd.encodeValue)
+		}
+		if cmd.embedJSON {
+			if raw, ok := compactJSON(value); ok {
+				m.Value = raw
+			}
+		}
+		if m.Timestamp != nil {
+			m.Timestamp.layout = cmd.timeFormat
+			if cmd.timeZone != nil {
+				m.Timestamp.Time = m.Timestamp.In(cmd.timeZone)
+			}
+		}
+		if cmd.showCRC && msg.Value != nil {
+			crc := crc32.ChecksumIEEE(msg.Value)
+			m.CRC = &crc
+		}
+		return m, true
+	}
+}
+
+// formatLogfmt returns msg as a logfmt line of its partition, offset, key,
+// value and timestamp. Null keys and values are left out.
+func (cmd *consumeCmd) formatLogfmt(msg *sarama.ConsumerMessage) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "partition=%v offset=%v", msg.Partition, msg.Offset)
+	if k := encodeBytes(msg.Key, cmd.encodeKey); k != nil {
+		fmt.Fprintf(buf, " key=%v", logfmtValue(*k))
+	}
+	if v := encodeBytes(msg.Value, cmd.encodeValue); v != nil {
+		fmt.Fprintf(buf, " value=%v", logfmtValue(*v))
+	}
+	if !msg.Timestamp.IsZero() {
+		ts := timestamp{Time: msg.Timestamp, layout: cmd.timeFormat}
+		if cmd.timeZone != nil {
+			ts.Time = ts.In(cmd.timeZone)
+		}
+		if data, err := ts.MarshalJSON(); err == nil {
+			var str string
+			if json.Unmarshal(data, &str) != nil {
+				str = string(data)
+			}
+			fmt.Fprintf(buf, " timestamp=%v", logfmtValue(str))
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.String()
+}
+
+// logfmtValue quotes str when it's empty or contains spaces, quotes, equal
+// signs or unprintable characters, and returns it as is otherwise.
+func logfmtValue(str string) string {
+	if str == "" {
+		return `""`
+	}
+	for _, r := range str {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r) {
+			return strconv.Quote(str)
+		}
+	}
+	return str
+}
+
+// confluentMagicByte starts values in the Confluent wire format, followed by
+// the 4-byte big-endian schema id and the Avro encoded data.
+const confluentMagicByte = 0
+
+// stripSchemaID splits a value in the Confluent wire format into its schema id
+// and the Avro encoded data.
+func stripSchemaID(value []byte) (int32, []byte, error) {
+	if len(value) < 5 || value[0] != confluentMagicByte {
+		return 0, nil, fmt.Errorf("value doesn't start with the magic byte and schema id of the Confluent wire format")
+	}
+	return int32(binary.BigEndian.Uint32(value[1:5])), value[5:], nil
+}
+
+var guessEncodings = []string{"string", "hex", "base64", "json"}
+
+// parseGuessOrder parses the comma separated encodings for -guess.
+func parseGuessOrder(str string) ([]string, error) {
+	var order []string
+	for _, e := range strings.Split(str, ",") {
+		e = strings.TrimSpace(e)
+		valid := false
+		for _, g := range guessEncodings {
+			valid = valid || e == g
+		}
+		if !valid {
+			return nil, fmt.Errorf("unsupported -guess encoding %#v, only %v are supported", e, strings.Join(guessEncodings, ", "))
+		}
+		order = append(order, e)
+	}
+	return order, nil
+}
+
+// guessEncoding returns the first of order that data is valid in: printable
+// UTF-8 text for string, the text encoding of bytes for hex and base64, or a
+// JSON document for json. It returns raw if none fits.
+func guessEncoding(data []byte, order []string) string {
+	for _, e := range order {
+		switch e {
+		case "string":
+			if utf8.Valid(data) && strings.IndexFunc(string(data), isUnprintable) < 0 {
+				return e
+			}
+		case "hex":
+			if _, err := hex.DecodeString(string(data)); err == nil && len(data) > 0 {
+				return e
+			}
+		case "base64":
+			if _, err := base64.StdEncoding.DecodeString(string(data)); err == nil && len(data) > 0 {
+				return e
+			}
+		case "json":
+			if json.Valid(data) {
+				return e
+			}
+		}
+	}
+	return "raw"
+}
+
+func isUnprintable(r rune) bool {
+	return r != '\t' && r != '\n' && r != '\r' && !unicode.IsPrint(r)
+}
+
+// applyGuess labels the key and value of m with the guessed encodings of
+// msg's. JSON values are embedded as is, raw keys and values are printed as
+// base64, all others as strings.
+func (cmd *consumeCmd) applyGuess(m *consumedMessage, msg *sarama.ConsumerMessage) {
+	if msg.Key != nil {
+		m.KeyGuess = guessEncoding(msg.Key, cmd.guess)
+		if m.KeyGuess == "raw" {
+			m.Key = encodeBytes(msg.Key, "base64")
+		}
+	}
+
+	if msg.Value != nil {
+		m.ValueGuess = guessEncoding(msg.Value, cmd.guess)
+		switch m.ValueGuess {
+		case "raw":
+			m.Value = encodeBytes(msg.Value, "base64")
+		case "json":
+			m.Value, _ = compactJSON(msg.Value)
+		}
+	}
+}
+
+// appendFrame appends data to buf as a frame for frames output: a 4-byte
+// big-endian signed length, -1 for null, followed by data.
+func appendFrame(buf, data []byte) []byte {
+	length := int32(len(data))
+	if data == nil {
+		length = -1
+	}
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(length))
+	return append(append(buf, prefix[:]...), data...)
+}
+
+// compactJSON returns value without insignificant whitespace if it's valid
+// JSON, so it can be embedded in the output as is.
+func compactJSON(value []byte) (json.RawMessage, bool) {
+	if value == nil {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return nil, false
+	}
+	return json.RawMessage(buf.Bytes()), true
+}
+
+// unescapeJSON decodes value up to n times while it's a JSON string, to
+// flatten values that were JSON encoded more than once. It stops early at the
+// first level that isn't a valid JSON string and returns what was decoded.
+func unescapeJSON(value []byte, n int) []byte {
+	for i := 0; i < n; i++ {
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			break
+		}
+		value = []byte(str)
+	}
+	return value
+}
+
+// markSeen records key and reports whether it was seen for the first time.
+func (cmd *consumeCmd) markSeen(key string) bool {
+	cmd.seenMu.Lock()
+	defer cmd.seenMu.Unlock()
+
+	if cmd.seen == nil {
+		cmd.seen = map[string]struct{}{}
+	}
+	if _, ok := cmd.seen[key]; ok {
+		return false
+	}
+	cmd.seen[key] = struct{}{}
+	return true
+}
+
+// seenWindow is a bounded set of the most recently seen keys, it evicts the
+// least recently seen key once it holds more than size keys. Keys are appended
+// to file once recorded, so they survive restarts, and the file is rewritten
+// with only the keys in the window whenever size keys were appended and on
+// Close, so it stays bounded.
+type seenWindow struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	entries  map[string]*list.Element
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	appended int
+}
+
+// openSeenWindow loads the keys recorded in path, and rewrites it with only
+// the ones that fit in the window so the file doesn't grow across runs.
+func openSeenWindow(path string, size int) (*seenWindow, error) {
+	w := &seenWindow{size: size, order: list.New(), entries: map[string]*list.Element{}, path: path}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, k := range strings.Split(string(buf), "\n") {
+		if k != "" {
+			w.touch(k)
+		}
+	}
+
+	if err = w.rewrite(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// seen reports whether key is in the window, marking it as recently seen if
+// so.
+func (w *seenWindow) seen(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[key]
+	if ok {
+		w.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// record adds key to the window and the file, it's called once the message
+// of key was emitted.
+func (w *seenWindow) record(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.touch(key)
+	if _, err := fmt.Fprintln(w.buf, key); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to record %v in dedup file err=%v\n", key, err)
+	}
+	if w.appended++; w.appended >= w.size {
+		if err := w.rewrite(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rewrite dedup file err=%v\n", err)
+		}
+	}
+}
+
+// touch moves key to the front of the window, evicting the least recently
+// seen key if the window is full, and reports whether key was present.
+func (w *seenWindow) touch(key string) bool {
+	if e, ok := w.entries[key]; ok {
+		w.order.MoveToFront(e)
+		return true
+	}
+
+	w.entries[key] = w.order.PushFront(key)
+	if w.order.Len() > w.size {
+		oldest := w.order.Back()
+		w.order.Remove(oldest)
+		delete(w.entries, oldest.Value.(string))
+	}
+	return false
+}
+
+// rewrite replaces the file with the keys in the window, least recently seen
+// first, and reopens it to append further keys. Keys still buffered are part
+// of the window, so the buffer is dropped rather than flushed.
+func (w *seenWindow) rewrite() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+
+	var kept bytes.Buffer
+	for e := w.order.Back(); e != nil; e = e.Prev() {
+		kept.WriteString(e.Value.(string) + "\n")
+	}
+	tmp := w.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+
+	var err error
+	if w.file, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	w.buf = bufio.NewWriter(w.file)
+	w.appended = 0
+	return nil
+}
+
+func (w *seenWindow) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.rewrite(); err != nil {
+		return err
+	}
+	return w.file.Close()
 }
 
 func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionConsumer, p int32, end int64) {
@@ -413,7 +2473,13 @@ func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionC
 		case <-timeout:
 			fmt.Fprintf(os.Stderr, "consuming from partition %v timed out after %s\n", p, cmd.timeout)
 			return
+		case <-cmd.stop:
+			return
 		case err := <-pc.Errors():
+			if cmd.leaderOnly && isLeaderError(err.Err) {
+				fmt.Fprintf(os.Stderr, "partition %v changed leaders, continuing with the new leader err=%v\n", p, err.Err)
+				continue
+			}
 			fmt.Fprintf(os.Stderr, "partition %v consumer encountered err %s", p, err)
 			return
 		case msg, ok := <-pc.Messages():
@@ -422,12 +2488,46 @@ func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionC
 				return
 			}
 
-			m := newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue)
-			ctx := printContext{output: m, done: make(chan struct{})}
-			out <- ctx
-			<-ctx.done
+			if cmd.maxWait > 0 {
+				cmd.markActivity()
+			}
+			if cmd.commitInterval > 0 && !cmd.manualCommit {
+				cmd.setConsumed(p, msg.Offset+1)
+			}
+
+			var windowKey string
+			if cmd.window != nil {
+				windowKey = fmt.Sprintf("%v/%v/%v", cmd.topic, p, msg.Offset)
+			}
+			dup := cmd.window != nil && cmd.window.seen(windowKey)
+			if dup {
+				// emitted by an earlier run already.
+			} else if cmd.count {
+				cmd.addCount(p)
+			} else if cmd.checkOrder {
+				cmd.addOrdering(p, cmd.partitionStart(p), msg.Offset)
+			} else if cmd.histogram {
+				cmd.addSize(p, len(msg.Value))
+			} else if cmd.toTopic != "" {
+				if err := cmd.mirror(msg); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to produce offset %v of partition %v to %v err=%v\n", msg.Offset, p, cmd.toTopic, err)
+					return
+				}
+			} else if cmd.sortBy != "" || cmd.compact {
+				cmd.buffer(msg)
+			} else if m, ok := cmd.format(msg); ok {
+				ctx := printContext{output: m, done: make(chan struct{})}
+				out <- ctx
+				<-ctx.done
+			}
+			if cmd.window != nil && !dup {
+				cmd.window.record(windowKey)
+			}
+			cmd.setPosition(p, msg.Offset+1)
 
-			if end > 0 && msg.Offset >= end {
+			// end is the last offset to read, negative ends leave the
+			// range open.
+			if end >= 0 && msg.Offset >= end {
 				return
 			}
 		}
@@ -457,6 +2557,25 @@ func (cmd *consumeCmd) findPartitions() []int32 {
 	return res
 }
 
+// leaderPartitions returns the partitions that broker cmd.leaderID leads, and
+// notes them on stderr.
+func (cmd *consumeCmd) leaderPartitions(partitions []int32) []int32 {
+	var res []int32
+	for _, p := range partitions {
+		leader, err := cmd.client.Leader(cmd.topic, p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to find leader for partition %v err=%v\n", p, err)
+			continue
+		}
+		if leader.ID() == cmd.leaderID {
+			res = append(res, p)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "broker %v leads partitions %v\n", cmd.leaderID, res)
+	return res
+}
+
 var consumeDocString = `
 The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
@@ -468,16 +2587,35 @@ Offsets can be specified as a comma-separated list of intervals:
 The default is to consume from the oldest offset on every partition for the given topic.
 
  - partition is the numeric identifier for a partition. You can use "all" to
-   specify a default interval for all partitions.
+   specify a default interval for all partitions, an interval given for a
+   partition explicitly takes precedence over it. Each partition may only be
+   given once, and whitespace around the separators is ignored.
 
  - start is the included offset where consumption should start.
 
  - end is the included offset where consumption should end.
 
+Keys and values are presented as plain strings by default. Use -encode to
+present both as hex, base64 or base64url (the URL-safe alphabet without
+padding), and -encodekey or -encodevalue to set either one independently, they
+override -encode. The environment variables KT_ENCODE_KEY and KT_ENCODE_VALUE
+are used when neither flag is given.
+
+With cbor, CBOR data is presented as JSON. Values are embedded in the JSON
+output, e.g. "value":{"temp":21.5}, while keys and the values of the other
+output modes are the JSON text as a string. Byte strings become base64url
+strings and tags are dropped. Data that isn't valid CBOR, or has no JSON
+equivalent like NaN or non-string map keys, is presented as base64 with a note
+on stderr.
+
 The following syntax is supported for each offset:
 
   (oldest|newest)?(+|-)?(\d+)?
 
+or to refer to a point in time relative to now:
+
+  last:duration
+
  - "oldest" and "newest" refer to the oldest and newest offsets known for a
    given partition.
 
@@ -544,4 +2682,332 @@ and
 
 Will achieve the same as the two examples above.
 
+To consume the messages of the last hour, starting at the first offset with a
+timestamp no older than one hour:
+
+  all=last:1h
+
+The duration is parsed as a Go duration, e.g. 90s, 15m or 1h30m. If the
+partition's retention is shorter than the duration, consumption starts at the
+oldest offset. Time based offsets rely on message timestamps and require
+-version v0.10.1.0 or later.
+
+While -timeout stops each partition consumer on its own, -max-wait stops
+consuming altogether once no message arrived on any partition for the given
+duration, printing what was read so far. This keeps bounded reads against
+quiet topics from waiting indefinitely, e.g. in CI:
+
+  -offsets all=oldest:newest -max-wait 10s
+
+A note is printed to stderr when kt stops due to -max-wait.
+
+To capture a fixed amount of wall-clock time instead, e.g. one minute of
+traffic, -exit-after stops consuming after the given duration regardless of
+whether messages are still arriving:
+
+  -offsets all=newest -exit-after 1m
+
+An interrupt, e.g. via ctrl-c, stops consuming the same way. In either case,
+what was read so far is printed before kt exits, including the output of
+-count, -size-histogram, -sort and -compact. A second interrupt exits
+immediately.
+
+Messages are printed one at a time, and each partition consumer waits for its
+message to be printed before handing over the next, so slow output, e.g. a slow
+terminal or pipe, holds back consuming. Meanwhile up to -buffer messages per
+partition, 256 by default, are buffered, plus the fetch response being read.
+For huge messages a small buffer keeps memory bounded, at the cost of
+throughput, down to 0 to only hold the fetch response in progress:
+
+  -offsets all=oldest: -buffer 1
+
+-sort and -compact still hold all messages read until the end.
+
+To read a time window on all partitions and exit, e.g. the messages from two
+to one hours ago:
+
+  -since 2h -until 1h
+
+-since and -until accept RFC3339 times like 2017-06-01T12:00:00Z or durations
+to go back from now, and are resolved to offsets per partition via the message
+timestamps at startup. They replace -offsets and require -version v0.10.1.0 or
+later. Without -until, kt keeps reading new messages.
+
+To replay what the consumer group "billing" has yet to process, without
+joining the group or committing any offsets:
+
+  -from-group billing
+
+Partitions without a committed offset for the group fall back to the start
+offset given via -offsets. For groups that store their offsets in ZooKeeper,
+as consumers before v0.9.0.0 did, add -offset-storage zookeeper.
+
+To also commit the group's progress, -commit-interval commits the offset after
+the last received message per partition at that interval and once consuming
+stops. kt commits without joining the group, so brokers reject the commits
+while the group has active members. As messages are committed when they're
+received, a crash can commit messages that were never written, and the next
+run skips them. -manual-commit commits a message only once it's written to
+stdout, or produced to -to-topic, every -commit-interval or every second by
+default. A crash then never skips a message, but the next run may print the
+messages since the last commit again:
+
+  -from-group billing -manual-commit -commit-interval 5s
+
+To pick up where the last run left off without a consumer group, use
+-checkpoint-file:
+
+  -checkpoint-file orders.checkpoint
+
+Every -checkpoint-interval, 5 seconds by default, and once consuming stops, kt
+writes the offset to resume from per partition to the file, e.g.
+
+  {"topic":"orders","offsets":{"0":20,"1":22}}
+
+The offset is one past the last message printed, so after a crash the next run
+may print messages since the last checkpoint again, but never skips any. When
+the file exists, partitions start at its offsets instead of -offsets, others
+fall back to -offsets. The file is replaced atomically by renaming a temporary
+file next to it, so a crash never leaves a partial checkpoint. kt assumes it's
+the only process using a checkpoint file, concurrent runs with the same file
+overwrite each other's checkpoints.
+
+To re-examine a known set of messages, list them as partition:offset pairs,
+one per line, in a file for -fetch-offsets:
+
+  $ cat bad-records.txt
+  # found by the billing reconciliation
+  0:1023
+  2:17
+  0:998
+  $ kt consume -topic orders -fetch-offsets bad-records.txt
+
+kt fetches exactly these messages and prints them in the order listed.
+Offsets that no longer exist, because retention or compaction removed them,
+are reported on stderr, and kt exits with an error once the others are
+printed.
+
+To print the set of live keys of a compacted topic, one per line:
+
+  -output keys -dedup -timeout 1s
+
+Null keys are skipped unless -null-key provides a literal to print instead.
+Keys are presented according to -encodekey, consider hex or base64 for keys
+that may contain newlines.
+
+To print keys and values like kafka-console-consumer with print.key=true, one
+message per line with key and value separated by a tab:
+
+  -output key-value
+
+Use -separator to pick a different separator. Key and value are presented
+according to -encodekey and -encodevalue. Null keys and values are printed as
+empty strings unless -null-key or -null-value provide a literal to print
+instead. Similarly, -output values prints only the values, one per line.
+
+For logs and tools that read logfmt, -output logfmt prints one line per
+message, leaving out null keys and values and quoting where needed:
+
+  partition=0 offset=3 key=id-23 value="hello world" timestamp=2017-08-22T10:31:02Z
+
+Rather than combining these flags, -message-format picks a familiar layout:
+
+ - json: kt's JSON objects, the default.
+ - kafka-console: key-value output with a tab separator and null for null keys
+   and values, like kafka-console-consumer with print.key=true.
+ - logfmt: logfmt output.
+ - raw: the values as plain strings, one per line.
+
+Presets don't combine with -output, other flags such as -separator or -encode
+take precedence over the preset's choices.
+
+For binary values, -output frames prints each value as is in a frame of a
+4-byte big-endian signed length followed by the value's bytes, regardless of
+-encode. Null values have a length of -1 and no bytes following. Keys are left
+out unless -key-frames is given, which prints each message as a frame of the
+key followed by a frame of the value. This is the framing that kt produce reads
+with -input-format frames, so the following copies keys and values losslessly:
+
+  $ kt consume -topic a -output frames -key-frames | kt produce -topic b -input-format frames -key-frames
+
+To feed messages into tooling built for Kafka Connect, -output connect wraps
+each message in a JSON structure resembling a Connect SourceRecord. The key and
+value are envelopes of schema and payload as written by Connect's
+JsonConverter with schemas enabled, and the topic, partition and offset are
+included as the source partition and offset:
+
+  $ kt consume -topic actor-news -output connect -pretty=false
+  {"topic":"actor-news","kafkaPartition":0,"sourcePartition":{"topic":"actor-news","partition":0},"sourceOffset":{"offset":23},"timestamp":1496318400000,"key":{"schema":{"type":"string","optional":true},"payload":"id-23"},"value":{"schema":{"type":"string","optional":true},"payload":"content"}}
+
+Keys and values have an optional string schema, or an optional bytes schema
+with base64 payloads for -encode base64, the only other supported encoding.
+The timestamp is in milliseconds since the epoch, null if the message has none.
+This is a best effort approximation of the shape, not a Connect
+implementation: kt doesn't infer structured schemas or converter settings.
+
+For topics with JSON values, -embed-json nests each value that is valid JSON
+directly under "value" instead of as a quoted string, which is easier to read
+and to process further, e.g. with jq. Values that aren't valid JSON are
+printed as strings as usual.
+
+Some producers encode JSON documents as JSON strings, sometimes more than once.
+-unescape-json N decodes such values up to N times before printing them, and
+stops early at the first level that isn't a JSON string. Combined with
+-embed-json the flattened document is nested under "value":
+
+  $ kt consume -topic events -unescape-json 2 -embed-json
+  {"partition":0,"offset":0,"key":null,"value":{"id":23}}
+
+For values in the Confluent wire format, -strip-schema-id removes the leading
+magic byte and 4-byte schema id, and prints the id as "schemaId" next to the
+remaining Avro encoded bytes, as base64 unless -encodevalue or -encode is
+given. This passes the raw Avro data on to other tooling without decoding it:
+
+  {"partition":0,"offset":3,"key":"id-23","value":"BmZvbw==","schemaId":42}
+
+Values without the magic byte are skipped with an error on stderr, null values
+are printed as is.
+
+For topics with plain Avro values, without the Confluent wire format's magic
+byte and schema id, -value-schema decodes each value with the given schema,
+inline or the path of an .avsc file, and nests it as JSON under "value":
+
+  $ kt consume -topic users -value-schema user.avsc
+  {"partition":0,"offset":0,"key":"23","value":{"id":23,"name":"hans","email":null}}
+
+Record fields keep the order of the schema, unions are printed as the plain
+value of their branch, and bytes and fixed values as strings whose code points
+are the byte values, as kt produce -value-schema reads them. Values that can't
+be decoded with the schema are skipped with the reason on stderr, null values
+are printed as is. Confluent framed values need -strip-schema-id instead.
+
+To explore a topic of unknown encoding, -guess tries the given encodings in
+order for each key and value and labels the first that fits in "keyGuess" and
+"valueGuess". string fits printable UTF-8 text, hex and base64 fit text that's
+a valid encoding of bytes, and json fits any JSON document, which is then
+nested under "value" as with -embed-json. Since most hex and base64 text, and
+all JSON, is printable text as well, list string last:
+
+  -guess json,hex,base64,string
+
+Keys and values that fit none of them are labelled raw and printed as base64.
+
+Message timestamps are printed in RFC 3339 format in the local time zone by
+default. Use -time-zone to present them in another zone, and -time-format to
+print them as seconds (unix) or milliseconds (unixmilli) since the epoch, or
+in a Go time layout, e.g.
+
+  -time-zone UTC -time-format '2006-01-02 15:04:05.000'
+
+With -show-crc the output includes a "crc" field with the CRC-32 checksum of
+the raw message value, using the IEEE polynomial as in Java's
+java.util.zip.CRC32. The checksum is computed by kt over the value only, so it
+differs from the checksum the broker stores for the whole message. Null values
+have no checksum.
+
+To count the messages between offsets 10 and 20 of every partition, without
+printing them:
+
+  -offsets all=10:20 -count
+
+Or the messages of the last hour, stopping after a second without messages:
+
+  -offsets all=last:1h -timeout 1s -count
+
+The output is a single JSON object with the total count and the count per
+partition, for example:
+
+  {"total": 22, "partitions": {"0": 11, "1": 11}}
+
+To understand the distribution of value sizes, e.g. for capacity planning,
+-size-histogram reads the messages of a bounded read without printing them
+and prints a histogram of value sizes in total and per partition once
+consuming stops. -size-buckets sets the upper bounds of the buckets in bytes,
+a last bucket with a null bound counts the larger values. Null values count as
+0 bytes:
+
+  -offsets all=oldest:newest -size-histogram -size-buckets 1000,10000
+
+  {"total": {"messages": 12, "bytes": 40960, "max": 20480, "buckets": [{"le": 1000, "count": 8}, {"le": 10000, "count": 3}, {"le": null, "count": 1}]}, "partitions": {"0": ...}}
+
+To verify that a replay didn't skip any data, -check-ordering reads the
+messages without printing them and checks that the offsets of each partition
+increase by one, starting at the start offset. Gaps, e.g. due to compaction or
+retention, and offsets that don't increase are reported on stderr as they're
+found, followed by a summary on stdout once consuming stops:
+
+  -offsets all=oldest:newest -check-ordering
+
+  {"gaps": 1, "missing": 3, "anomalies": 0, "partitions": {"0": {"messages": 8, "first": 0, "last": 10, "gaps": 1, "missing": 3, "anomalies": 0}}}
+
+Without support for transactions in kt's Kafka client, gaps left by
+transaction markers can't be told apart from missing messages, so expect gaps
+on transactional topics.
+
+During rolling restarts of the brokers, partitions can briefly be without a
+leader. By default kt gives up on a partition whose leader can't be found.
+With -partition-leader-only, kt waits for an offline partition to get a leader
+before consuming it, and keeps consuming when the leader of a partition moves,
+noting both on stderr.
+
+To check whether a data issue is specific to one broker, -leader-broker 2
+consumes only the partitions that broker 2 leads when kt starts, as noted on
+stderr.
+
+To copy messages to another topic, possibly on another cluster, -to-topic
+produces each consumed message to the same partition of that topic instead of
+printing it. The destination topic needs at least as many partitions as the
+source. Keys and values are copied as is, null ones included, and with
+-keep-timestamp so are the message timestamps. Pass -to-brokers and the -to-tls
+flags to reach a cluster other than -brokers, and -to-version if it runs a
+different Kafka version. -to-version defaults to -version, with auto probing
+-to-brokers rather than -brokers:
+
+  -topic orders -offsets all=oldest:newest -to-topic orders -to-brokers backup:9092 -to-version v0.9.0.1
+
+Once consuming stops, kt prints how many messages it copied per partition and
+the -offsets argument to resume from, e.g. after a failed send:
+
+  {"topic": "orders", "total": 42, "resume": "0=20,1=22", "partitions": {"0": {"count": 20, "next": 20}, "1": {"count": 22, "next": 22}}}
+
+Message headers are not copied, as kt's Kafka client doesn't support them.
+
+Partition leaders and other cluster metadata are refreshed in the background
+every -metadata-refresh, 10 minutes by default. A shorter interval lets long
+running consumers, e.g. with -partition-leader-only, notice leadership changes
+sooner, at the cost of a metadata request to the cluster per interval.
+
+When following a topic, -lag-warn 30s checks every 30 seconds how far each
+partition consumer is behind the newest offset and warns on stderr when that
+lag grew since the last check. This usually means that whatever reads kt's
+output can't keep up with the producers.
+
+For deterministic, diffable captures across partitions, -sort offset, timestamp
+or key buffers all messages of a bounded read and prints them sorted once
+consuming stops, ties broken by offset and partition. A read is bounded when
+every partition has an end offset, or a -timeout is given. As all messages are
+held in memory until the end, keep the range small enough to fit:
+
+  -offsets all=newest-100:newest -sort timestamp
+
+To reconstruct the current state of a log compacted topic, -compact buffers a
+bounded read the same way and prints only the last message per key, in offset
+order unless -sort is given. Keys whose last message is a tombstone (a null
+value) are left out, as are messages without a key:
+
+  -offsets all=oldest:newest -compact -sort key
+
+To make restarts of a capture with overlapping ranges idempotent, -dedup-window
+N records the partition and offset of each emitted message in -dedup-file, and
+skips messages among the last N recorded there. This is best-effort: messages
+that fell out of the window are emitted again, so pick N larger than the
+overlap you expect.
+
+Messages are recorded once they're emitted, and the records are buffered and
+written out as kt exits, so after a crash the last messages may be emitted
+again. The file holds at most about 2N entries, it's rewritten with the last N
+every N messages and on exit.
+
+  -offsets all=newest-1000: -dedup-window 100000
+
 `
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseOffsets(t *testing.T) {
@@ -287,6 +293,30 @@ func TestParseOffsets(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			input: "all=last:1h",
+			expected: map[int32]interval{
+				-1: interval{
+					start: offset{relative: true, ago: time.Hour},
+					end:   offset{relative: false, start: 1<<63 - 1, diff: 0},
+				},
+			},
+			expectedErr: nil,
+		},
+		{
+			input: "last:90m:100,2=last:1h30m",
+			expected: map[int32]interval{
+				-1: interval{
+					start: offset{relative: true, ago: 90 * time.Minute},
+					end:   offset{relative: false, start: 100},
+				},
+				2: interval{
+					start: offset{relative: true, ago: 90 * time.Minute},
+					end:   offset{relative: false, start: 1<<63 - 1},
+				},
+			},
+			expectedErr: nil,
+		},
 	}
 
 	for _, d := range data {
@@ -319,7 +349,7 @@ func TestFindPartitionsToConsume(t *testing.T) {
 		{
 			topic: "a",
 			offsets: map[int32]interval{
-				10: {offset{false, 2, 0}, offset{false, 4, 0}},
+				10: {offset{start: 2}, offset{start: 4}},
 			},
 			consumer: tConsumer{
 				topics:              []string{"a"},
@@ -335,7 +365,7 @@ func TestFindPartitionsToConsume(t *testing.T) {
 		{
 			topic: "a",
 			offsets: map[int32]interval{
-				-1: {offset{false, 3, 0}, offset{false, 41, 0}},
+				-1: {offset{start: 3}, offset{start: 41}},
 			},
 			consumer: tConsumer{
 				topics:              []string{"a"},
@@ -391,7 +421,7 @@ func TestConsume(t *testing.T) {
 	target.topic = "hans"
 	target.brokers = []string{"localhost:9092"}
 	target.offsets = map[int32]interval{
-		-1: interval{start: offset{false, 1, 0}, end: offset{false, 5, 0}},
+		-1: interval{start: offset{start: 1}, end: offset{start: 5}},
 	}
 
 	go target.consume(partitions)
@@ -439,6 +469,48 @@ Actual:   %#v
 	}
 }
 
+func TestConsumePartitionFromGroupOffsets(t *testing.T) {
+	messageChan := make(<-chan *sarama.ConsumerMessage)
+	calls := make(chan tConsumePartition)
+	consumer := tConsumer{
+		consumePartition: map[tConsumePartition]tPartitionConsumer{
+			tConsumePartition{"hans", 1, 7}: tPartitionConsumer{messages: messageChan},
+			tConsumePartition{"hans", 2, 1}: tPartitionConsumer{messages: messageChan},
+		},
+		calls: calls,
+	}
+	target := consumeCmd{consumer: consumer}
+	target.topic = "hans"
+	target.resumeOffsets = map[int32]int64{1: 7}
+	target.offsets = map[int32]interval{
+		-1: interval{start: offset{start: 1}, end: offset{start: 5}},
+	}
+
+	out := make(chan printContext)
+	for _, p := range []int32{1, 2} {
+		go target.consumePartition(out, p)
+	}
+
+	actual := []tConsumePartition{}
+	for len(actual) < 2 {
+		select {
+		case call := <-calls:
+			actual = append(actual, call)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Did not receive calls to consume partitions before timeout.")
+		}
+	}
+	sort.Sort(ByPartitionOffset(actual))
+
+	expected := []tConsumePartition{
+		tConsumePartition{"hans", 1, 7},
+		tConsumePartition{"hans", 2, 1},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("\nExpected: %#v\nActual:   %#v\n", expected, actual)
+	}
+}
+
 type tConsumePartition struct {
 	topic     string
 	partition int32
@@ -551,3 +623,864 @@ func TestConsumeParseArgs(t *testing.T) {
 		return
 	}
 }
+
+func TestFormatKeys(t *testing.T) {
+	target := &consumeCmd{output: "keys", encodeKey: "string", dedup: true}
+	msgs := []*sarama.ConsumerMessage{
+		{Key: []byte("a")},
+		{Key: nil},
+		{Key: []byte("b")},
+		{Key: []byte("a")},
+	}
+
+	actual := []string{}
+	for _, m := range msgs {
+		if o, ok := target.format(m); ok {
+			actual = append(actual, string(o.(rawOutput)))
+		}
+	}
+	if !reflect.DeepEqual(actual, []string{"a\n", "b\n"}) {
+		t.Errorf("unexpected keys output %#v", actual)
+	}
+
+	target = &consumeCmd{output: "keys", encodeKey: "hex", nullKey: "<null>"}
+	actual = []string{}
+	for _, m := range msgs {
+		if o, ok := target.format(m); ok {
+			actual = append(actual, string(o.(rawOutput)))
+		}
+	}
+	if !reflect.DeepEqual(actual, []string{"61\n", "<null>\n", "62\n", "61\n"}) {
+		t.Errorf("unexpected keys output %#v", actual)
+	}
+}
+
+func TestFormatKeyValue(t *testing.T) {
+	target := &consumeCmd{output: "key-value", encodeKey: "string", encodeValue: "hex", separator: "\t"}
+	msgs := []*sarama.ConsumerMessage{
+		{Key: []byte("a"), Value: []byte("A")},
+		{Key: nil, Value: []byte("B")},
+		{Key: []byte("c"), Value: nil},
+	}
+
+	format := func() []string {
+		actual := []string{}
+		for _, m := range msgs {
+			o, ok := target.format(m)
+			require.True(t, ok)
+			actual = append(actual, string(o.(rawOutput)))
+		}
+		return actual
+	}
+	require.Equal(t, []string{"a\t41\n", "\t42\n", "c\t\n"}, format())
+
+	target.separator, target.nullKey, target.nullValue = ":", "<null>", "<tombstone>"
+	require.Equal(t, []string{"a:41\n", "<null>:42\n", "c:<tombstone>\n"}, format())
+}
+
+func TestFormatValues(t *testing.T) {
+	target := &consumeCmd{output: "values", encodeValue: "string", nullValue: "null"}
+	actual := []string{}
+	for _, m := range []*sarama.ConsumerMessage{{Key: []byte("a"), Value: []byte("A")}, {Key: []byte("b")}} {
+		o, ok := target.format(m)
+		require.True(t, ok)
+		actual = append(actual, string(o.(rawOutput)))
+	}
+	require.Equal(t, []string{"A\n", "null\n"}, actual)
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	target := &consumeCmd{output: "logfmt", encodeKey: "string", encodeValue: "string", timeFormat: "unix"}
+	data := []struct {
+		msg      *sarama.ConsumerMessage
+		expected string
+	}{
+		{
+			msg:      &sarama.ConsumerMessage{Partition: 1, Offset: 23, Key: []byte("id-23"), Value: []byte("ola")},
+			expected: "partition=1 offset=23 key=id-23 value=ola\n",
+		},
+		{
+			msg:      &sarama.ConsumerMessage{Offset: 24, Value: []byte(`hello "world"`), Timestamp: time.Unix(1503397862, 0)},
+			expected: "partition=0 offset=24 value=\"hello \\\"world\\\"\" timestamp=1503397862\n",
+		},
+		{
+			msg:      &sarama.ConsumerMessage{Offset: 25, Key: []byte(""), Value: []byte("a=b\n")},
+			expected: "partition=0 offset=25 key=\"\" value=\"a=b\\n\"\n",
+		},
+	}
+
+	for _, d := range data {
+		o, ok := target.format(d.msg)
+		require.True(t, ok)
+		require.Equal(t, d.expected, string(o.(rawOutput)))
+	}
+}
+
+func TestApplyMessageFormat(t *testing.T) {
+	data := []struct {
+		given    consumeArgs
+		expected consumeArgs
+		err      bool
+	}{
+		{
+			given:    consumeArgs{msgFormat: "json", output: "json"},
+			expected: consumeArgs{msgFormat: "json", output: "json"},
+		},
+		{
+			given:    consumeArgs{msgFormat: "kafka-console", output: "json"},
+			expected: consumeArgs{msgFormat: "kafka-console", output: "key-value", nullKey: "null", nullValue: "null"},
+		},
+		{
+			given:    consumeArgs{msgFormat: "kafka-console", output: "json", nullValue: "<tombstone>"},
+			expected: consumeArgs{msgFormat: "kafka-console", output: "key-value", nullKey: "null", nullValue: "<tombstone>"},
+		},
+		{
+			given:    consumeArgs{msgFormat: "logfmt", output: "json"},
+			expected: consumeArgs{msgFormat: "logfmt", output: "logfmt"},
+		},
+		{
+			given:    consumeArgs{msgFormat: "raw", output: "json"},
+			expected: consumeArgs{msgFormat: "raw", output: "values", encode: "string"},
+		},
+		{
+			given:    consumeArgs{msgFormat: "raw", output: "json", encode: "hex"},
+			expected: consumeArgs{msgFormat: "raw", output: "values", encode: "hex"},
+		},
+		{
+			given: consumeArgs{msgFormat: "console"},
+			err:   true,
+		},
+	}
+
+	for _, d := range data {
+		args := d.given
+		err := applyMessageFormat(&args)
+		if d.err {
+			require.Error(t, err, d.given.msgFormat)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, d.expected, args)
+	}
+}
+
+func TestFormatCRC(t *testing.T) {
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "string", showCRC: true}
+
+	o, ok := target.format(&sarama.ConsumerMessage{Value: []byte("hans")})
+	require.True(t, ok)
+	require.NotNil(t, o.(consumedMessage).CRC)
+	require.Equal(t, uint32(0xa4b1c748), *o.(consumedMessage).CRC)
+
+	o, ok = target.format(&sarama.ConsumerMessage{})
+	require.True(t, ok)
+	require.Nil(t, o.(consumedMessage).CRC)
+}
+
+func TestCountResult(t *testing.T) {
+	target := &consumeCmd{}
+	for _, p := range []int32{0, 2, 2, 2} {
+		target.addCount(p)
+	}
+
+	expected := consumeCount{Total: 4, Partitions: map[int32]int64{0: 1, 1: 0, 2: 3}}
+	require.Equal(t, expected, target.countResult([]int32{0, 1, 2}))
+}
+
+func TestSortMessages(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	msgs := []*sarama.ConsumerMessage{
+		{Partition: 1, Offset: 5, Key: []byte("b"), Timestamp: t0.Add(time.Second)},
+		{Partition: 0, Offset: 5, Key: []byte("c"), Timestamp: t0},
+		{Partition: 0, Offset: 3, Key: []byte("b"), Timestamp: t0.Add(2 * time.Second)},
+		{Partition: 1, Offset: 2, Key: nil, Timestamp: t0},
+	}
+	order := func() []string {
+		result := []string{}
+		for _, m := range msgs {
+			result = append(result, fmt.Sprintf("%v/%v", m.Partition, m.Offset))
+		}
+		return result
+	}
+
+	sortMessages(msgs, "offset")
+	require.Equal(t, []string{"1/2", "0/3", "0/5", "1/5"}, order())
+
+	sortMessages(msgs, "timestamp")
+	require.Equal(t, []string{"1/2", "0/5", "1/5", "0/3"}, order())
+
+	sortMessages(msgs, "key")
+	require.Equal(t, []string{"1/2", "0/3", "1/5", "0/5"}, order())
+}
+
+func TestConsumeBounded(t *testing.T) {
+	data := []struct {
+		offsets   string
+		timeout   time.Duration
+		exitAfter time.Duration
+		expected  bool
+	}{
+		{offsets: "", expected: false},
+		{offsets: "", timeout: time.Second, expected: true},
+		{offsets: "", exitAfter: time.Minute, expected: true},
+		{offsets: "all=10:20", expected: true},
+		{offsets: "all=newest-10:newest", expected: true},
+		{offsets: "all=10:20,1=5", expected: false},
+	}
+
+	for _, d := range data {
+		offsets, err := parseOffsets(d.offsets)
+		require.NoError(t, err)
+		target := &consumeCmd{offsets: offsets, timeout: d.timeout, exitAfter: d.exitAfter}
+		require.Equal(t, d.expected, target.bounded(), "offsets %#v", d.offsets)
+	}
+}
+
+func TestParseOffsetsMixed(t *testing.T) {
+	max := offset{start: 1<<63 - 1}
+	actual, err := parseOffsets(" 0 = oldest , 1=100 : 200,2=last:1h:newest, all=newest,-1")
+	require.Error(t, err, "-1 and all both define the default")
+	require.Contains(t, err.Error(), "[-1]")
+
+	actual, err = parseOffsets(" 0 = oldest , 1=100 : 200,2=last: 1h : newest, all=newest, 3=newest - 5:")
+	require.NoError(t, err)
+	require.Equal(t, map[int32]interval{
+		0:  {start: offset{relative: true, start: sarama.OffsetOldest}, end: max},
+		1:  {start: offset{start: 100}, end: offset{start: 200}},
+		2:  {start: offset{relative: true, ago: time.Hour}, end: offset{relative: true, start: sarama.OffsetNewest}},
+		3:  {start: offset{relative: true, start: sarama.OffsetNewest, diff: -5}, end: max},
+		-1: {start: offset{relative: true, start: sarama.OffsetNewest}, end: max},
+	}, actual)
+
+	// explicit partitions take precedence over all, regardless of the order.
+	target := &consumeCmd{}
+	target.offsets, err = parseOffsets("all=newest,1=100:200")
+	require.NoError(t, err)
+	require.Equal(t, interval{start: offset{start: 100}, end: offset{start: 200}}, target.partitionInterval(1))
+	require.Equal(t, interval{start: offset{relative: true, start: sarama.OffsetNewest}, end: max}, target.partitionInterval(0))
+}
+
+func TestParseOffsetsErrors(t *testing.T) {
+	data := []struct {
+		input    string
+		expected string
+	}{
+		{input: "x=1", expected: "Invalid partition [x] in [x=1]"},
+		{input: "0=1,-2=3", expected: "Invalid partition [-2] in [-2=3]"},
+		{input: "0=1, 0=2", expected: "Duplicate partition [0] in [0=2]"},
+		{input: "0=foo", expected: "Invalid start offset [foo] in [0=foo]"},
+		{input: "0=1:bar", expected: "Invalid end offset [bar] in [0=1:bar]"},
+		{input: "0=newest+-1", expected: "Invalid start offset [newest+-1] in [0=newest+-1]"},
+		{input: "all=last:", expected: "Invalid start offset [last] in [all=last:]"},
+		{input: "all=last:1x", expected: "Invalid start offset [last1x] in [all=last:1x]"},
+	}
+
+	for _, d := range data {
+		_, err := parseOffsets(d.input)
+		require.EqualError(t, err, d.expected, "input %#v", d.input)
+	}
+}
+
+func TestCompactMessages(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	msgs := []*sarama.ConsumerMessage{
+		{Partition: 0, Offset: 1, Key: []byte("a"), Value: []byte("1")},
+		{Partition: 0, Offset: 3, Key: []byte("b"), Value: []byte("1")},
+		{Partition: 0, Offset: 2, Key: []byte("a"), Value: []byte("2")},
+		{Partition: 0, Offset: 4, Key: []byte("b"), Value: nil},
+		{Partition: 0, Offset: 5, Key: nil, Value: []byte("x")},
+		{Partition: 1, Offset: 7, Key: []byte("c"), Value: []byte("late"), Timestamp: t0.Add(time.Second)},
+		{Partition: 2, Offset: 9, Key: []byte("c"), Value: []byte("early"), Timestamp: t0},
+	}
+
+	actual := compactMessages(msgs)
+	sortMessages(actual, "key")
+
+	values := []string{}
+	for _, m := range actual {
+		values = append(values, fmt.Sprintf("%s=%s", m.Key, m.Value))
+	}
+	require.Equal(t, []string{"a=2", "c=late"}, values)
+}
+
+func TestParseTimeOffset(t *testing.T) {
+	actual, err := parseTimeOffset("2h")
+	require.NoError(t, err)
+	require.Equal(t, offset{relative: true, ago: 2 * time.Hour}, actual)
+	require.True(t, actual.timeBased())
+
+	actual, err = parseTimeOffset("2017-06-01T12:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, offset{relative: true, at: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)}, actual)
+	require.True(t, actual.timeBased())
+
+	for _, in := range []string{"", "-1h", "0s", "yesterday", "2017-06-01"} {
+		_, err := parseTimeOffset(in)
+		require.Error(t, err, "input %#v", in)
+	}
+
+	require.False(t, offset{relative: true, start: sarama.OffsetNewest}.timeBased())
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	msg := &sarama.ConsumerMessage{Value: []byte("v"), Timestamp: time.Date(2017, 6, 1, 12, 0, 0, 123e6, time.UTC)}
+
+	data := []struct {
+		layout   string
+		zone     *time.Location
+		expected string
+	}{
+		{zone: time.UTC, expected: `"2017-06-01T12:00:00.123Z"`},
+		{zone: berlin, expected: `"2017-06-01T14:00:00.123+02:00"`},
+		{layout: "unix", expected: `1496318400`},
+		{layout: "unixmilli", expected: `1496318400123`},
+		{layout: "2006-01-02 15:04", zone: berlin, expected: `"2017-06-01 14:00"`},
+	}
+
+	for _, d := range data {
+		target := &consumeCmd{output: "json", timeFormat: d.layout, timeZone: d.zone}
+		m, ok := target.format(msg)
+		require.True(t, ok)
+		buf, err := json.Marshal(m.(consumedMessage).Timestamp)
+		require.NoError(t, err)
+		require.Equal(t, d.expected, string(buf))
+	}
+}
+
+func TestStopWhenIdle(t *testing.T) {
+	target := &consumeCmd{maxWait: 30 * time.Millisecond, stop: make(chan struct{})}
+	target.markActivity()
+	started := time.Now()
+	go target.stopWhenIdle()
+
+	// activity postpones stopping
+	time.Sleep(20 * time.Millisecond)
+	target.markActivity()
+
+	select {
+	case <-target.stop:
+		require.True(t, time.Since(started) >= 50*time.Millisecond, "stopped after %s", time.Since(started))
+	case <-time.After(time.Second):
+		t.Fatal("did not stop when idle")
+	}
+}
+
+func TestFormatEmbedJSON(t *testing.T) {
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "string", embedJSON: true}
+	data := []struct {
+		value    []byte
+		expected string
+	}{
+		{value: []byte(`{"a": [1, 2],  "b": "c"}`), expected: `{"partition":0,"offset":0,"key":null,"value":{"a":[1,2],"b":"c"}}`},
+		{value: []byte(`42`), expected: `{"partition":0,"offset":0,"key":null,"value":42}`},
+		{value: []byte(`not json`), expected: `{"partition":0,"offset":0,"key":null,"value":"not json"}`},
+		{value: nil, expected: `{"partition":0,"offset":0,"key":null,"value":null}`},
+	}
+
+	for _, d := range data {
+		o, ok := target.format(&sarama.ConsumerMessage{Value: d.value})
+		require.True(t, ok)
+		buf, err := json.Marshal(o)
+		require.NoError(t, err)
+		require.Equal(t, d.expected, string(buf))
+	}
+}
+
+func TestUnescapeJSON(t *testing.T) {
+	data := []struct {
+		value    string
+		n        int
+		expected string
+	}{
+		{value: `"{\"id\":23}"`, n: 1, expected: `{"id":23}`},
+		{value: `"\"{\\\"id\\\":23}\""`, n: 1, expected: `"{\"id\":23}"`},
+		{value: `"\"{\\\"id\\\":23}\""`, n: 2, expected: `{"id":23}`},
+		{value: `"\"{\\\"id\\\":23}\""`, n: 5, expected: `{"id":23}`},
+		{value: `"plain"`, n: 3, expected: `plain`},
+		{value: `{"id":23}`, n: 2, expected: `{"id":23}`},
+		{value: `not json`, n: 1, expected: `not json`},
+		{value: `"{\"id\":23}"`, n: 0, expected: `"{\"id\":23}"`},
+	}
+
+	for _, d := range data {
+		require.Equal(t, d.expected, string(unescapeJSON([]byte(d.value), d.n)), "value %v n %v", d.value, d.n)
+	}
+}
+
+func TestFormatUnescapeJSON(t *testing.T) {
+	value := []byte(`"{\"a\": 1}"`)
+
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "string", unescape: 1}
+	o, ok := target.format(&sarama.ConsumerMessage{Value: value})
+	require.True(t, ok)
+	buf, err := json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":null,"value":"{\"a\": 1}"}`, string(buf))
+
+	target.embedJSON = true
+	o, ok = target.format(&sarama.ConsumerMessage{Value: value})
+	require.True(t, ok)
+	buf, err = json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":null,"value":{"a":1}}`, string(buf))
+}
+
+func TestFormatValueSchema(t *testing.T) {
+	schema, err := parseAvroSchema(`{"type": "record", "name": "A", "fields": [{"name": "id", "type": "int"}]}`)
+	require.NoError(t, err)
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "string", valueSchema: schema}
+
+	o, ok := target.format(&sarama.ConsumerMessage{Value: []byte{0x02}})
+	require.True(t, ok)
+	buf, err := json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":null,"value":{"id":1}}`, string(buf))
+
+	o, ok = target.format(&sarama.ConsumerMessage{})
+	require.True(t, ok)
+	buf, err = json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":null,"value":null}`, string(buf))
+
+	_, ok = target.format(&sarama.ConsumerMessage{Value: []byte{0x02, 0x00}})
+	require.False(t, ok)
+}
+
+func TestSeenWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-dedup-window")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen")
+
+	w, err := openSeenWindow(path, 2)
+	require.Nil(t, err)
+	require.False(t, w.seen("t/0/1"))
+	w.record("t/0/1")
+	w.record("t/0/2")
+	require.True(t, w.seen("t/0/1"))
+	w.record("t/0/3") // evicts t/0/2
+	require.False(t, w.seen("t/0/2"))
+	w.record("t/0/2")
+	require.Nil(t, w.Close())
+
+	w, err = openSeenWindow(path, 2)
+	require.Nil(t, err)
+	defer w.Close()
+
+	buf, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "t/0/3\nt/0/2\n", string(buf))
+	require.True(t, w.seen("t/0/2"))
+	require.False(t, w.seen("t/0/1"))
+}
+
+func TestSeenWindowFileStaysBounded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-dedup-window")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen")
+
+	w, err := openSeenWindow(path, 3)
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		w.record(fmt.Sprintf("t/0/%v", i))
+	}
+
+	// records are buffered and the file is rewritten every 3 records.
+	buf, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.True(t, bytes.Count(buf, []byte("\n")) <= 3, string(buf))
+
+	require.Nil(t, w.Close())
+	buf, err = ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "t/0/97\nt/0/98\nt/0/99\n", string(buf))
+}
+
+func TestStopConsuming(t *testing.T) {
+	target := &consumeCmd{stop: make(chan struct{})}
+	target.stopConsuming("first")
+	target.stopConsuming("second")
+
+	select {
+	case <-target.stop:
+	default:
+		t.Fatal("did not stop")
+	}
+}
+
+func TestPartitionOrdering(t *testing.T) {
+	var po partitionOrdering
+	require.Equal(t, "", po.add(5, 5))
+	require.Equal(t, "", po.add(5, 6))
+	require.Equal(t, "gap of 3 offsets between 7 and 10", po.add(5, 10))
+	require.Equal(t, "offset 9 after 10 does not increase", po.add(5, 9))
+	require.Equal(t, "", po.add(5, 11))
+	require.Equal(t, partitionOrdering{Messages: 5, First: 5, Last: 11, Gaps: 1, Missing: 3, Anomalies: 1}, po)
+
+	// a gap before the first message, e.g. due to compaction
+	po = partitionOrdering{}
+	require.Equal(t, "gap of 2 offsets between 0 and 2", po.add(0, 2))
+	require.Equal(t, partitionOrdering{Messages: 1, First: 2, Last: 2, Gaps: 1, Missing: 2}, po)
+}
+
+type fakeSyncProducer struct {
+	sent []*sarama.ProducerMessage
+	err  error
+}
+
+func (p *fakeSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	p.sent = append(p.sent, msg)
+	return msg.Partition, int64(len(p.sent) - 1), nil
+}
+
+func (p *fakeSyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, m := range msgs {
+		if _, _, err := p.SendMessage(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *fakeSyncProducer) Close() error { return nil }
+
+func TestMirror(t *testing.T) {
+	producer := &fakeSyncProducer{}
+	target := &consumeCmd{toTopic: "copy", producer: producer, keepTime: true}
+	ts := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	require.Nil(t, target.mirror(&sarama.ConsumerMessage{Partition: 1, Offset: 7, Key: []byte("k"), Value: []byte("v"), Timestamp: ts}))
+	require.Nil(t, target.mirror(&sarama.ConsumerMessage{Partition: 1, Offset: 9}))
+	require.Nil(t, target.mirror(&sarama.ConsumerMessage{Partition: 0, Offset: 3, Value: []byte{}}))
+
+	require.Len(t, producer.sent, 3)
+	require.Equal(t, &sarama.ProducerMessage{Topic: "copy", Partition: 1, Key: sarama.ByteEncoder("k"), Value: sarama.ByteEncoder("v"), Timestamp: ts}, producer.sent[0])
+	require.Nil(t, producer.sent[1].Key, "null key is kept")
+	require.Nil(t, producer.sent[1].Value, "null value is kept")
+	require.Equal(t, sarama.ByteEncoder{}, producer.sent[2].Value, "empty value is not null")
+
+	producer.err = fmt.Errorf("boom")
+	require.Error(t, target.mirror(&sarama.ConsumerMessage{Partition: 0, Offset: 4}))
+
+	expected := mirrorResult{
+		Topic:  "copy",
+		Total:  3,
+		Resume: "0=4,1=10",
+		Partitions: map[int32]mirroredPartition{
+			0: {Count: 1, Next: 4},
+			1: {Count: 2, Next: 10},
+		},
+	}
+	require.Equal(t, expected, target.mirrorResult([]int32{0, 1, 2}))
+}
+
+func TestGuessEncoding(t *testing.T) {
+	order, err := parseGuessOrder("json, hex,base64,string")
+	require.NoError(t, err)
+	require.Equal(t, []string{"json", "hex", "base64", "string"}, order)
+	_, err = parseGuessOrder("json,avro")
+	require.Error(t, err)
+
+	data := []struct {
+		in       []byte
+		expected string
+	}{
+		{in: []byte(`{"a": 1}`), expected: "json"},
+		{in: []byte("cafe"), expected: "hex"},
+		{in: []byte("aGFucw=="), expected: "base64"},
+		{in: []byte("hans\tpeter\n"), expected: "string"},
+		{in: []byte{0xff, 0x00}, expected: "raw"},
+		{in: []byte{}, expected: "string"},
+	}
+	for _, d := range data {
+		require.Equal(t, d.expected, guessEncoding(d.in, order), "input %#v", d.in)
+	}
+
+	// the order decides between encodings that fit
+	require.Equal(t, "string", guessEncoding([]byte("cafe"), []string{"string", "hex"}))
+}
+
+func TestFormatGuess(t *testing.T) {
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "string", guess: []string{"json", "string"}}
+	m, ok := target.format(&sarama.ConsumerMessage{Key: []byte{0xff}, Value: []byte(`{"a": 1}`)})
+	require.True(t, ok)
+	buf, err := json.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":"/w==","value":{"a":1},"keyGuess":"raw","valueGuess":"json"}`, string(buf))
+}
+
+func TestIsLeaderError(t *testing.T) {
+	require.True(t, isLeaderError(sarama.ErrNotLeaderForPartition))
+	require.True(t, isLeaderError(sarama.ErrLeaderNotAvailable))
+	require.False(t, isLeaderError(sarama.ErrOffsetOutOfRange))
+	require.False(t, isLeaderError(nil))
+}
+
+func TestFormatFrames(t *testing.T) {
+	target := &consumeCmd{output: "frames"}
+	m, ok := target.format(&sarama.ConsumerMessage{Key: []byte("k"), Value: []byte("hans")})
+	require.True(t, ok)
+	require.Equal(t, rawOutput{0, 0, 0, 4, 'h', 'a', 'n', 's'}, m)
+
+	target.keyFrames = true
+	m, ok = target.format(&sarama.ConsumerMessage{Value: []byte{}})
+	require.True(t, ok)
+	require.Equal(t, rawOutput{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, m)
+
+	// frames output is read back by produce's frames input
+	out := make(chan []byte, 2)
+	require.NoError(t, readFrames(bytes.NewReader(m.(rawOutput)), 10, out))
+	require.Nil(t, <-out)
+	require.Equal(t, []byte{}, <-out)
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "orders.checkpoint")
+
+	_, found, err := readCheckpoint(path)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	target := &consumeCmd{topic: "orders", cpFile: path, resumeOffsets: map[int32]int64{0: 10, 1: 7}}
+	target.setPosition(0, 20)
+	target.setPosition(2, 3)
+	target.checkpoint()
+
+	cp, found, err := readCheckpoint(path)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, checkpoint{Topic: "orders", Offsets: map[int32]int64{0: 20, 1: 7, 2: 3}}, cp)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"orders","offsets":{"0":20,"1":7,"2":3}}`+"\n", string(data))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "temporary files should be renamed or removed")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"topic":`), 0644))
+	_, _, err = readCheckpoint(path)
+	require.Error(t, err)
+}
+
+func TestParseOffsetList(t *testing.T) {
+	list, err := parseOffsetList(bytes.NewBufferString("# known bad\n0:1023\n\n 2 : 17 \n0:998\n"))
+	require.NoError(t, err)
+	require.Equal(t, []partitionOffset{{0, 1023}, {2, 17}, {0, 998}}, list)
+
+	for _, input := range []string{"0", "0:1:2", "a:1", "0:b", "-1:1", "0:-1"} {
+		_, err := parseOffsetList(bytes.NewBufferString("0:1\n" + input))
+		require.Error(t, err, input)
+		require.Contains(t, err.Error(), "line 2", input)
+	}
+}
+
+func TestFormatStripSchemaID(t *testing.T) {
+	target := &consumeCmd{output: "json", encodeKey: "string", encodeValue: "base64", stripSchema: true}
+
+	o, ok := target.format(&sarama.ConsumerMessage{Offset: 3, Key: []byte("id-23"), Value: []byte{0, 0, 0, 0, 42, 6, 'f', 'o', 'o'}})
+	require.True(t, ok)
+	m := o.(consumedMessage)
+	require.Equal(t, "BmZvbw==", *m.Value.(*string))
+	require.Equal(t, int32(42), *m.SchemaID)
+
+	o, ok = target.format(&sarama.ConsumerMessage{Offset: 4, Key: []byte("id-23")})
+	require.True(t, ok)
+	m = o.(consumedMessage)
+	require.Nil(t, m.Value)
+	require.Nil(t, m.SchemaID)
+
+	for _, v := range [][]byte{[]byte("plain"), {0, 0, 1}, {}} {
+		_, ok = target.format(&sarama.ConsumerMessage{Offset: 5, Value: v})
+		require.False(t, ok, "%v", v)
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	bounds, err := parseSizeBuckets("10, 100")
+	require.NoError(t, err)
+	require.Equal(t, []int64{10, 100}, bounds)
+
+	for _, in := range []string{"", "10,10", "100,10", "-1", "a"} {
+		_, err := parseSizeBuckets(in)
+		require.Error(t, err, in)
+	}
+
+	target := &consumeCmd{sizeBounds: bounds}
+	for _, s := range []int{0, 10, 11, 100, 101} {
+		target.addSize(0, s)
+	}
+	target.addSize(1, 5000)
+
+	ten, hundred := int64(10), int64(100)
+	actual := target.histogramResult([]int32{0, 1, 2})
+	require.Equal(t, &sizeHistogram{
+		Messages: 6,
+		Bytes:    5222,
+		Max:      5000,
+		Buckets:  []sizeBucket{{Le: &ten, Count: 2}, {Le: &hundred, Count: 2}, {Count: 2}},
+	}, actual.Total)
+	require.Equal(t, []sizeBucket{{Le: &ten, Count: 2}, {Le: &hundred, Count: 2}, {Count: 1}}, actual.Partitions[0].Buckets)
+	require.Equal(t, int64(1), actual.Partitions[1].Buckets[2].Count)
+	require.Equal(t, int64(0), actual.Partitions[2].Messages)
+}
+
+func TestFormatConnect(t *testing.T) {
+	target := &consumeCmd{output: "connect", encodeKey: "string", encodeValue: "base64"}
+
+	o, ok := target.format(&sarama.ConsumerMessage{
+		Topic:     "actor-news",
+		Partition: 2,
+		Offset:    23,
+		Key:       []byte("id-23"),
+		Value:     []byte{0x00, 0x01},
+		Timestamp: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+	})
+	require.True(t, ok)
+	buf, err := json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"actor-news","kafkaPartition":2,"sourcePartition":{"topic":"actor-news","partition":2},"sourceOffset":{"offset":23},"timestamp":1496318400000,"key":{"schema":{"type":"string","optional":true},"payload":"id-23"},"value":{"schema":{"type":"bytes","optional":true},"payload":"AAE="}}`, string(buf))
+
+	o, ok = target.format(&sarama.ConsumerMessage{Topic: "actor-news"})
+	require.True(t, ok)
+	buf, err = json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"actor-news","kafkaPartition":0,"sourcePartition":{"topic":"actor-news","partition":0},"sourceOffset":{"offset":0},"timestamp":null,"key":{"schema":{"type":"string","optional":true},"payload":null},"value":{"schema":{"type":"bytes","optional":true},"payload":null}}`, string(buf))
+}
+
+func TestFormatCBOR(t *testing.T) {
+	data, err := cborFromJSON(`{"temp":21.5}`)
+	require.NoError(t, err)
+	target := &consumeCmd{encodeKey: "cbor", encodeValue: "cbor"}
+
+	o, ok := target.format(&sarama.ConsumerMessage{Key: data, Value: data})
+	require.True(t, ok)
+	buf, err := json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":"{\"temp\":21.5}","value":{"temp":21.5}}`, string(buf))
+
+	o, ok = target.format(&sarama.ConsumerMessage{Value: []byte{0xff}})
+	require.True(t, ok)
+	buf, err = json.Marshal(o)
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"offset":0,"key":null,"value":"/w=="}`, string(buf))
+
+	target.output = "values"
+	o, ok = target.format(&sarama.ConsumerMessage{Value: data})
+	require.True(t, ok)
+	require.Equal(t, rawOutput("{\"temp\":21.5}\n"), o)
+}
+
+func TestConsumeParseArgsBuffer(t *testing.T) {
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic"})
+	require.Equal(t, 256, target.chanBuffer)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-buffer", "1"})
+	require.Equal(t, 1, target.chanBuffer)
+}
+
+func TestConsumeParseArgsToVersion(t *testing.T) {
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-version", "v0.10.1.0", "-to-topic", "copy"})
+	require.Equal(t, sarama.V0_10_1_0, target.toVersion)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-version", "v0.10.1.0", "-to-topic", "copy", "-to-brokers", "backup:9092", "-to-version", "v0.9.0.1"})
+	require.Equal(t, sarama.V0_10_1_0, target.version)
+	require.Equal(t, sarama.V0_9_0_1, target.toVersion)
+}
+
+func TestConsumeParseArgsCommit(t *testing.T) {
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-from-group", "billing", "-manual-commit"})
+	require.True(t, target.manualCommit)
+	require.Equal(t, time.Second, target.commitInterval)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-from-group", "billing", "-commit-interval", "5s"})
+	require.False(t, target.manualCommit)
+	require.Equal(t, 5*time.Second, target.commitInterval)
+}
+
+func TestPartitionLoopManualCommit(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	for o := int64(0); o < 2; o++ {
+		messages <- &sarama.ConsumerMessage{Partition: 0, Offset: o}
+	}
+	target := &consumeCmd{manualCommit: true, commitInterval: time.Second}
+
+	out := make(chan printContext)
+	done := make(chan struct{})
+	go func() {
+		target.partitionLoop(out, tPartitionConsumer{messages: messages}, 0, 1)
+		close(done)
+	}()
+
+	// offset 0 isn't written until its print is done.
+	ctx := <-out
+	require.Empty(t, target.pendingCommits())
+	close(ctx.done)
+
+	ctx = <-out
+	require.Equal(t, map[int32]int64{0: 1}, target.pendingCommits())
+	close(ctx.done)
+	<-done
+	require.Equal(t, map[int32]int64{0: 2}, target.pendingCommits())
+
+	target.committed = map[int32]int64{0: 2}
+	require.Empty(t, target.pendingCommits())
+}
+
+func TestPartitionLoopCommitOnReceive(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{Partition: 0, Offset: 23}
+	target := &consumeCmd{commitInterval: time.Second}
+
+	out := make(chan printContext)
+	done := make(chan struct{})
+	go func() {
+		target.partitionLoop(out, tPartitionConsumer{messages: messages}, 0, 23)
+		close(done)
+	}()
+
+	// without -manual-commit the offset is pending before it's written.
+	ctx := <-out
+	require.Equal(t, map[int32]int64{0: 24}, target.pendingCommits())
+	close(ctx.done)
+	<-done
+}
+
+func TestPartitionLoopEndsAtOffsetZero(t *testing.T) {
+	// a time based -until that resolves to offset 1 makes 0 the last offset
+	// to read.
+	messages := make(chan *sarama.ConsumerMessage, 3)
+	for o := int64(0); o < 3; o++ {
+		messages <- &sarama.ConsumerMessage{Partition: 0, Offset: o}
+	}
+	target := &consumeCmd{count: true}
+
+	done := make(chan struct{})
+	go func() {
+		target.partitionLoop(make(chan printContext), tPartitionConsumer{messages: messages}, 0, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected consuming to stop after offset 0")
+	}
+	require.Equal(t, consumeCount{Partitions: map[int32]int64{0: 1}, Total: 1}, target.countResult([]int32{0}))
+}
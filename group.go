@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/user"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
@@ -21,29 +26,50 @@ type groupCmd struct {
 	topic      string
 	partitions []int32
 	reset      int64
+	resetAt    time.Time
 	verbose    bool
 	pretty     bool
+	color      bool
 	version    sarama.KafkaVersion
 	offsets    bool
+	verify     bool
+	lagSummary bool
+	threshold  int64
+	yes        bool
+	tlsConfig  *tls.Config
 
 	client sarama.Client
+	// offsetVersion is the version of the OffsetFetch and OffsetCommit
+	// requests for -offset-storage, 0 for offsets stored in ZooKeeper.
+	offsetVersion int16
+	// resetOffsets are the offsets resolved for -reset with a time, per
+	// topic and partition.
+	resetOffsets map[string]map[int32]int64
 }
 
 type group struct {
-	Name    string        `json:"name"`
-	Topic   string        `json:"topic,omitempty"`
-	Offsets []groupOffset `json:"offsets,omitempty"`
+	Name        string            `json:"name"`
+	Coordinator *groupCoordinator `json:"coordinator,omitempty"`
+	Topic       string            `json:"topic,omitempty"`
+	Offsets     []groupOffset     `json:"offsets,omitempty"`
+}
+
+type groupCoordinator struct {
+	ID   int32  `json:"id"`
+	Addr string `json:"addr"`
 }
 
 type groupOffset struct {
 	Partition int32  `json:"partition"`
 	Offset    *int64 `json:"offset"`
 	Lag       *int64 `json:"lag"`
+	Verified  *bool  `json:"verified,omitempty"`
 }
 
 const (
 	allPartitionsHuman = "all"
 	resetNotSpecified  = -23
+	resetToTime        = -24
 )
 
 func (cmd *groupCmd) run(args []string) {
@@ -80,7 +106,7 @@ func (cmd *groupCmd) run(args []string) {
 	fmt.Fprintf(os.Stderr, "found %v topics\n", len(topics))
 
 	out := make(chan printContext)
-	go print(out, cmd.pretty)
+	go print(out, cmd.pretty, cmd.color)
 
 	if !cmd.offsets {
 		for i, grp := range groups {
@@ -105,12 +131,31 @@ func (cmd *groupCmd) run(args []string) {
 		topicPartitions[topic] = parts
 	}
 
+	if cmd.reset == sarama.OffsetOldest {
+		cmd.confirmReprocessing(topicPartitions, os.Stdin)
+	}
+	if cmd.reset == resetToTime {
+		if cmd.topic == "" {
+			topicPartitions = cmd.committedTopics(topicPartitions)
+			fmt.Fprintf(os.Stderr, "found %v topics with offsets for group=%v\n", len(topicPartitions), cmd.group)
+		}
+		cmd.resetOffsets = cmd.resolveResetTime(topicPartitions)
+	}
+
+	if cmd.lagSummary {
+		ctx := printContext{output: cmd.summarizeLag(groups, topicPartitions), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+		return
+	}
+
+	coordinators := cmd.fetchCoordinators(groups)
 	wg := &sync.WaitGroup{}
-	wg.Add(len(groups) * len(topics))
+	wg.Add(len(groups) * len(topicPartitions))
 	for _, grp := range groups {
 		for top, parts := range topicPartitions {
 			go func(grp, topic string, partitions []int32) {
-				cmd.printGroupTopicOffset(out, grp, topic, partitions)
+				cmd.printGroupTopicOffset(out, grp, coordinators[grp], topic, partitions)
 				wg.Done()
 			}(grp, top, parts)
 		}
@@ -118,8 +163,247 @@ func (cmd *groupCmd) run(args []string) {
 	wg.Wait()
 }
 
-func (cmd *groupCmd) printGroupTopicOffset(out chan printContext, grp, top string, parts []int32) {
-	target := group{Name: grp, Topic: top, Offsets: []groupOffset{}}
+// committedTopics returns the topics of topicPartitions that cmd.group has
+// committed offsets for, to reset a group across its own topics only.
+func (cmd *groupCmd) committedTopics(topicPartitions map[string][]int32) map[string][]int32 {
+	committed, err := cmd.fetchCommittedOffsets(cmd.group, topicPartitions)
+	if err != nil {
+		failf("failed to fetch offsets for group=%v err=%v", cmd.group, err)
+	}
+
+	result := map[string][]int32{}
+	for topic := range committed {
+		result[topic] = topicPartitions[topic]
+	}
+	return result
+}
+
+// resolveResetTime resolves cmd.resetAt to an offset per partition and prints
+// them to stderr before anything is committed. Times after the newest message
+// resolve to the newest offset, times before the retention to the oldest.
+func (cmd *groupCmd) resolveResetTime(topicPartitions map[string][]int32) map[string]map[int32]int64 {
+	topics := []string{}
+	for topic := range topicPartitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	result := map[string]map[int32]int64{}
+	for _, topic := range topics {
+		result[topic] = map[int32]int64{}
+		for _, p := range topicPartitions[topic] {
+			off, err := offsetForTime(cmd.client, topic, p, cmd.resetAt)
+			if err != nil {
+				failf("failed to resolve offset for time %v of topic=%v partition=%v err=%v", cmd.resetAt.Format(time.RFC3339), topic, p, err)
+			}
+			fmt.Fprintf(os.Stderr, "resetting group=%v topic=%v partition=%v to offset %v for time %v\n", cmd.group, topic, p, off, cmd.resetAt.Format(time.RFC3339))
+			result[topic][p] = off
+		}
+	}
+	return result
+}
+
+// confirmReprocessing warns about the number of messages a reset to oldest
+// may reprocess, and fails unless the estimate is below the threshold, -yes
+// is given, or the user confirms on in.
+func (cmd *groupCmd) confirmReprocessing(topicPartitions map[string][]int32, in io.Reader) {
+	limit := make(chan struct{}, defaultOffsetConcurrency)
+	var estimate int64
+	for topic, parts := range topicPartitions {
+		estimate += reprocessEstimate(fetchWatermarks(cmd.client, topic, parts, limit))
+	}
+
+	if estimate == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "resetting group=%v to oldest may reprocess up to %v messages\n", cmd.group, estimate)
+
+	if cmd.threshold <= 0 || estimate < cmd.threshold || cmd.yes {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "continue with the reset? [y/N] ")
+	if !confirmed(in) {
+		failf("aborted reset, %v messages is above -reprocess-threshold=%v. use -yes to skip the confirmation", estimate, cmd.threshold)
+	}
+}
+
+// reprocessEstimate returns the number of messages between the oldest and
+// newest offsets of partitions, skipping partitions without watermarks.
+func reprocessEstimate(partitions map[int32]watermarks) int64 {
+	var result int64
+	for p, wm := range partitions {
+		if wm.err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read offsets for partition=%v err=%v\n", p, wm.err)
+			continue
+		}
+		result += wm.newest - wm.oldest
+	}
+	return result
+}
+
+// confirmed reads an answer line from in and reports whether it's yes.
+func confirmed(in io.Reader) bool {
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+type groupLag struct {
+	Group  string `json:"group"`
+	Lag    int64  `json:"lag"`
+	Topics int    `json:"topics"`
+}
+
+// summarizeLag returns the total lag of each group across topicPartitions,
+// ranked by lag. It looks up the newest offsets once for all groups, and the
+// committed offsets of each group with a single request to its coordinator.
+func (cmd *groupCmd) summarizeLag(groups []string, topicPartitions map[string][]int32) []groupLag {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		limit     = make(chan struct{}, defaultOffsetConcurrency)
+		newest    = map[string]map[int32]int64{}
+		committed = map[string]map[string]map[int32]int64{}
+	)
+
+	for topic, parts := range topicPartitions {
+		newest[topic] = map[int32]int64{}
+		for p, wm := range fetchWatermarks(cmd.client, topic, parts, limit) {
+			if wm.err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read newest offset for topic=%v partition=%v err=%v\n", topic, p, wm.err)
+				continue
+			}
+			newest[topic][p] = wm.newest
+		}
+	}
+
+	wg.Add(len(groups))
+	for _, grp := range groups {
+		go func(grp string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			offsets, err := cmd.fetchCommittedOffsets(grp, topicPartitions)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to fetch offsets for group=%v err=%v\n", grp, err)
+				return
+			}
+
+			mu.Lock()
+			committed[grp] = offsets
+			mu.Unlock()
+		}(grp)
+	}
+	wg.Wait()
+
+	return rankGroupLags(committed, newest)
+}
+
+// fetchCommittedOffsets returns the offsets grp committed for topicPartitions,
+// leaving out partitions without a committed offset.
+func (cmd *groupCmd) fetchCommittedOffsets(grp string, topicPartitions map[string][]int32) (map[string]map[int32]int64, error) {
+	broker, err := cmd.client.Coordinator(grp)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &sarama.OffsetFetchRequest{ConsumerGroup: grp, Version: cmd.offsetVersion}
+	for topic, parts := range topicPartitions {
+		for _, p := range parts {
+			req.AddPartition(topic, p)
+		}
+	}
+
+	resp, err := broker.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]map[int32]int64{}
+	for topic, parts := range topicPartitions {
+		for _, p := range parts {
+			block := resp.GetBlock(topic, p)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				continue
+			}
+			if result[topic] == nil {
+				result[topic] = map[int32]int64{}
+			}
+			result[topic][p] = block.Offset
+		}
+	}
+	return result, nil
+}
+
+// rankGroupLags sums the lag of each group's committed offsets behind the
+// newest offsets, sorted by lag descending and then by group name. Groups
+// without committed offsets have no lag and no topics.
+func rankGroupLags(committed map[string]map[string]map[int32]int64, newest map[string]map[int32]int64) []groupLag {
+	result := []groupLag{}
+	for grp, topics := range committed {
+		gl := groupLag{Group: grp, Topics: len(topics)}
+		for topic, parts := range topics {
+			for p, off := range parts {
+				if n, ok := newest[topic][p]; ok && n > off {
+					gl.Lag += n - off
+				}
+			}
+		}
+		result = append(result, gl)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Lag != result[j].Lag {
+			return result[i].Lag > result[j].Lag
+		}
+		return result[i].Group < result[j].Group
+	})
+	return result
+}
+
+// fetchCoordinators looks up the coordinator of each group concurrently. Groups
+// whose coordinator can't be found are missing from the result.
+func (cmd *groupCmd) fetchCoordinators(groups []string) map[string]*groupCoordinator {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		limit  = make(chan struct{}, defaultOffsetConcurrency)
+		result = make(map[string]*groupCoordinator, len(groups))
+	)
+
+	wg.Add(len(groups))
+	for _, grp := range groups {
+		go func(grp string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			broker, err := cmd.client.Coordinator(grp)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to find coordinator for group=%v err=%v\n", grp, err)
+				return
+			}
+
+			mu.Lock()
+			result[grp] = &groupCoordinator{ID: broker.ID(), Addr: broker.Addr()}
+			mu.Unlock()
+		}(grp)
+	}
+	wg.Wait()
+
+	return result
+}
+
+func (cmd *groupCmd) printGroupTopicOffset(out chan printContext, grp string, coord *groupCoordinator, top string, parts []int32) {
+	target := group{Name: grp, Coordinator: coord, Topic: top, Offsets: []groupOffset{}}
 	results := make(chan groupOffset)
 	done := make(chan struct{})
 
@@ -162,9 +446,9 @@ func (cmd *groupCmd) resolveOffset(top string, part int32, off int64) int64 {
 
 func (cmd *groupCmd) fetchGroupOffset(wg *sync.WaitGroup, grp, top string, part int32, results chan groupOffset) {
 	var (
-		err           error
-		offsetManager sarama.OffsetManager
-		shouldReset   = cmd.reset >= 0 || cmd.reset == sarama.OffsetNewest || cmd.reset == sarama.OffsetOldest
+		groupOff    int64
+		verified    *bool
+		shouldReset = cmd.reset >= 0 || cmd.reset == sarama.OffsetNewest || cmd.reset == sarama.OffsetOldest || cmd.reset == resetToTime
 	)
 
 	if cmd.verbose {
@@ -173,6 +457,42 @@ func (cmd *groupCmd) fetchGroupOffset(wg *sync.WaitGroup, grp, top string, part
 
 	defer wg.Done()
 
+	if cmd.offsetVersion == 0 {
+		groupOff, verified = cmd.zookeeperGroupOffset(grp, top, part, shouldReset)
+	} else {
+		groupOff, verified = cmd.managedGroupOffset(grp, top, part, shouldReset)
+	}
+
+	// we haven't reset it, and it wasn't set before - lag depends on client's config
+	if groupOff == sarama.OffsetNewest || groupOff == sarama.OffsetOldest {
+		results <- groupOffset{Partition: part, Verified: verified}
+		return
+	}
+
+	partOff := cmd.resolveOffset(top, part, sarama.OffsetNewest)
+	lag := partOff - groupOff
+	results <- groupOffset{Partition: part, Offset: &groupOff, Lag: &lag, Verified: verified}
+}
+
+// resetTarget returns the offset that -reset moves partition part of top to.
+func (cmd *groupCmd) resetTarget(top string, part int32) int64 {
+	switch cmd.reset {
+	case sarama.OffsetNewest, sarama.OffsetOldest:
+		return cmd.resolveOffset(top, part, cmd.reset)
+	case resetToTime:
+		return cmd.resetOffsets[top][part]
+	}
+	return cmd.reset
+}
+
+// managedGroupOffset reads, and with shouldReset commits, the offset of grp
+// stored in Kafka via sarama's offset manager.
+func (cmd *groupCmd) managedGroupOffset(grp, top string, part int32, shouldReset bool) (int64, *bool) {
+	var (
+		err           error
+		offsetManager sarama.OffsetManager
+	)
+
 	if offsetManager, err = sarama.NewOffsetManagerFromClient(grp, cmd.client); err != nil {
 		failf("failed to create client err=%v", err)
 	}
@@ -184,25 +504,95 @@ func (cmd *groupCmd) fetchGroupOffset(wg *sync.WaitGroup, grp, top string, part
 	}
 	defer logClose("partition offset manager", pom)
 
+	var verified *bool
 	groupOff, _ := pom.NextOffset()
 	if shouldReset {
-		resolvedOff := cmd.reset
-		if resolvedOff == sarama.OffsetNewest || resolvedOff == sarama.OffsetOldest {
-			resolvedOff = cmd.resolveOffset(top, part, cmd.reset)
+		groupOff = cmd.resetTarget(top, part)
+		if cmd.verify {
+			// the offset manager keeps retrying a rejected commit and never
+			// finishes closing, so commit directly to see the response.
+			ok := cmd.commitAndVerify(grp, top, part, groupOff)
+			verified = &ok
+		} else {
+			pom.MarkOffset(groupOff, "")
 		}
-		groupOff = resolvedOff
-		pom.MarkOffset(resolvedOff, "")
 	}
 
-	// we haven't reset it, and it wasn't set before - lag depends on client's config
-	if groupOff == sarama.OffsetNewest || groupOff == sarama.OffsetOldest {
-		results <- groupOffset{Partition: part}
-		return
+	return groupOff, verified
+}
+
+// zookeeperGroupOffset reads, and with shouldReset commits, the offset of grp
+// stored in ZooKeeper via version 0 requests to its coordinator. sarama's
+// offset manager only supports offsets stored in Kafka.
+func (cmd *groupCmd) zookeeperGroupOffset(grp, top string, part int32, shouldReset bool) (int64, *bool) {
+	if shouldReset {
+		off := cmd.resetTarget(top, part)
+		if cmd.verify {
+			ok := cmd.commitAndVerify(grp, top, part, off)
+			return off, &ok
+		}
+		if err := cmd.commitOffset(grp, top, part, off); err != nil {
+			failf("%v", err)
+		}
+		return off, nil
 	}
 
-	partOff := cmd.resolveOffset(top, part, sarama.OffsetNewest)
-	lag := partOff - groupOff
-	results <- groupOffset{Partition: part, Offset: &groupOff, Lag: &lag}
+	committed, err := cmd.fetchCommittedOffsets(grp, map[string][]int32{top: {part}})
+	if err != nil {
+		failf("failed to fetch offset for group=%s topic=%s partition=%d err=%v", grp, top, part, err)
+	}
+	if off, ok := committed[top][part]; ok {
+		return off, nil
+	}
+	return sarama.OffsetNewest, nil
+}
+
+// commitOffset commits off for grp with an OffsetCommit request of
+// cmd.offsetVersion.
+func (cmd *groupCmd) commitOffset(grp, top string, part int32, off int64) error {
+	return commitGroupOffsets(cmd.client, grp, cmd.offsetVersion, top, map[int32]int64{part: off})
+}
+
+// commitAndVerify commits off for grp and reads it back for -verify. A
+// rejected commit is noted on stderr and reported as not verified.
+func (cmd *groupCmd) commitAndVerify(grp, top string, part int32, off int64) bool {
+	if err := cmd.commitOffset(grp, top, part, off); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return cmd.verifyOffset(grp, top, part, off)
+}
+
+// verifyOffset reads back the offset committed for grp from its coordinator
+// and reports whether it's expected, noting any discrepancy on stderr.
+func (cmd *groupCmd) verifyOffset(grp, top string, part int32, expected int64) bool {
+	broker, err := cmd.client.Coordinator(grp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to find coordinator to verify offset for group=%s err=%v\n", grp, err)
+		return false
+	}
+
+	req := &sarama.OffsetFetchRequest{ConsumerGroup: grp, Version: cmd.offsetVersion}
+	req.AddPartition(top, part)
+	resp, err := broker.FetchOffset(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch offset to verify for group=%s topic=%s partition=%d err=%v\n", grp, top, part, err)
+		return false
+	}
+
+	block := resp.GetBlock(top, part)
+	switch {
+	case block == nil:
+		fmt.Fprintf(os.Stderr, "no committed offset to verify for group=%s topic=%s partition=%d in response\n", grp, top, part)
+		return false
+	case block.Err != sarama.ErrNoError:
+		fmt.Fprintf(os.Stderr, "failed to fetch offset to verify for group=%s topic=%s partition=%d err=%v\n", grp, top, part, block.Err)
+		return false
+	case block.Offset != expected:
+		fmt.Fprintf(os.Stderr, "committed offset for group=%s topic=%s partition=%d is %v, expected %v\n", grp, top, part, block.Offset, expected)
+		return false
+	}
+	return true
 }
 
 func (cmd *groupCmd) fetchTopics() []string {
@@ -313,6 +703,7 @@ func (cmd *groupCmd) saramaConfig() *sarama.Config {
 		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-group-" + sanitizeUsername(usr.Username)
+	applyTLS(cfg, cmd.tlsConfig)
 
 	return cfg
 }
@@ -337,8 +728,21 @@ func (cmd *groupCmd) parseArgs(as []string) {
 	cmd.group = args.group
 	cmd.verbose = args.verbose
 	cmd.pretty = args.pretty
+	if cmd.color, err = resolveColor(args.color); err != nil {
+		cmd.failStartup(err.Error())
+	}
 	cmd.offsets = args.offsets
-	cmd.version = kafkaVersion(args.version)
+	cmd.verify = args.verify
+	if args.lagSummary && (args.reset != "" || !args.offsets) {
+		cmd.failStartup("-lag-summary cannot be combined with -reset or -offsets=false.")
+	}
+	cmd.lagSummary = args.lagSummary
+	cmd.threshold = args.threshold
+	cmd.yes = args.yes
+
+	if cmd.tlsConfig, err = newTLSConfig(args.tls); err != nil {
+		cmd.failStartup(err.Error())
+	}
 
 	switch args.partitions {
 	case "", "all":
@@ -362,9 +766,16 @@ func (cmd *groupCmd) parseArgs(as []string) {
 		failf("filter regexp invalid err=%v", err)
 	}
 
-	if args.reset != "" && (args.topic == "" || args.group == "") {
+	resetTime, timeErr := parseTimeOffset(args.reset)
+	if args.reset != "" && timeErr == nil && args.group == "" {
+		failf("group is required to reset offsets.")
+	}
+	if args.reset != "" && timeErr != nil && (args.topic == "" || args.group == "") {
 		failf("group and topic are required to reset offsets.")
 	}
+	if args.verify && args.reset == "" {
+		cmd.failStartup("-verify requires -reset.")
+	}
 
 	switch args.reset {
 	case "newest":
@@ -375,12 +786,20 @@ func (cmd *groupCmd) parseArgs(as []string) {
 		// optional flag
 		cmd.reset = resetNotSpecified
 	default:
+		if timeErr == nil {
+			cmd.reset = resetToTime
+			cmd.resetAt = resetTime.at
+			if resetTime.ago > 0 {
+				cmd.resetAt = time.Now().Add(-resetTime.ago)
+			}
+			break
+		}
 		cmd.reset, err = strconv.ParseInt(args.reset, 10, 64)
 		if err != nil {
 			if cmd.verbose {
 				fmt.Fprintf(os.Stderr, "failed to parse set %#v err=%v", args.reset, err)
 			}
-			cmd.failStartup(fmt.Sprintf(`set value %#v not valid. either newest, oldest or specific offset expected.`, args.reset))
+			cmd.failStartup(fmt.Sprintf(`set value %#v not valid. either newest, oldest, a specific offset, an RFC3339 time or a duration ago expected.`, args.reset))
 		}
 	}
 
@@ -392,11 +811,18 @@ func (cmd *groupCmd) parseArgs(as []string) {
 			args.brokers = "localhost:9092"
 		}
 	}
-	cmd.brokers = strings.Split(args.brokers, ",")
-	for i, b := range cmd.brokers {
-		if !strings.Contains(b, ":") {
-			cmd.brokers[i] = b + ":9092"
-		}
+	if cmd.brokers, err = parseBrokers(args.brokers); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	cmd.version = resolveKafkaVersion(args.version, cmd.brokers, cmd.tlsConfig)
+	if cmd.reset == resetToTime && !cmd.version.IsAtLeast(sarama.V0_10_1_0) {
+		cmd.failStartup("Resetting to a time requires -version v0.10.1.0 or later.")
+	}
+	if cmd.offsetVersion, err = offsetStorageVersion(args.storage, cmd.version); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	if args.storage == zookeeperOffsetStorage && args.group == "" {
+		cmd.failStartup("-offset-storage zookeeper requires -group, brokers only list groups that store their offsets in Kafka.")
 	}
 }
 
@@ -409,8 +835,15 @@ type groupArgs struct {
 	reset      string
 	verbose    bool
 	pretty     bool
+	color      string
 	version    string
 	offsets    bool
+	verify     bool
+	lagSummary bool
+	threshold  int64
+	yes        bool
+	storage    string
+	tls        tlsArgs
 }
 
 func (cmd *groupCmd) parseFlags(as []string) groupArgs {
@@ -420,17 +853,24 @@ func (cmd *groupCmd) parseFlags(as []string) groupArgs {
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.StringVar(&args.group, "group", "", "Consumer group name.")
 	flags.StringVar(&args.filter, "filter", "", "Regex to filter groups.")
-	flags.StringVar(&args.reset, "reset", "", "Target offset to reset for consumer group (newest, oldest, or specific offset)")
+	flags.StringVar(&args.reset, "reset", "", "Target offset to reset for consumer group (newest, oldest, specific offset, or an RFC3339 time or duration ago)")
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
-	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+	addColorFlag(flags, &args.color)
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version, or auto to probe the brokers for it (defaults to v0.10.0.0).")
 	flags.StringVar(&args.partitions, "partitions", allPartitionsHuman, "comma separated list of partitions to limit offsets to, or all")
 	flags.BoolVar(&args.offsets, "offsets", true, "Controls if offsets should be fetched (defauls to true)")
+	flags.BoolVar(&args.lagSummary, "lag-summary", false, "Print the total lag of each group across topics as one JSON array, ranked by lag.")
+	flags.BoolVar(&args.verify, "verify", false, "Read back the offsets committed by -reset and report whether they match.")
+	flags.Int64Var(&args.threshold, "reprocess-threshold", 1000000, "Ask for confirmation when -reset oldest may reprocess at least this many messages, 0 to never ask.")
+	flags.BoolVar(&args.yes, "yes", false, "Skip the confirmation for -reset oldest above -reprocess-threshold.")
+	flags.StringVar(&args.storage, "offset-storage", kafkaOffsetStorage, "Where the group's offsets are stored: kafka or zookeeper (for clusters before v0.9.0.0).")
+	addTLSFlags(flags, &args.tls)
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of group:")
 		flags.PrintDefaults()
-		fmt.Fprintln(os.Stderr, groupDocString)
+		fmt.Fprintln(os.Stderr, groupDocString+tlsDocString)
 		os.Exit(2)
 	}
 
@@ -446,14 +886,26 @@ The group command can be used to list groups, their offsets and lag and to reset
 
 When an explicit offset hasn't been set yet, kt prints out the respective sarama constants, cf. https://godoc.org/github.com/Shopify/sarama#pkg-constants
 
+Along with their offsets, groups include the id and address of their
+coordinator broker, which handles the group's membership and offset commits.
+
 To simply list all groups:
 
 kt group
 
-This is faster when not fetching offsets:
+This is faster when not fetching offsets, which also skips looking up each
+group's coordinator:
 
 kt group -offsets=false
 
+To see which groups are falling behind across the cluster, -lag-summary sums
+each group's lag over all topics, or -topic, and prints the groups ranked by
+lag with the number of topics they have committed offsets for:
+
+kt group -lag-summary
+
+  [{"group": "specials", "lag": 2342, "topics": 2}, {"group": "hans", "lag": 0, "topics": 1}]
+
 To filter by regex:
 
 kt group -filter specials
@@ -469,4 +921,33 @@ kt group -reset 23 -topic fav-topic -group specials -partitions 2
 To reset a consumer group's offset for all partitions:
 
 kt group -reset newest -topic fav-topic -group specials -partitions all
+
+Resetting to oldest warns with the number of messages the group may reprocess,
+counted from the oldest to the newest offsets. When that's at least
+-reprocess-threshold (1000000 by default), kt asks for confirmation on stdin
+before committing anything, unless -yes is given:
+
+kt group -reset oldest -topic fav-topic -group specials -yes
+
+To reset a group to where it was at a point in time, pass an RFC3339 time or a
+duration ago to -reset. Each partition is reset to the offset of its first
+message at or after that time, the newest offset if there's none, or the
+oldest if the time is before the retention. Without -topic, all topics the
+group has committed offsets for are reset. The resolved offsets are printed to
+stderr before anything is committed. This requires -version v0.10.1.0 or later:
+
+kt group -reset 2017-06-01T12:00:00Z -group specials -version v0.10.1.0
+kt group -reset 2h -group specials -topic fav-topic -version v0.10.1.0
+
+To confirm that the broker accepted the reset, -verify commits each offset with
+its own request, reads it back and adds "verified" to each partition's output.
+A rejected commit or a mismatch is noted on stderr and reported as not verified:
+
+kt group -reset oldest -topic fav-topic -group specials -verify
+
+Groups of consumers before v0.9.0.0 may store their offsets in ZooKeeper
+rather than Kafka. -offset-storage zookeeper reads and resets those offsets via
+the brokers, which requires -group as the brokers can't list such groups:
+
+kt group -group legacy -topic fav-topic -offset-storage zookeeper -version v0.8.2.2
 `
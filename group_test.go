@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankGroupLags(t *testing.T) {
+	newest := map[string]map[int32]int64{
+		"a": {0: 10, 1: 20},
+		"b": {0: 5},
+	}
+	committed := map[string]map[string]map[int32]int64{
+		"idle":     {},
+		"behind":   {"a": {0: 2, 1: 20}, "b": {0: 1}},
+		"current":  {"a": {0: 10}},
+		"ahead":    {"b": {0: 7}},
+		"unknowns": {"c": {0: 3}},
+	}
+
+	expected := []groupLag{
+		{Group: "behind", Lag: 12, Topics: 2},
+		{Group: "ahead", Lag: 0, Topics: 1},
+		{Group: "current", Lag: 0, Topics: 1},
+		{Group: "idle", Lag: 0, Topics: 0},
+		{Group: "unknowns", Lag: 0, Topics: 1},
+	}
+	require.Equal(t, expected, rankGroupLags(committed, newest))
+}
+
+func TestReprocessEstimate(t *testing.T) {
+	partitions := map[int32]watermarks{
+		0: {oldest: 10, newest: 110},
+		1: {oldest: 5, newest: 5},
+		2: {oldest: 0, newest: 42, err: sarama.ErrNotLeaderForPartition},
+	}
+	require.Equal(t, int64(100), reprocessEstimate(partitions))
+}
+
+func TestConfirmed(t *testing.T) {
+	data := []struct {
+		in       string
+		expected bool
+	}{
+		{in: "y\n", expected: true},
+		{in: " Yes \n", expected: true},
+		{in: "yes", expected: true},
+		{in: "n\n", expected: false},
+		{in: "\n", expected: false},
+		{in: "", expected: false},
+		{in: "yep\n", expected: false},
+	}
+
+	for _, d := range data {
+		require.Equal(t, d.expected, confirmed(strings.NewReader(d.in)), d.in)
+	}
+}
+
+func TestGroupParseArgsResetTime(t *testing.T) {
+	target := &groupCmd{}
+	target.parseArgs([]string{"-reset", "2017-06-01T12:00:00Z", "-group", "specials", "-version", "v0.10.1.0"})
+	require.Equal(t, int64(resetToTime), target.reset)
+	require.Equal(t, time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), target.resetAt.UTC())
+
+	before := time.Now()
+	target = &groupCmd{}
+	target.parseArgs([]string{"-reset", "2h", "-group", "specials", "-topic", "fav-topic", "-version", "v0.10.1.0"})
+	require.Equal(t, int64(resetToTime), target.reset)
+	require.WithinDuration(t, before.Add(-2*time.Hour), target.resetAt, time.Minute)
+
+	target = &groupCmd{}
+	target.parseArgs([]string{"-reset", "23", "-group", "specials", "-topic", "fav-topic", "-version", "v0.10.1.0"})
+	require.Equal(t, int64(23), target.reset)
+	require.True(t, target.resetAt.IsZero())
+}
+
+func TestGroupParseArgsOffsetStorage(t *testing.T) {
+	target := &groupCmd{}
+	target.parseArgs([]string{"-group", "specials"})
+	require.Equal(t, int16(1), target.offsetVersion)
+
+	target = &groupCmd{}
+	target.parseArgs([]string{"-group", "legacy", "-offset-storage", "zookeeper", "-version", "v0.8.2.2"})
+	require.Equal(t, int16(0), target.offsetVersion)
+}
+
+func TestCommitAndVerify(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	commits := sarama.NewMockOffsetCommitResponse(t).
+		SetError("rejected", "hans", 0, sarama.ErrNotCoordinatorForConsumer)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"ConsumerMetadataRequest": sarama.NewMockConsumerMetadataResponse(t).
+			SetCoordinator("accepted", broker).
+			SetCoordinator("rejected", broker),
+		"OffsetCommitRequest": commits,
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("accepted", "hans", 0, 23, "", sarama.ErrNoError).
+			SetOffset("rejected", "hans", 0, 5, "", sarama.ErrNoError),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := &groupCmd{client: client, offsetVersion: 1, verify: true}
+	require.True(t, target.commitAndVerify("accepted", "hans", 0, 23))
+	require.False(t, target.commitAndVerify("accepted", "hans", 0, 42))
+	require.False(t, target.commitAndVerify("rejected", "hans", 0, 5))
+}
@@ -31,6 +31,8 @@ The commands are:
 	produce    produce messages.
 	topic      topic information.
 	group      consumer group information and modification
+	partition  partition a key would be produced to.
+	broker     broker information.
 
 Use "kt [command] -help" for for information about the command.
 
@@ -51,6 +53,10 @@ func parseArgs() command {
 		return &topicCmd{}
 	case "group":
 		return &groupCmd{}
+	case "partition":
+		return &partitionCmd{}
+	case "broker":
+		return &brokerCmd{}
 	default:
 		failf(usageMessage)
 		return nil
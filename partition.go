@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type partitionArgs struct {
+	key        string
+	keyGiven   bool
+	partitions int
+	pretty     bool
+	color      string
+}
+
+type partitionCmd struct {
+	key        *string
+	partitions int32
+	pretty     bool
+	color      bool
+}
+
+type keyPartition struct {
+	Key       string `json:"key"`
+	Partition int32  `json:"partition"`
+	HashCode  int32  `json:"hashCode"`
+}
+
+func (cmd *partitionCmd) parseFlags(as []string) partitionArgs {
+	var (
+		args  partitionArgs
+		flags = flag.NewFlagSet("partition", flag.ExitOnError)
+	)
+
+	flags.StringVar(&args.key, "key", "", "Key to find the partition for (defaults to reading keys from stdin).")
+	flags.IntVar(&args.partitions, "partitions", 0, "Number of partitions of the topic (required).")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+	addColorFlag(flags, &args.color)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of partition:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, partitionDocString)
+		os.Exit(2)
+	}
+
+	flags.Parse(as)
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "key" {
+			args.keyGiven = true
+		}
+	})
+
+	return args
+}
+
+func (cmd *partitionCmd) failStartup(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	failf("use \"kt partition -help\" for more information")
+}
+
+func (cmd *partitionCmd) parseArgs(as []string) {
+	args := cmd.parseFlags(as)
+
+	if args.partitions <= 0 {
+		cmd.failStartup("Number of partitions is required.")
+	}
+	cmd.partitions = int32(args.partitions)
+	cmd.pretty = args.pretty
+	color, err := resolveColor(args.color)
+	if err != nil {
+		cmd.failStartup(err.Error())
+	}
+	cmd.color = color
+
+	cmd.key = nil
+	if args.keyGiven {
+		cmd.key = &args.key
+	}
+}
+
+func (cmd *partitionCmd) run(as []string) {
+	cmd.parseArgs(as)
+
+	out := make(chan printContext)
+	go print(out, cmd.pretty, cmd.color)
+
+	if cmd.key != nil {
+		cmd.print(out, *cmd.key)
+		return
+	}
+
+	keys := make(chan string)
+	go readStdinLines(16*1024*1024, keys)
+	for k := range keys {
+		cmd.print(out, k)
+	}
+}
+
+func (cmd *partitionCmd) print(out chan printContext, key string) {
+	ctx := printContext{output: newKeyPartition(key, cmd.partitions), done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+func newKeyPartition(key string, partitions int32) keyPartition {
+	return keyPartition{
+		Key:       key,
+		Partition: hashCodePartition(key, partitions),
+		HashCode:  hashCode(key),
+	}
+}
+
+var partitionDocString = `
+The partition command prints the partition that produce's hashCode partitioner
+picks for a key, without connecting to a cluster. The partitioner mimics the
+default partitioner of the JVM producer up to Kafka 0.8.2 (abs(key.hashCode())
+modulo the number of partitions), and the output includes the key's
+JVM-compatible String#hashCode.
+
+To find the partition for a single key:
+
+  $ kt partition -partitions 8 -key id-23
+  {
+    "key": "id-23",
+    "partition": 3,
+    "hashCode": 99993651
+  }
+
+Without -key, keys are read from stdin, one per line:
+
+  $ printf 'id-23\nid-42\n' | kt partition -partitions 8 -pretty=false
+  {"key":"id-23","partition":3,"hashCode":99993651}
+  {"key":"id-42","partition":0,"hashCode":99993712}
+`
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionParseArgs(t *testing.T) {
+	target := &partitionCmd{}
+
+	target.parseArgs([]string{"-partitions", "4"})
+	require.Equal(t, int32(4), target.partitions)
+	require.Nil(t, target.key)
+
+	target.parseArgs([]string{"-partitions", "4", "-key", ""})
+	require.NotNil(t, target.key)
+	require.Equal(t, "", *target.key)
+}
+
+func TestNewKeyPartition(t *testing.T) {
+	require.Equal(t, keyPartition{Key: "random", Partition: 0, HashCode: -938285885}, newKeyPartition("random", 5))
+	require.Equal(t, keyPartition{Key: "a", Partition: 1, HashCode: 97}, newKeyPartition("a", 2))
+}
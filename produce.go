@@ -1,17 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
+	"golang.org/x/crypto/ssh/terminal"
+
 	"github.com/Shopify/sarama"
 )
 
@@ -23,43 +41,140 @@ type produceArgs struct {
 	timeout     time.Duration
 	verbose     bool
 	pretty      bool
+	color       string
 	version     string
 	compression string
 	literal     bool
 	decodeKey   string
 	decodeValue string
+	encode      string
 	partitioner string
+	stickySize  int
 	bufferSize  int
+	inputDir    string
+	dirKey      string
+	manifest    string
+	inputs      string
+	merge       string
+	keySchema   string
+	valueSchema string
+	report      bool
+	template    string
+	nullKey     string
+	linger      time.Duration
+	queueSize   int
+	refresh     time.Duration
+	refreshPart time.Duration
+	interval    time.Duration
+	ordered     bool
+	acks        string
+	tls         tlsArgs
+	dedupKeys   bool
+	keySep      string
+	explain     bool
+	verifyPart  bool
+	reference   string
+	keyPaths    string
+	keyPathSep  string
+	contOnError bool
+	strictInput bool
+	inputFormat string
+	keyFrames   bool
+	frameKey    string
+	generate    int
+	valueSize   int
+	keyPattern  string
+	valueTmpl   string
+	rate        int
 }
 
 type message struct {
-	Key       *string `json:"key"`
-	Value     *string `json:"value"`
-	Partition *int32  `json:"partition"`
+	Key        *string `json:"key"`
+	Value      *string `json:"value"`
+	ValueFile  *string `json:"valueFile"`
+	Partition  *int32  `json:"partition"`
+	KeyCodec   *string `json:"keyCodec"`
+	ValueCodec *string `json:"valueCodec"`
+	Acks       *string `json:"acks"`
+
+	// rawValue holds the content of ValueFile, or the value encoded via
+	// -value-schema, it is used as is rather than decoded according to
+	// -decodevalue.
+	rawValue []byte
+	// rawKey holds the content of a -manifest entry's keyFile, or the key
+	// encoded via -key-schema, it is used as is rather than decoded according
+	// to -decodekey.
+	rawKey []byte
+	// entry is the index of the -manifest entry the message was read from.
+	entry *int
+	// topic is set when -topic-template routes the message to a topic other
+	// than -topic.
+	topic string
+	// partitionFlag is set when Partition is taken from -partition rather
+	// than the input.
+	partitionFlag bool
 }
 
 func (cmd *produceCmd) read(as []string) produceArgs {
 	var args produceArgs
 	flags := flag.NewFlagSet("produce", flag.ExitOnError)
-	flags.StringVar(&args.topic, "topic", "", "Topic to produce to (required).")
+	flags.StringVar(&args.topic, "topic", "", "Topic to produce to (required unless -topic-template is given).")
+	flags.StringVar(&args.template, "topic-template", "", "Go template to derive the topic per message from its key and value, e.g. '{{.Key | prefix 3}}'.")
 	flags.IntVar(&args.partition, "partition", 0, "Partition to produce to (defaults to 0).")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.IntVar(&args.batch, "batch", 1, "Max size of a batch before sending it off")
 	flags.DurationVar(&args.timeout, "timeout", 50*time.Millisecond, "Duration to wait for batch to be filled before sending it off")
+	flags.BoolVar(&args.explain, "explain", false, "Print the partition each input message would be sent to and why, without sending anything.")
+	flags.BoolVar(&args.verifyPart, "verify-partitioning", false, "Send a test message per key read from the input lines via -reference-partitioner, read each back and report whether it landed in the partition -partitioner predicts.")
+	flags.StringVar(&args.reference, "reference-partitioner", "murmur2", "Partitioner of other clients to compare -partitioner with for -verify-partitioning [murmur2|fnv1a]: the Java producer's or sarama's default.")
+	flags.BoolVar(&args.dedupKeys, "dedup-keys", false, "Read all input before sending and send only the last message per key.")
+	addTLSFlags(flags, &args.tls)
+	flags.DurationVar(&args.linger, "linger", 0, "Max duration a batch waits after its first message before sending it off, regardless of -timeout (default 0 to disable).")
+	flags.DurationVar(&args.refresh, "metadata-refresh", 10*time.Minute, "Interval to refresh the partition leaders of topics being produced to (default 0 to never refresh).")
+	flags.DurationVar(&args.refreshPart, "refresh-partitions", 0, "Interval to look up the partition counts of topics being produced to again, to pick up added partitions (default 0 to keep the first counts).")
+	flags.DurationVar(&args.interval, "report-interval", 0, "Interval to print a progress summary to stderr (default 0 to disable).")
+	flags.StringVar(&args.acks, "acks", "all", "Acks to wait for per request (all|leader|none), JSON input can override it per message via acks.")
+	flags.BoolVar(&args.ordered, "order-by-partition", false, "Send the requests of each batch to the partitions' leader brokers concurrently rather than one broker after another, keeping each partition in input order.")
+	flags.IntVar(&args.queueSize, "queue-size", 0, "Number of messages and batches to queue while a batch is being sent (default 0 for no queueing).")
 	flags.BoolVar(&args.verbose, "verbose", false, "Verbose output")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+	addColorFlag(flags, &args.color)
 	flags.BoolVar(&args.literal, "literal", false, "Interpret stdin line literally and pass it as value, key as null.")
-	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+	flags.StringVar(&args.keySep, "key-separator", "", "Interpret stdin lines as key and value separated by the first occurrence of this separator, instead of JSON.")
+	flags.StringVar(&args.keyPaths, "json-key-path", "", "Comma separated paths of fields in JSON values to use as key for messages without one, e.g. '$.user.id,$.order.id'.")
+	flags.StringVar(&args.keyPathSep, "json-key-separator", "|", "Separator to join the fields of -json-key-path with.")
+	flags.BoolVar(&args.contOnError, "continue-on-error", false, "Skip input lines that can't be parsed or decoded with a note on stderr, rather than failing.")
+	flags.BoolVar(&args.strictInput, "strict-input", false, "Reject input lines that aren't JSON objects of the documented fields, e.g. with a misspelled field, rather than falling back to defaults.")
+	flags.StringVar(&args.inputFormat, "input-format", "lines", "Format of stdin [lines|frames]: newline separated lines, or 4-byte big-endian length prefixed binary values.")
+	flags.BoolVar(&args.keyFrames, "key-frames", false, "Read frames for -input-format frames in pairs of key and value.")
+	flags.StringVar(&args.frameKey, "frame-key", "", "Key to send all frames of -input-format frames with (defaults to a null key).")
+	flags.IntVar(&args.generate, "generate", 0, "Produce this many generated messages instead of reading input, e.g. for load testing (default 0 to disable).")
+	flags.IntVar(&args.valueSize, "value-size", 100, "Size in bytes of the random values of -generate.")
+	flags.StringVar(&args.keyPattern, "key-pattern", "seq", "Keys of the messages for -generate [seq|random|const]: the message's sequence number, random hex or the same key for all.")
+	flags.StringVar(&args.valueTmpl, "value-template", "", "Go template for the values of -generate instead of random bytes, e.g. '{\"n\": {{.Seq}}, \"key\": \"{{.Key}}\"}'.")
+	flags.IntVar(&args.rate, "rate", 0, "Max number of messages per second for -generate (default 0 for no limit).")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version, or auto to probe the brokers for it (defaults to v0.10.0.0).")
 	flags.StringVar(&args.compression, "compression", "", "Kafka message compression codec [gzip|snappy|lz4] (defaults to none)")
-	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: hashCode")
-	flags.StringVar(&args.decodeKey, "", "string", "Decode message value as (string|hex|base64), defaults to string.")
-	flags.StringVar(&args.decodeValue, "", "string", "Decode message value as (string|hex|base64), defaults to string.")
-	flags.IntVar(&args.bufferSize, "buffersize", 16777216, "Buffer size for scanning stdin, defaults to 16777216=16*1024*1024.")
+	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: hashCode, sticky")
+	flags.IntVar(&args.stickySize, "sticky-size", 100, "Number of keyless messages the sticky partitioner sends to one partition before moving on to the next.")
+	flags.StringVar(&args.nullKey, "null-key", "null", "Policy for input without a key [null|error]: send a null key or fail.")
+	flags.StringVar(&args.decodeKey, "decodekey", "", "Decode message key as (string|hex|base64|base64url|cbor), defaults to -encode.")
+	flags.StringVar(&args.decodeValue, "decodevalue", "", "Decode message value as (string|hex|base64|base64url|cbor), defaults to -encode.")
+	flags.StringVar(&args.encode, "encode", "", "Decode both message key and value as (string|hex|base64|base64url|cbor), defaults to string.")
+	flags.IntVar(&args.bufferSize, "buffersize", 16777216, "Max size in bytes of a line read from stdin, defaults to 16777216=16*1024*1024.")
+	flags.StringVar(&args.inputDir, "input-dir", "", "Produce each file in this directory as a single message instead of reading stdin.")
+	flags.BoolVar(&args.report, "report", false, "Print the partition and offset of every produced message, instead of a summary per batch.")
+	flags.StringVar(&args.dirKey, "input-dir-key", "", "Regex applied to file names for -input-dir, its first group is used as the key (defaults to the whole file name).")
+	flags.StringVar(&args.keySchema, "key-schema", "", "Avro schema, inline or a path to an .avsc file, to encode JSON keys with as plain Avro binary data.")
+	flags.StringVar(&args.valueSchema, "value-schema", "", "Avro schema, inline or a path to an .avsc file, to encode JSON values with as plain Avro binary data.")
+	flags.StringVar(&args.manifest, "manifest", "", "JSON file listing entries with a keyFile and valueFile each, to produce one message per entry instead of reading stdin.")
+	flags.StringVar(&args.inputs, "input", "", "Comma separated list of files to read input lines from instead of stdin, - for stdin.")
+	flags.StringVar(&args.merge, "merge-inputs", "sequential", "How to merge the lines of several -input files [sequential|fair]: each file in turn to its end, or one line of each file in turn.")
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of produce:")
 		flags.PrintDefaults()
-		fmt.Fprintln(os.Stderr, produceDocString)
+		fmt.Fprintln(os.Stderr, produceDocString+tlsDocString)
 		os.Exit(2)
 	}
 
@@ -78,8 +193,17 @@ func (cmd *produceCmd) failStartup(msg string) {
 
 func (cmd *produceCmd) parseArgs(as []string) {
 	args := cmd.read(as)
+
+	if args.template != "" {
+		tmpl, err := template.New("topic").Funcs(topicTemplateFuncs).Parse(args.template)
+		if err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid topic template err=%v", err))
+		}
+		cmd.topicTemplate = tmpl
+	}
+
 	envTopic := os.Getenv("KT_TOPIC")
-	if args.topic == "" {
+	if args.topic == "" && cmd.topicTemplate == nil {
 		if envTopic == "" {
 			cmd.failStartup("Topic name is required.")
 		} else {
@@ -97,35 +221,238 @@ func (cmd *produceCmd) parseArgs(as []string) {
 		}
 	}
 
-	cmd.brokers = strings.Split(args.brokers, ",")
-	for i, b := range cmd.brokers {
-		if !strings.Contains(b, ":") {
-			cmd.brokers[i] = b + ":9092"
-		}
+	var err error
+	if cmd.brokers, err = parseBrokers(args.brokers); err != nil {
+		cmd.failStartup(err.Error())
+	}
+
+	if _, err := getTransformValue("encode", "", args.encode); err != nil {
+		cmd.failStartup(err.Error())
 	}
 
-	if decodeValue, err := getTransformValue("decodevalue", "KT_DECODE_VALUE", args.decodeValue); err == nil {
+	if decodeValue, err := getTransformValue("decodevalue", "KT_DECODE_VALUE", args.decodeValue, args.encode); err == nil {
 		cmd.decodeValue = decodeValue
 	} else {
 		cmd.failStartup(err.Error())
 	}
 
-	if decodeKey, err := getTransformValue("decodekey", "KT_DECODE_KEY", args.decodeKey); err == nil {
+	if decodeKey, err := getTransformValue("decodekey", "KT_DECODE_KEY", args.decodeKey, args.encode); err == nil {
 		cmd.decodeKey = decodeKey
 	} else {
 		cmd.failStartup(err.Error())
 	}
 
+	if cmd.tlsConfig, err = newTLSConfig(args.tls); err != nil {
+		cmd.failStartup(err.Error())
+	}
+
+	if args.generate < 0 || args.valueSize < 0 || args.rate < 0 {
+		cmd.failStartup("-generate, -value-size and -rate cannot be negative.")
+	}
+	if args.generate > 0 && (args.inputDir != "" || args.explain) {
+		cmd.failStartup("-generate cannot be combined with -input-dir or -explain.")
+	}
+
+	switch args.inputFormat {
+	case "lines":
+		if args.keyFrames || args.frameKey != "" {
+			cmd.failStartup("-key-frames and -frame-key require -input-format frames.")
+		}
+	case "frames":
+		if args.literal || args.keySep != "" || args.keyPaths != "" || args.inputDir != "" || args.explain || args.generate > 0 {
+			cmd.failStartup("-input-format frames cannot be combined with -literal, -key-separator, -json-key-path, -input-dir, -explain or -generate.")
+		}
+		if args.keyFrames && args.frameKey != "" {
+			cmd.failStartup("-key-frames cannot be combined with -frame-key.")
+		}
+		cmd.frames = true
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -input-format %#v, only lines and frames are supported.`, args.inputFormat))
+	}
+	cmd.keyFrames = args.keyFrames
+	if args.frameKey != "" {
+		cmd.frameKey = &args.frameKey
+	}
+	switch args.keyPattern {
+	case "seq", "random", "const":
+		cmd.keyPattern = args.keyPattern
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -key-pattern %#v, only seq, random and const are supported.`, args.keyPattern))
+	}
+	if args.valueTmpl != "" {
+		if cmd.valueTmpl, err = template.New("value").Parse(args.valueTmpl); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid value template err=%v", err))
+		}
+	}
+	cmd.generate = args.generate
+	cmd.contOnError = args.contOnError
+	if args.strictInput && (args.literal || args.keySep != "" || args.inputFormat != "lines" || args.inputDir != "" || args.generate > 0) {
+		cmd.failStartup("-strict-input only applies to JSON input lines.")
+	}
+	cmd.strictInput = args.strictInput
+	cmd.valueSize = args.valueSize
+	cmd.rate = args.rate
+
+	if args.dedupKeys && args.inputDir == "" && args.manifest == "" && args.generate == 0 && !boundedInputs(args.inputs) && terminal.IsTerminal(int(syscall.Stdin)) {
+		cmd.failStartup("-dedup-keys requires bounded input, e.g. a file piped to stdin or -input-dir.")
+	}
+	cmd.dedupKeys = args.dedupKeys
+
+	if args.explain && args.inputDir != "" {
+		cmd.failStartup("-explain reads stdin, it cannot be combined with -input-dir.")
+	}
+	cmd.explainOnly = args.explain
+
+	if args.verifyPart {
+		if args.inputDir != "" || args.manifest != "" || args.generate > 0 || args.explain || cmd.frames || args.template != "" || args.dedupKeys {
+			cmd.failStartup("-verify-partitioning cannot be combined with -input-dir, -manifest, -generate, -explain, -input-format frames, -topic-template or -dedup-keys.")
+		}
+		if args.partitioner == "" {
+			cmd.failStartup("-verify-partitioning requires -partitioner, without one kt sends all messages to partition 0.")
+		}
+		if args.acks == "none" {
+			cmd.failStartup("-verify-partitioning cannot be combined with -acks none, brokers don't report where messages landed without acks.")
+		}
+		if cmd.reference = referencePartitioners[args.reference]; cmd.reference == nil {
+			cmd.failStartup(fmt.Sprintf(`unsupported -reference-partitioner %#v, only murmur2 and fnv1a are supported.`, args.reference))
+		}
+	}
+	cmd.verifyPart = args.verifyPart
+
 	cmd.batch = args.batch
+	cmd.linger = args.linger
+	if args.refresh < 0 {
+		cmd.failStartup("-metadata-refresh should not be negative.")
+	}
+	cmd.refresh = args.refresh
+	if args.refreshPart < 0 {
+		cmd.failStartup("-refresh-partitions should not be negative.")
+	}
+	cmd.refreshPart = args.refreshPart
+	if args.interval < 0 {
+		cmd.failStartup("-report-interval should not be negative.")
+	}
+	cmd.interval = args.interval
+	cmd.orderByPartition = args.ordered
+	if cmd.acks, err = parseAcks(args.acks); err != nil {
+		cmd.failStartup(err.Error())
+	}
+	if args.queueSize < 0 {
+		cmd.failStartup(fmt.Sprintf("-queue-size should not be negative, got %v", args.queueSize))
+	}
+	cmd.queueSize = args.queueSize
 	cmd.timeout = args.timeout
 	cmd.verbose = args.verbose
 	cmd.pretty = args.pretty
+	if cmd.color, err = resolveColor(args.color); err != nil {
+		cmd.failStartup(err.Error())
+	}
 	cmd.literal = args.literal
 	cmd.partition = int32(args.partition)
-	cmd.partitioner = args.partitioner
-	cmd.version = kafkaVersion(args.version)
+	switch args.partitioner {
+	case "", "hashCode", "sticky":
+		cmd.partitioner = args.partitioner
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -partitioner %#v, only hashCode and sticky are supported.`, args.partitioner))
+	}
+	if args.stickySize < 1 {
+		cmd.failStartup(fmt.Sprintf("-sticky-size should be at least 1, got %v", args.stickySize))
+	}
+	cmd.stickySize = args.stickySize
+	cmd.version = resolveKafkaVersion(args.version, cmd.brokers, cmd.tlsConfig)
 	cmd.compression = kafkaCompression(args.compression)
+	if args.bufferSize < 1 {
+		cmd.failStartup(fmt.Sprintf("-buffersize should be at least 1, got %v", args.bufferSize))
+	}
 	cmd.bufferSize = args.bufferSize
+	cmd.inputDir = args.inputDir
+	cmd.report = args.report
+
+	switch args.nullKey {
+	case "null", "error":
+		cmd.nullKey = args.nullKey
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -null-key argument %#v, only null and error are supported.`, args.nullKey))
+	}
+	if args.keyPaths != "" {
+		paths, err := parseKeyPaths(args.keyPaths)
+		if err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -json-key-path err=%v", err))
+		}
+		cmd.keyPaths = paths
+	}
+	cmd.keyPathSep = args.keyPathSep
+	if cmd.nullKey == "error" && cmd.literal && cmd.keyPaths == nil {
+		cmd.failStartup("-null-key error cannot be combined with -literal, which always sends a null key.")
+	}
+	if args.keySep != "" && cmd.literal {
+		cmd.failStartup("-key-separator cannot be combined with -literal.")
+	}
+	cmd.keySep = args.keySep
+
+	if args.dirKey != "" {
+		if args.inputDir == "" {
+			cmd.failStartup("-input-dir-key requires -input-dir.")
+		}
+		re, err := regexp.Compile(args.dirKey)
+		if err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid regex for -input-dir-key err=%v", err))
+		}
+		cmd.dirKey = re
+	}
+
+	if args.manifest != "" {
+		if args.inputDir != "" || args.generate > 0 || args.explain || cmd.frames || args.literal || args.keySep != "" || args.keyPaths != "" {
+			cmd.failStartup("-manifest cannot be combined with -input-dir, -generate, -explain, -input-format frames, -literal, -key-separator or -json-key-path.")
+		}
+		if cmd.manifest, err = readManifest(args.manifest); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -manifest %v: %v", args.manifest, err))
+		}
+		cmd.manifestDir = filepath.Dir(args.manifest)
+		cmd.report = true
+	}
+
+	if args.inputs != "" {
+		if args.inputDir != "" || args.manifest != "" || args.generate > 0 || cmd.frames {
+			cmd.failStartup("-input cannot be combined with -input-dir, -manifest, -generate or -input-format frames.")
+		}
+		if cmd.inputs, err = parseInputs(args.inputs); err != nil {
+			cmd.failStartup(err.Error())
+		}
+		cmd.inputCounts = make([]int64, len(cmd.inputs))
+	}
+	switch args.merge {
+	case "sequential":
+	case "fair":
+		if len(cmd.inputs) < 2 {
+			cmd.failStartup("-merge-inputs fair requires several files via -input.")
+		}
+		cmd.mergeFair = true
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported -merge-inputs %#v, only sequential and fair are supported.`, args.merge))
+	}
+
+	if args.keySchema != "" || args.valueSchema != "" {
+		if args.inputDir != "" || args.manifest != "" || args.generate > 0 || cmd.frames {
+			cmd.failStartup("-key-schema and -value-schema only apply to input lines, not -input-dir, -manifest, -generate or -input-format frames.")
+		}
+	}
+	if args.keySchema != "" {
+		if args.decodeKey != "" || args.encode != "" {
+			cmd.failStartup("-key-schema cannot be combined with -decodekey or -encode.")
+		}
+		if cmd.keySchema, err = readAvroSchema(args.keySchema); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -key-schema err=%v", err))
+		}
+	}
+	if args.valueSchema != "" {
+		if args.decodeValue != "" || args.encode != "" {
+			cmd.failStartup("-value-schema cannot be combined with -decodevalue or -encode.")
+		}
+		if cmd.valueSchema, err = readAvroSchema(args.valueSchema); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid -value-schema err=%v", err))
+		}
+	}
 }
 
 func kafkaCompression(codecName string) sarama.CompressionCodec {
@@ -144,12 +471,67 @@ func kafkaCompression(codecName string) sarama.CompressionCodec {
 	panic("unreachable")
 }
 
-func (cmd *produceCmd) findLeaders() {
+// topicLeaders returns the leader brokers per partition of topic, fetching
+// them on first use and again once they're older than -metadata-refresh.
+func (cmd *produceCmd) topicLeaders(topic string) map[int32]*sarama.Broker {
+	cmd.leadersMu.Lock()
+	defer cmd.leadersMu.Unlock()
+
+	if cmd.leaders == nil {
+		cmd.leaders = map[string]map[int32]*sarama.Broker{}
+		cmd.leadersFetched = map[string]time.Time{}
+	}
+	_, ok := cmd.leaders[topic]
+	if !ok || cmd.leadersStale(topic) {
+		if ok && cmd.verbose {
+			fmt.Fprintf(os.Stderr, "refreshing leaders for topic=%v\n", topic)
+		}
+		cmd.leaders[topic] = cmd.findLeaders(topic)
+		cmd.leadersFetched[topic] = time.Now()
+	}
+	return cmd.leaders[topic]
+}
+
+// partitionCount returns the number of partitions of topic, looking it up on
+// first use and again, along with the topic's leaders, once it's older than
+// -refresh-partitions.
+func (cmd *produceCmd) partitionCount(topic string) int32 {
+	cmd.countsMu.Lock()
+	defer cmd.countsMu.Unlock()
+
+	if cmd.counts == nil {
+		cmd.counts = map[string]int32{}
+		cmd.countsFetched = map[string]time.Time{}
+	}
+
+	count, ok := cmd.counts[topic]
+	stale := ok && cmd.refreshPart > 0 && time.Since(cmd.countsFetched[topic]) >= cmd.refreshPart
+	if ok && !stale {
+		return count
+	}
+
+	if stale {
+		cmd.leadersMu.Lock()
+		delete(cmd.leaders, topic)
+		cmd.leadersMu.Unlock()
+	}
+	cmd.counts[topic] = int32(len(cmd.topicLeaders(topic)))
+	cmd.countsFetched[topic] = time.Now()
+	if stale && cmd.counts[topic] != count {
+		fmt.Fprintf(os.Stderr, "partition count of topic=%v changed from %v to %v\n", topic, count, cmd.counts[topic])
+	}
+	return cmd.counts[topic]
+}
+
+func (cmd *produceCmd) leadersStale(topic string) bool {
+	fetched, ok := cmd.leadersFetched[topic]
+	return ok && cmd.refresh > 0 && time.Since(fetched) >= cmd.refresh
+}
+
+func (cmd *produceCmd) saramaConfig() *sarama.Config {
 	var (
-		usr *user.User
 		err error
-		res *sarama.MetadataResponse
-		req = sarama.MetadataRequest{Topics: []string{cmd.topic}}
+		usr *user.User
 		cfg = sarama.NewConfig()
 	)
 
@@ -159,9 +541,26 @@ func (cmd *produceCmd) findLeaders() {
 		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-produce-" + sanitizeUsername(usr.Username)
+	cfg.Metadata.RefreshFrequency = cmd.refresh
+	applyTLS(cfg, cmd.tlsConfig)
+
+	return cfg
+}
+
+func (cmd *produceCmd) findLeaders(topic string) map[int32]*sarama.Broker {
+	var (
+		err error
+		res *sarama.MetadataResponse
+		req = sarama.MetadataRequest{Topics: []string{topic}}
+		cfg = cmd.saramaConfig()
+	)
+
 	if cmd.verbose {
 		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
 	}
+	if cmd.conns == nil {
+		cmd.conns = map[int32]*sarama.Broker{}
+	}
 
 loop:
 	for _, addr := range cmd.brokers {
@@ -186,18 +585,23 @@ loop:
 		}
 
 		for _, tm := range res.Topics {
-			if tm.Name == cmd.topic {
+			if tm.Name == topic {
 				if tm.Err != sarama.ErrNoError {
 					fmt.Fprintf(os.Stderr, "Failed to get metadata from %#v. err=%v\n", addr, tm.Err)
 					continue loop
 				}
 
-				cmd.leaders = map[int32]*sarama.Broker{}
+				leaders := map[int32]*sarama.Broker{}
 				for _, pm := range tm.Partitions {
 					b, ok := brokers[pm.Leader]
 					if !ok {
 						failf("failed to find leader in broker response, giving up")
 					}
+					if conn, ok := cmd.conns[b.ID()]; ok && conn.Addr() == b.Addr() {
+						leaders[pm.ID] = conn
+						continue
+					}
+					cmd.conns[b.ID()] = b
 
 					if err = b.Open(cfg); err != nil && err != sarama.ErrAlreadyConnected {
 						failf("failed to open broker connection err=%s", err)
@@ -206,14 +610,15 @@ loop:
 						failf("failed to wait for broker connection to open err=%s", err)
 					}
 
-					cmd.leaders[pm.ID] = b
+					leaders[pm.ID] = b
 				}
-				return
+				return leaders
 			}
 		}
 	}
 
-	failf("failed to find leader for given topic")
+	failf("failed to find leader for topic %v", topic)
+	return nil
 }
 
 type produceCmd struct {
@@ -221,8 +626,14 @@ type produceCmd struct {
 	brokers     []string
 	batch       int
 	timeout     time.Duration
+	linger      time.Duration
+	queueSize   int
+	refresh     time.Duration
+	refreshPart time.Duration
+	interval    time.Duration
 	verbose     bool
 	pretty      bool
+	color       bool
 	literal     bool
 	partition   int32
 	version     sarama.KafkaVersion
@@ -231,8 +642,105 @@ type produceCmd struct {
 	decodeKey   string
 	decodeValue string
 	bufferSize  int
+	inputDir    string
+	dirKey      *regexp.Regexp
+	report      bool
+	nullKey     string
+	tlsConfig   *tls.Config
+	dedupKeys   bool
+	keySep      string
+	explainOnly bool
+	verifyPart  bool
+	reference   sarama.PartitionerConstructor
+	keyPaths    [][]string
+	keyPathSep  string
+	generate    int
+	valueSize   int
+	keyPattern  string
+	valueTmpl   *template.Template
+	rate        int
+	contOnError bool
+	strictInput bool
+	frames      bool
+	keyFrames   bool
+	frameKey    *string
+
+	// manifest are the entries of -manifest, their files are resolved
+	// relative to manifestDir.
+	manifest       []manifestEntry
+	manifestDir    string
+	manifestFailed int
+	// keySchema and valueSchema encode JSON keys and values as Avro.
+	keySchema   *avroSchema
+	valueSchema *avroSchema
+	// inputs are the files of -input, - for stdin, read in the order of
+	// -merge-inputs. inputCounts are updated atomically per line read.
+	inputs      []string
+	mergeFair   bool
+	inputCounts []int64
+
+	// orderByPartition sends the requests of a batch to brokers concurrently.
+	orderByPartition bool
+	// acks is the acks level for messages without an acks field.
+	acks sarama.RequiredAcks
+
+	topicTemplate *template.Template
+	roundRobin    int32
+	// stickyCount is the number of keyless messages sent to the current
+	// partition of the sticky partitioner, which moves on after stickySize.
+	stickyCount int
+	stickySize  int
+	sticky      int32
+
+	leadersMu sync.Mutex
+	leaders   map[string]map[int32]*sarama.Broker
+	// leadersFetched records when the leaders of each topic were fetched,
+	// to refresh them after -metadata-refresh.
+	leadersFetched map[string]time.Time
+	// counts are the partition counts per topic, looked up once and again
+	// after -refresh-partitions, so messages in between are partitioned
+	// consistently even if leaders are refreshed.
+	countsMu      sync.Mutex
+	counts        map[string]int32
+	countsFetched map[string]time.Time
+	// conns are the leader brokers opened so far by ID, reused when leaders
+	// are refreshed.
+	conns map[int32]*sarama.Broker
+	// sent and skipped are updated atomically, as -report-interval reads them
+	// while messages are being produced.
+	sent    int64
+	skipped int64
+	stats   batchStats
+	// generatedBytes is the total size of the values created by -generate.
+	generatedBytes int64
+}
 
-	leaders map[int32]*sarama.Broker
+// batchStats tracks the sizes of the batches sent, to judge the effect of
+// -batch, -timeout and -linger.
+type batchStats struct {
+	count    int64
+	messages int64
+	min      int
+	max      int
+}
+
+func (s *batchStats) add(size int) {
+	if s.count == 0 || size < s.min {
+		s.min = size
+	}
+	if size > s.max {
+		s.max = size
+	}
+	s.count++
+	s.messages += int64(size)
+}
+
+func (s batchStats) String() string {
+	if s.count == 0 {
+		return "sent no batches"
+	}
+	avg := float64(s.messages) / float64(s.count)
+	return fmt.Sprintf("sent %v messages in %v batches, batch sizes min=%v avg=%.1f max=%v", s.messages, s.count, s.min, avg, s.max)
 }
 
 func (cmd *produceCmd) run(as []string) {
@@ -242,216 +750,1587 @@ func (cmd *produceCmd) run(as []string) {
 	}
 
 	defer cmd.close()
-	cmd.findLeaders()
-	stdin := make(chan string)
-	lines := make(chan string)
-	messages := make(chan message)
-	batchedMessages := make(chan []message)
+	var partitionCount int32
+	if cmd.topicTemplate == nil {
+		partitionCount = cmd.partitionCount(cmd.topic)
+	}
+	stdin := make(chan inputLine)
+	lines := make(chan inputLine)
+	messages := make(chan message, cmd.queueSize)
+	batchedMessages := make(chan []message, cmd.queueSize)
 	out := make(chan printContext)
 	q := make(chan struct{})
 
-	go readStdinLines(cmd.bufferSize, stdin)
-	go print(out, cmd.pretty)
-
+	go print(out, cmd.pretty, cmd.color)
 	go listenForInterrupt(q)
-	go cmd.readInput(q, stdin, lines)
-	go cmd.deserializeLines(lines, messages, int32(len(cmd.leaders)))
-	go cmd.batchRecords(messages, batchedMessages)
-	cmd.produce(batchedMessages, out)
-}
 
-func (cmd *produceCmd) close() {
-	for _, b := range cmd.leaders {
-		var (
-			connected bool
-			err       error
-		)
+	if cmd.explainOnly {
+		go cmd.readLines(stdin)
+		go cmd.readInput(q, stdin, lines)
+		cmd.explainLines(lines, out, partitionCount)
+		return
+	}
+	if cmd.verifyPart {
+		go cmd.readLines(stdin)
+		go cmd.readInput(q, stdin, lines)
+		cmd.verifyPartitioning(lines, out, partitionCount)
+		return
+	}
 
-		if connected, err = b.Connected(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to check if broker is connected. err=%s\n", err)
-			continue
-		}
+	start := time.Now()
+	switch {
+	case cmd.generate > 0:
+		go cmd.generateMessages(q, messages, partitionCount)
+	case cmd.inputDir != "":
+		go cmd.readDir(q, messages, partitionCount)
+	case cmd.manifest != nil:
+		go cmd.readManifestMessages(q, messages, out, partitionCount)
+	case cmd.frames:
+		frames := make(chan []byte)
+		go cmd.readStdinFrames(frames)
+		go cmd.deserializeFrames(q, frames, messages, partitionCount)
+	default:
+		go cmd.readLines(stdin)
+		go cmd.readInput(q, stdin, lines)
+		go cmd.deserializeLines(lines, messages, partitionCount)
+	}
 
-		if !connected {
-			continue
-		}
+	if cmd.dedupKeys {
+		deduped := make(chan message, cmd.queueSize)
+		go cmd.dedupMessages(messages, deduped)
+		messages = deduped
+	}
 
-		if err = b.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to close broker %v connection. err=%s\n", b, err)
-		}
+	go cmd.batchRecords(messages, batchedMessages)
+	if cmd.interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go cmd.reportProgress(start, done)
+	}
+	cmd.produce(batchedMessages, out)
+
+	if cmd.inputDir != "" {
+		fmt.Fprintf(os.Stderr, "sent %v files from %v\n", cmd.sent, cmd.inputDir)
+	}
+	for i, name := range cmd.inputs {
+		fmt.Fprintf(os.Stderr, "read %v lines from input %v\n", atomic.LoadInt64(&cmd.inputCounts[i]), name)
+	}
+	if cmd.contOnError {
+		fmt.Fprintf(os.Stderr, "skipped %v invalid input lines\n", cmd.skipped)
+	}
+	if cmd.manifestFailed > 0 {
+		failf("failed to produce %v of %v manifest entries", cmd.manifestFailed, len(cmd.manifest))
+	}
+	if cmd.generate > 0 {
+		elapsed := time.Since(start)
+		secs := elapsed.Seconds()
+		fmt.Fprintf(os.Stderr, "sent %v messages with %v bytes of values in %s, %.1f messages/s, %.1f KiB/s\n",
+			cmd.sent, cmd.generatedBytes, elapsed, float64(cmd.sent)/secs, float64(cmd.generatedBytes)/1024/secs)
+	}
+	if cmd.verbose {
+		fmt.Fprintln(os.Stderr, cmd.stats)
 	}
 }
 
-func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partitionCount int32) {
-	defer func() { close(out) }()
+// reportProgress prints a progress summary to stderr every -report-interval
+// until done is closed.
+func (cmd *produceCmd) reportProgress(start time.Time, done chan struct{}) {
+	ticker := time.NewTicker(cmd.interval)
+	defer ticker.Stop()
+
+	var lastSent int64
+	last := start
 	for {
 		select {
-		case l, ok := <-in:
-			if !ok {
-				return
-			}
-			var msg message
-
-			switch {
-			case cmd.literal:
-				msg.Value = &l
-				msg.Partition = &cmd.partition
-			default:
-				if err := json.Unmarshal([]byte(l), &msg); err != nil {
-					if cmd.verbose {
-						fmt.Fprintf(os.Stderr, "Failed to unmarshal input [%v], falling back to defaults. err=%v\n", l, err)
-					}
-					var v *string = &l
-					if len(l) == 0 {
-						v = nil
-					}
-					msg = message{Key: nil, Value: v}
-				}
-			}
-
-			var part int32 = 0
-			if msg.Key != nil && cmd.partitioner == "hashCode" {
-				part = hashCodePartition(*msg.Key, partitionCount)
-			}
-			if msg.Partition == nil {
-				msg.Partition = &part
-			}
-
-			out <- msg
+		case now := <-ticker.C:
+			sent := atomic.LoadInt64(&cmd.sent)
+			fmt.Fprintln(os.Stderr, progress(now.Sub(start), now.Sub(last), sent, sent-lastSent, atomic.LoadInt64(&cmd.skipped)))
+			lastSent, last = sent, now
+		case <-done:
+			return
 		}
 	}
 }
 
-func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
+// progress summarizes sent messages in total since the start of the run and
+// recentSent in the last recent duration, and the invalid input lines skipped.
+func progress(elapsed, recent time.Duration, sent, recentSent, skipped int64) string {
+	return fmt.Sprintf("progress: sent %v messages in %s, %.1f messages/s, %.1f messages/s over the last %s, skipped %v invalid input lines",
+		sent, elapsed, float64(sent)/elapsed.Seconds(), float64(recentSent)/recent.Seconds(), recent, skipped)
+}
+
+// generatedValue is passed to -value-template for each generated message.
+type generatedValue struct {
+	Seq int
+	Key string
+}
+
+// generateMessages sends cmd.generate messages to out, limited to cmd.rate
+// messages per second if set.
+func (cmd *produceCmd) generateMessages(q chan struct{}, out chan message, partitionCount int32) {
 	defer func() { close(out) }()
+	rand.Seed(time.Now().UnixNano())
 
-	messages := []message{}
-	send := func() {
-		out <- messages
-		messages = []message{}
+	var tick <-chan time.Time
+	if cmd.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(cmd.rate))
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	for {
-		select {
-		case m, ok := <-in:
-			if !ok {
-				send()
+	for i := 0; i < cmd.generate; i++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-q:
 				return
 			}
+		}
 
-			messages = append(messages, m)
-			if len(messages) > 0 && len(messages) >= cmd.batch {
-				send()
-			}
-		case <-time.After(cmd.timeout):
-			if len(messages) > 0 {
-				send()
-			}
+		msg, err := cmd.generateMessage(i)
+		if err != nil {
+			failf("failed to generate message %v err=%v", i, err)
+		}
+		cmd.generatedBytes += int64(len(msg.rawValue))
+
+		if err := cmd.assignPartition(&msg, partitionCount); err != nil {
+			failf("failed to route generated message %v err=%v", i, err)
+		}
+
+		select {
+		case out <- msg:
+		case <-q:
+			return
 		}
 	}
 }
 
-type partitionProduceResult struct {
-	start int64
-	count int64
-}
+// assignPartition routes msg to its topic and sets its partition: -partition
+// without a partitioner, the partitioner's choice otherwise.
+func (cmd *produceCmd) assignPartition(msg *message, partitionCount int32) error {
+	count, err := cmd.routeTopic(msg, partitionCount)
+	if err != nil {
+		return err
+	}
 
-func (cmd *produceCmd) makeSaramaMessage(msg message) (*sarama.Message, error) {
-	var (
-		err error
-		sm  = &sarama.Message{Codec: cmd.compression}
-	)
+	if cmd.partitioner == "" {
+		msg.Partition = &cmd.partition
+	} else {
+		part := cmd.keyPartition(msg.Key, count)
+		msg.Partition = &part
+	}
+	return nil
+}
 
-	if msg.Key != nil {
-		switch cmd.decodeKey {
-		case "hex":
-			if sm.Key, err = hex.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Key, err = base64.StdEncoding.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as base64 string, err=%v", err)
-			}
-		default: // string
-			sm.Key = []byte(*msg.Key)
-		}
+// generateMessage returns the seq-th generated message. Its value is the
+// output of cmd.valueTmpl, or cmd.valueSize random bytes. Either is sent as
+// is, regardless of -decodevalue.
+func (cmd *produceCmd) generateMessage(seq int) (message, error) {
+	var key string
+	switch cmd.keyPattern {
+	case "random":
+		key = fmt.Sprintf("%016x", rand.Uint64())
+	case "const":
+		key = "kt-generate"
+	default:
+		key = strconv.Itoa(seq)
 	}
+	msg := message{Key: &key}
 
-	if msg.Value != nil {
-		switch cmd.decodeValue {
-		case "hex":
-			if sm.Value, err = hex.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Value, err = base64.StdEncoding.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as base64 string, err=%v", err)
-			}
-		default: // string
-			sm.Value = []byte(*msg.Value)
-		}
+	if cmd.valueTmpl == nil {
+		msg.rawValue = make([]byte, cmd.valueSize)
+		rand.Read(msg.rawValue)
+		return msg, nil
 	}
 
-	return sm, nil
+	var buf bytes.Buffer
+	if err := cmd.valueTmpl.Execute(&buf, generatedValue{Seq: seq, Key: key}); err != nil {
+		return msg, err
+	}
+	msg.rawValue = buf.Bytes()
+	return msg, nil
 }
 
-func (cmd *produceCmd) produceBatch(leaders map[int32]*sarama.Broker, batch []message, out chan printContext) error {
-	requests := map[*sarama.Broker]*sarama.ProduceRequest{}
-	for _, msg := range batch {
-		broker, ok := leaders[*msg.Partition]
-		if !ok {
-			return fmt.Errorf("non-configured partition %v", *msg.Partition)
-		}
-		req, ok := requests[broker]
-		if !ok {
-			req = &sarama.ProduceRequest{RequiredAcks: sarama.WaitForAll, Timeout: 10000}
-			requests[broker] = req
-		}
+// nullFrameLength is the length prefix of a frame that stands for null.
+const nullFrameLength = -1
 
-		sm, err := cmd.makeSaramaMessage(msg)
-		if err != nil {
-			return err
-		}
-		req.AddMessage(cmd.topic, *msg.Partition, sm)
+func (cmd *produceCmd) readStdinFrames(out chan []byte) {
+	if err := readFrames(os.Stdin, cmd.bufferSize, out); err != nil {
+		fmt.Fprintf(os.Stderr, "reading input frames failed err=%v\n", err)
 	}
+}
 
-	for broker, req := range requests {
-		resp, err := broker.Produce(req)
-		if err != nil {
-			return fmt.Errorf("failed to send request to broker %#v. err=%s", broker, err)
+// readFrames sends the frames in r to out and closes it. Each frame is a
+// 4-byte big-endian signed length followed by that many bytes, a length of -1
+// stands for null and is sent as nil. Frames may be at most max bytes long.
+func readFrames(r io.Reader, max int, out chan []byte) error {
+	defer close(out)
+
+	br := bufio.NewReader(r)
+	for n := 0; ; n++ {
+		var length int32
+		if err := binary.Read(br, binary.BigEndian, &length); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("frame %v: %v", n, err)
 		}
 
-		offsets, err := readPartitionOffsetResults(resp)
-		if err != nil {
-
-			return fmt.Errorf("failed to read producer response err=%s", err)
+		switch {
+		case length == nullFrameLength:
+			out <- nil
+			continue
+		case length < 0:
+			return fmt.Errorf("frame %v: invalid length %v", n, length)
+		case int(length) > max:
+			return fmt.Errorf("frame %v: length %v exceeds the limit of %v bytes, use -buffersize to raise it", n, length, max)
 		}
 
-		for p, o := range offsets {
-			result := map[string]interface{}{"partition": p, "startOffset": o.start, "count": o.count}
-			ctx := printContext{output: result, done: make(chan struct{})}
-			out <- ctx
-			<-ctx.done
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return fmt.Errorf("frame %v: %v", n, err)
 		}
+		out <- frame
 	}
-
-	return nil
 }
 
-func readPartitionOffsetResults(resp *sarama.ProduceResponse) (map[int32]partitionProduceResult, error) {
-	offsets := map[int32]partitionProduceResult{}
-	for _, blocks := range resp.Blocks {
-		for partition, block := range blocks {
-			if block.Err != sarama.ErrNoError {
-				fmt.Fprintf(os.Stderr, "Failed to send message. err=%s\n", block.Err.Error())
-				return offsets, block.Err
-			}
+// deserializeFrames sends a message per frame in, or per pair of frames with
+// -key-frames. Frames are used as is, regardless of -decodevalue.
+func (cmd *produceCmd) deserializeFrames(q chan struct{}, in chan []byte, out chan message, partitionCount int32) {
+	defer func() { close(out) }()
 
-			if r, ok := offsets[partition]; ok {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: r.count + 1}
-			} else {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: 1}
-			}
+	for {
+		msg := message{Key: cmd.frameKey}
+		if cmd.keyFrames {
+			key, ok := <-in
+			if !ok {
+				return
+			}
+			if key != nil {
+				k := string(key)
+				msg.Key = &k
+			}
+		}
+
+		value, ok := <-in
+		if !ok {
+			if cmd.keyFrames {
+				fmt.Fprintf(os.Stderr, "ignoring key frame without value frame at the end of input\n")
+			}
+			return
+		}
+		msg.rawValue = value
+
+		if err := cmd.checkNullKey(msg); err != nil {
+			failf("invalid input frame: %v", err)
+		}
+		if err := cmd.assignPartition(&msg, partitionCount); err != nil {
+			failf("invalid input frame: %v", err)
+		}
+
+		select {
+		case out <- msg:
+		case <-q:
+			return
+		}
+	}
+}
+
+// inputLine is a line of input along with the input it was read from.
+type inputLine struct {
+	text  string
+	input string // -input file, - for stdin
+	line  int    // line number within input, starting at 1
+}
+
+// dir returns the directory that paths in the line are relative to: the
+// directory of its -input file, or the working directory for stdin.
+func (l inputLine) dir() string {
+	if l.input == "" || l.input == "-" {
+		return ""
+	}
+	return filepath.Dir(l.input)
+}
+
+// position describes where the line was read from for error messages.
+func (l inputLine) position() string {
+	if l.input == "" || l.input == "-" {
+		return fmt.Sprintf("line %v", l.line)
+	}
+	return fmt.Sprintf("line %v of %v", l.line, l.input)
+}
+
+// readLines sends the input lines to out and closes it: stdin's lines, or
+// those of the -input files merged according to -merge-inputs.
+func (cmd *produceCmd) readLines(out chan inputLine) {
+	names, counts := cmd.inputs, cmd.inputCounts
+	if len(names) == 0 {
+		names, counts = []string{"-"}, make([]int64, 1)
+	}
+
+	ins := make([]chan string, len(names))
+	for i, name := range names {
+		ins[i] = make(chan string)
+		go cmd.readInputLines(name, ins[i])
+	}
+	mergeLines(ins, names, cmd.mergeFair, counts, out)
+}
+
+func (cmd *produceCmd) readStdin(out chan string) {
+	err := readLines(os.Stdin, cmd.bufferSize, out)
+	switch {
+	case err == bufio.ErrTooLong:
+		fmt.Fprintf(os.Stderr, "input line exceeds the limit of %v bytes, use -buffersize to raise it\n", cmd.bufferSize)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "scanning input failed err=%v\n", err)
+	}
+}
+
+// readInputLines sends the lines of the -input file name, or stdin for -, to
+// out and closes it.
+func (cmd *produceCmd) readInputLines(name string, out chan string) {
+	if name == "-" {
+		cmd.readStdin(out)
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		failf("failed to open input %#v err=%v", name, err)
+	}
+	defer f.Close()
+
+	err = readLines(f, cmd.bufferSize, out)
+	switch {
+	case err == bufio.ErrTooLong:
+		fmt.Fprintf(os.Stderr, "line of input %v exceeds the limit of %v bytes, use -buffersize to raise it\n", name, cmd.bufferSize)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "scanning input %v failed err=%v\n", name, err)
+	}
+}
+
+// mergeLines sends the lines of ins to out and closes it once all ins are
+// closed. With fair it takes one line of each open input in turn, otherwise it
+// reads each input to its end before the next. Either way the lines of each
+// input keep their order. counts are incremented per line read of each input,
+// names are the inputs' names the lines are tagged with.
+func mergeLines(ins []chan string, names []string, fair bool, counts []int64, out chan inputLine) {
+	defer close(out)
+
+	if !fair {
+		for i, in := range ins {
+			for l := range in {
+				n := atomic.AddInt64(&counts[i], 1)
+				out <- inputLine{text: l, input: names[i], line: int(n)}
+			}
+		}
+		return
+	}
+
+	open := make([]int, len(ins))
+	for i := range ins {
+		open[i] = i
+	}
+	for len(open) > 0 {
+		next := open[:0]
+		for _, i := range open {
+			l, ok := <-ins[i]
+			if !ok {
+				continue
+			}
+			n := atomic.AddInt64(&counts[i], 1)
+			out <- inputLine{text: l, input: names[i], line: int(n)}
+			next = append(next, i)
+		}
+		open = next
+	}
+}
+
+// parseInputs parses the comma separated files of -input, rejecting empty
+// entries and reading stdin more than once.
+func parseInputs(s string) ([]string, error) {
+	var (
+		result []string
+		stdin  bool
+	)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("invalid -input %#v, it contains an empty file name", s)
+		case name == "-" && stdin:
+			return nil, fmt.Errorf("invalid -input %#v, stdin can only be read once", s)
+		case name == "-":
+			stdin = true
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// boundedInputs reports whether the -input files s don't include stdin.
+func boundedInputs(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, name := range strings.Split(s, ",") {
+		if strings.TrimSpace(name) == "-" {
+			return false
+		}
+	}
+	return true
+}
+
+// readDir sends each regular file in cmd.inputDir as a message, in order of
+// the file names. The file name, or the first group cmd.dirKey captures from
+// it, is used as the message key.
+func (cmd *produceCmd) readDir(q chan struct{}, out chan message, partitionCount int32) {
+	defer func() { close(out) }()
+
+	files, err := ioutil.ReadDir(cmd.inputDir)
+	if err != nil {
+		failf("failed to read input directory %#v err=%v", cmd.inputDir, err)
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		msg, err := cmd.readFileMessage(f.Name(), partitionCount)
+		if err != nil {
+			failf("%v", err)
+		}
+
+		select {
+		case out <- msg:
+		case <-q:
+			return
+		}
+	}
+}
+
+// manifestEntry references the files holding the key and value of one message
+// of -manifest. A missing keyFile or valueFile means a null key or value.
+type manifestEntry struct {
+	KeyFile   *string         `json:"keyFile"`
+	ValueFile *string         `json:"valueFile"`
+	Partition *int32          `json:"partition"`
+	Headers   json.RawMessage `json:"headers"`
+}
+
+// manifestFailure reports a -manifest entry that couldn't be turned into a
+// message.
+type manifestFailure struct {
+	Entry int    `json:"entry"`
+	Error string `json:"error"`
+}
+
+// readManifest reads the JSON array of entries in the -manifest file at path.
+func readManifest(path string) ([]manifestEntry, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of entries err=%v", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	return entries, nil
+}
+
+// readManifestMessages sends a message per -manifest entry, in order. Entries
+// whose files can't be read are reported on out and skipped.
+func (cmd *produceCmd) readManifestMessages(q chan struct{}, messages chan message, out chan printContext, partitionCount int32) {
+	defer func() { close(messages) }()
+
+	for i, e := range cmd.manifest {
+		msg, err := cmd.manifestMessage(i, e, partitionCount)
+		if err != nil {
+			cmd.manifestFailed++
+			ctx := printContext{output: manifestFailure{Entry: i, Error: err.Error()}, done: make(chan struct{})}
+			out <- ctx
+			<-ctx.done
+			continue
+		}
+
+		select {
+		case messages <- msg:
+		case <-q:
+			return
+		}
+	}
+}
+
+// manifestMessage returns the message for the i-th -manifest entry e. Its
+// files are resolved relative to the manifest and their content is used as
+// is, regardless of -decodekey and -decodevalue.
+func (cmd *produceCmd) manifestMessage(i int, e manifestEntry, partitionCount int32) (message, error) {
+	msg := message{entry: &i}
+
+	if len(e.Headers) > 0 && string(e.Headers) != "null" {
+		return msg, fmt.Errorf("headers require Kafka v0.11.0.0 record batches, which kt doesn't support")
+	}
+
+	if e.KeyFile != nil {
+		buf, err := ioutil.ReadFile(cmd.manifestPath(*e.KeyFile))
+		if err != nil {
+			return msg, fmt.Errorf("failed to read keyFile %#v err=%v", *e.KeyFile, err)
+		}
+		key := string(buf)
+		msg.Key, msg.rawKey = &key, buf
+	}
+	if e.ValueFile != nil {
+		buf, err := ioutil.ReadFile(cmd.manifestPath(*e.ValueFile))
+		if err != nil {
+			return msg, fmt.Errorf("failed to read valueFile %#v err=%v", *e.ValueFile, err)
+		}
+		msg.rawValue = buf
+	}
+
+	if err := cmd.checkNullKey(msg); err != nil {
+		return msg, err
+	}
+	if e.Partition == nil {
+		return msg, cmd.assignPartition(&msg, partitionCount)
+	}
+	_, err := cmd.routeTopic(&msg, partitionCount)
+	msg.Partition = e.Partition
+	return msg, err
+}
+
+// manifestPath resolves path relative to the directory of -manifest.
+func (cmd *produceCmd) manifestPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cmd.manifestDir, path)
+}
+
+func (cmd *produceCmd) readFileMessage(name string, partitionCount int32) (message, error) {
+	var msg message
+
+	key := name
+	if cmd.dirKey != nil {
+		m := cmd.dirKey.FindStringSubmatch(name)
+		switch {
+		case m == nil:
+			return msg, fmt.Errorf("file name %#v does not match -input-dir-key %v", name, cmd.dirKey)
+		case len(m) > 1:
+			key = m[1]
+		default:
+			key = m[0]
+		}
+	}
+
+	buf, err := readInputFile(filepath.Join(cmd.inputDir, name))
+	if err != nil {
+		return msg, fmt.Errorf("failed to read input file %#v err=%v", name, err)
+	}
+	value := string(buf)
+	msg = message{Key: &key, Value: &value}
+
+	if partitionCount, err = cmd.routeTopic(&msg, partitionCount); err != nil {
+		return msg, fmt.Errorf("failed to route file %#v err=%v", name, err)
+	}
+
+	part := cmd.partition
+	if cmd.partitioner != "" {
+		part = cmd.keyPartition(&key, partitionCount)
+	}
+
+	msg.Partition = &part
+
+	return msg, nil
+}
+
+// readInputFile reads the content of the file at path, decompressing it when
+// it's gzipped.
+func readInputFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gunzipIfCompressed(f)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+var validTopicRegExp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+var topicTemplateFuncs = template.FuncMap{
+	"prefix": func(n int, s string) string {
+		if len(s) < n {
+			return s
+		}
+		return s[:n]
+	},
+	"suffix": func(n int, s string) string {
+		if len(s) < n {
+			return s
+		}
+		return s[len(s)-n:]
+	},
+}
+
+// routeTopic sets the topic of msg from -topic-template and returns the
+// number of partitions of the topic msg is sent to. Without a template,
+// partitionCount for -topic is returned as is, unless -refresh-partitions
+// may have changed it since.
+func (cmd *produceCmd) routeTopic(msg *message, partitionCount int32) (int32, error) {
+	if cmd.topicTemplate == nil {
+		if cmd.refreshPart > 0 {
+			return cmd.partitionCount(cmd.topic), nil
+		}
+		return partitionCount, nil
+	}
+
+	var (
+		buf  bytes.Buffer
+		data = struct{ Key, Value string }{}
+	)
+	if msg.Key != nil {
+		data.Key = *msg.Key
+	}
+	if msg.Value != nil {
+		data.Value = *msg.Value
+	}
+
+	if err := cmd.topicTemplate.Execute(&buf, data); err != nil {
+		return 0, fmt.Errorf("failed to execute topic template err=%v", err)
+	}
+
+	topic := buf.String()
+	if !validTopicRegExp.MatchString(topic) {
+		return 0, fmt.Errorf("invalid topic name %#v from topic template", topic)
+	}
+
+	msg.topic = topic
+	return cmd.partitionCount(topic), nil
+}
+
+func (cmd *produceCmd) messageTopic(msg message) string {
+	if msg.topic != "" {
+		return msg.topic
+	}
+	return cmd.topic
+}
+
+func (cmd *produceCmd) close() {
+	brokers := map[*sarama.Broker]struct{}{}
+	for _, leaders := range cmd.leaders {
+		for _, b := range leaders {
+			brokers[b] = struct{}{}
+		}
+	}
+	for _, b := range cmd.conns {
+		brokers[b] = struct{}{}
+	}
+
+	for b := range brokers {
+		var (
+			connected bool
+			err       error
+		)
+
+		if connected, err = b.Connected(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check if broker is connected. err=%s\n", err)
+			continue
+		}
+
+		if !connected {
+			continue
+		}
+
+		if err = b.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close broker %v connection. err=%s\n", b, err)
+		}
+	}
+}
+
+func (cmd *produceCmd) deserializeLines(in chan inputLine, out chan message, partitionCount int32) {
+	defer func() { close(out) }()
+	for {
+		select {
+		case l, ok := <-in:
+			if !ok {
+				return
+			}
+
+			msg, count, err := cmd.parseLine(l, partitionCount)
+			if err == nil {
+				err = cmd.encodeAvro(&msg)
+			}
+			if err == nil && cmd.contOnError {
+				_, err = cmd.makeSaramaMessage(msg)
+			}
+			if err != nil {
+				cmd.invalidInput(l, err)
+				continue
+			}
+
+			if msg.Partition == nil {
+				part := cmd.keyPartition(msg.Key, count)
+				msg.Partition = &part
+			}
+
+			out <- msg
+		}
+	}
+}
+
+// encodeAvro encodes the key and value of msg as Avro according to -key-schema
+// and -value-schema, if given. Null keys and values, and values read from a
+// valueFile, are left as they are.
+func (cmd *produceCmd) encodeAvro(msg *message) error {
+	var err error
+	if cmd.keySchema != nil && msg.Key != nil {
+		if msg.rawKey, err = avroFromJSON(cmd.keySchema, *msg.Key); err != nil {
+			return fmt.Errorf("failed to encode key as Avro: %v", err)
+		}
+	}
+	if cmd.valueSchema != nil && msg.Value != nil && msg.rawValue == nil {
+		if msg.rawValue, err = avroFromJSON(cmd.valueSchema, *msg.Value); err != nil {
+			return fmt.Errorf("failed to encode value as Avro: %v", err)
+		}
+	}
+	return nil
+}
+
+// messageFields are the names of the fields of JSON input lines.
+var messageFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(message{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// checkMessageFields returns an error if line isn't a JSON object, or has
+// fields other than messageFields. Unlike json.Unmarshal, names need to match
+// exactly.
+func checkMessageFields(line string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return fmt.Errorf("input is not a JSON object err=%v", err)
+	}
+	if fields == nil {
+		return fmt.Errorf("input is not a JSON object but null")
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !messageFields[name] {
+			unknown = append(unknown, fmt.Sprintf("%#v", name))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown fields %v", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// invalidInput fails on the invalid input line, or skips it with a note on
+// stderr for -continue-on-error.
+func (cmd *produceCmd) invalidInput(l inputLine, err error) {
+	if !cmd.contOnError {
+		failf("invalid input on %v: %v", l.position(), err)
+	}
+	fmt.Fprintf(os.Stderr, "skipping invalid input on %v: %v\n", l.position(), err)
+	atomic.AddInt64(&cmd.skipped, 1)
+}
+
+// parseLine returns the message for input line l and the partition count of
+// its topic. The message's partition is only set if the input determines it.
+func (cmd *produceCmd) parseLine(in inputLine, partitionCount int32) (message, int32, error) {
+	var msg message
+	l := in.text
+
+	switch {
+	case cmd.literal:
+		msg.Value = &l
+		if cmd.partitioner == "" || cmd.keyPaths == nil {
+			msg.Partition, msg.partitionFlag = &cmd.partition, true
+		}
+	case cmd.keySep != "":
+		msg = splitKeyValue(l, cmd.keySep)
+		if cmd.partitioner == "" {
+			msg.Partition, msg.partitionFlag = &cmd.partition, true
+		}
+	default:
+		if cmd.strictInput {
+			if err := checkMessageFields(l); err != nil {
+				return msg, 0, err
+			}
+		}
+		if err := json.Unmarshal([]byte(l), &msg); err != nil {
+			if cmd.strictInput {
+				return msg, 0, fmt.Errorf("invalid JSON input err=%v", err)
+			}
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "Failed to unmarshal input [%v], falling back to defaults. err=%v\n", l, err)
+			}
+			var v *string = &l
+			if len(l) == 0 {
+				v = nil
+			}
+			msg = message{Key: nil, Value: v}
+		}
+		if err := readValueFile(&msg, in.dir()); err != nil {
+			return msg, 0, err
+		}
+		if _, _, err := cmd.messageCodecs(msg); err != nil {
+			return msg, 0, err
+		}
+		if msg.Acks != nil {
+			if _, err := parseAcks(*msg.Acks); err != nil {
+				return msg, 0, err
+			}
+		}
+	}
+
+	if msg.Key == nil && cmd.keyPaths != nil {
+		msg.Key = jsonKey(msg.Value, cmd.keyPaths, cmd.keyPathSep)
+	}
+
+	if err := cmd.checkNullKey(msg); err != nil {
+		return msg, 0, err
+	}
+
+	count, err := cmd.routeTopic(&msg, partitionCount)
+	return msg, count, err
+}
+
+type partitionExplanation struct {
+	Topic       string  `json:"topic,omitempty"`
+	Key         *string `json:"key"`
+	Partition   int32   `json:"partition"`
+	Partitioner string  `json:"partitioner"`
+	HashCode    *int32  `json:"hashCode,omitempty"`
+}
+
+// explainLines prints which partition each input line would be sent to and
+// why, without sending anything.
+func (cmd *produceCmd) explainLines(in chan inputLine, out chan printContext, partitionCount int32) {
+	for l := range in {
+		msg, count, err := cmd.parseLine(l, partitionCount)
+		if err != nil {
+			cmd.invalidInput(l, err)
+			continue
+		}
+		ctx := printContext{output: cmd.explain(msg, count), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+}
+
+// explain returns the partition msg is sent to and what picked it: the input,
+// -partition, the hashCode partitioner, round-robin for null keys with
+// hashCode, sticky for null keys with sticky, or the default partition 0.
+func (cmd *produceCmd) explain(msg message, partitionCount int32) partitionExplanation {
+	result := partitionExplanation{Key: msg.Key}
+	if cmd.topicTemplate != nil {
+		result.Topic = cmd.messageTopic(msg)
+	}
+	if msg.Key != nil {
+		hc := hashCode(*msg.Key)
+		result.HashCode = &hc
+	}
+
+	switch {
+	case msg.partitionFlag:
+		result.Partitioner = "-partition"
+	case msg.Partition != nil:
+		result.Partitioner = "input"
+	case cmd.partitioner != "" && msg.Key != nil:
+		result.Partitioner = "hashCode"
+	case cmd.partitioner == "hashCode":
+		result.Partitioner = "round-robin"
+	case cmd.partitioner == "sticky":
+		result.Partitioner = "sticky"
+	default:
+		result.Partitioner = "default"
+	}
+
+	if msg.Partition != nil {
+		result.Partition = *msg.Partition
+	} else {
+		result.Partition = cmd.keyPartition(msg.Key, partitionCount)
+	}
+	return result
+}
+
+// verifyValue is the value of the test messages sent by -verify-partitioning.
+const verifyValue = "kt verify-partitioning"
+
+type partitionVerification struct {
+	Key       string `json:"key"`
+	Predicted int32  `json:"predicted"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Match     bool   `json:"match"`
+	Error     string `json:"error,omitempty"`
+}
+
+// referencePartitioners are the partitioners of other clients that
+// -verify-partitioning can send its test messages with.
+var referencePartitioners = map[string]sarama.PartitionerConstructor{
+	"murmur2": newMurmur2Partitioner,
+	"fnv1a":   sarama.NewHashPartitioner,
+}
+
+// murmur2Partitioner picks partitions like the Java producer's default
+// partitioner for messages with a key.
+type murmur2Partitioner struct{}
+
+func newMurmur2Partitioner(topic string) sarama.Partitioner { return murmur2Partitioner{} }
+
+func (murmur2Partitioner) Partition(msg *sarama.ProducerMessage, partitions int32) (int32, error) {
+	if msg.Key == nil {
+		return 0, fmt.Errorf("murmur2 partitioner requires a key")
+	}
+	key, err := msg.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	return murmur2Partition(key, partitions), nil
+}
+
+func (murmur2Partitioner) RequiresConsistency() bool { return true }
+
+// verifyPartitioning sends a test message per key line of in via a producer
+// that picks partitions with -reference-partitioner, like other clients do,
+// reads each back from where it landed, and prints whether that's the
+// partition kt's partitioner predicted. It fails once all keys are checked if
+// any landed elsewhere.
+func (cmd *produceCmd) verifyPartitioning(in chan inputLine, out chan printContext, partitionCount int32) {
+	cfg := cmd.saramaConfig()
+	cfg.Producer.RequiredAcks = cmd.acks
+	cfg.Producer.Compression = cmd.compression
+	cfg.Producer.Partitioner = cmd.reference
+	cfg.Producer.Return.Successes = true
+
+	client, err := sarama.NewClient(cmd.brokers, cfg)
+	if err != nil {
+		failf("failed to create client err=%v", err)
+	}
+	defer logClose("client", client)
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		failf("failed to create producer err=%v", err)
+	}
+	defer logClose("producer", producer)
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		failf("failed to create consumer err=%v", err)
+	}
+	defer logClose("consumer", consumer)
+
+	send := func(key string) (int32, int64, error) {
+		return producer.SendMessage(&sarama.ProducerMessage{Topic: cmd.topic, Key: sarama.StringEncoder(key), Value: sarama.StringEncoder(verifyValue)})
+	}
+	read := func(partition int32, offset int64) *sarama.ConsumerMessage {
+		return cmd.readBack(consumer, partition, offset)
+	}
+
+	var total, mismatched int
+	for l := range in {
+		result := cmd.verifyKey(l.text, partitionCount, send, read)
+		total++
+		if !result.Match {
+			mismatched++
+		}
+		ctx := printContext{output: result, done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+
+	fmt.Fprintf(os.Stderr, "verified partitioning of %v keys, %v mismatched\n", total, mismatched)
+	if mismatched > 0 {
+		failf("partitioning mismatched for %v of %v keys", mismatched, total)
+	}
+}
+
+// verifyKey sends a test message for key via send, which leaves picking the
+// partition to the reference partitioner, reads it back via read, and compares
+// where it landed with kt's prediction.
+func (cmd *produceCmd) verifyKey(key string, partitionCount int32, send func(string) (int32, int64, error), read func(int32, int64) *sarama.ConsumerMessage) partitionVerification {
+	result := partitionVerification{Key: key, Predicted: cmd.keyPartition(&key, partitionCount), Partition: -1, Offset: -1}
+
+	var err error
+	if result.Partition, result.Offset, err = send(key); err != nil {
+		result.Partition, result.Offset = -1, -1
+		result.Error = fmt.Sprintf("failed to send test message err=%v", err)
+		return result
+	}
+	result.Match, result.Error = verifyLanded(result, read(result.Partition, result.Offset))
+	return result
+}
+
+// readBack returns the message at offset of partition, or nil when it can't
+// be read within offsetTimeout.
+func (cmd *produceCmd) readBack(consumer sarama.Consumer, partition int32, offset int64) *sarama.ConsumerMessage {
+	pc, err := consumer.ConsumePartition(cmd.topic, partition, offset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to consume partition=%v offset=%v err=%v\n", partition, offset, err)
+		return nil
+	}
+	defer logClose("partition consumer", pc)
+
+	select {
+	case msg := <-pc.Messages():
+		return msg
+	case <-time.After(offsetTimeout):
+		fmt.Fprintf(os.Stderr, "timed out after %s reading back partition=%v offset=%v\n", offsetTimeout, partition, offset)
+		return nil
+	}
+}
+
+// verifyLanded reports whether msg, read back from where v's test message
+// landed, shows that it's in the predicted partition, and why not.
+func verifyLanded(v partitionVerification, msg *sarama.ConsumerMessage) (bool, string) {
+	switch {
+	case msg == nil:
+		return false, "failed to read back the test message"
+	case msg.Partition != v.Partition || msg.Offset != v.Offset:
+		return false, fmt.Sprintf("read back partition %v offset %v instead", msg.Partition, msg.Offset)
+	case string(msg.Key) != v.Key:
+		return false, fmt.Sprintf("read back key %#v instead", string(msg.Key))
+	case string(msg.Value) != verifyValue:
+		return false, "read back a value other than the test message's"
+	case v.Partition != v.Predicted:
+		return false, fmt.Sprintf("landed in partition %v instead of %v", v.Partition, v.Predicted)
+	}
+	return true, ""
+}
+
+// splitKeyValue returns a message with the key before the first occurrence of
+// sep in line and the value after it. Lines without sep become the value of a
+// message with a null key.
+func splitKeyValue(line, sep string) message {
+	i := strings.Index(line, sep)
+	if i < 0 {
+		return message{Value: &line}
+	}
+
+	key, value := line[:i], line[i+len(sep):]
+	return message{Key: &key, Value: &value}
+}
+
+// parseKeyPaths parses a comma separated list of paths like $.user.id into
+// their field names. The leading $ is optional, numeric fields index arrays.
+func parseKeyPaths(str string) ([][]string, error) {
+	var paths [][]string
+	for _, p := range strings.Split(str, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "$")
+		p = strings.TrimPrefix(p, ".")
+		if p == "" {
+			return nil, fmt.Errorf("empty path in [%v]", str)
+		}
+		fields := strings.Split(p, ".")
+		for _, f := range fields {
+			if f == "" {
+				return nil, fmt.Errorf("empty field in path [%v]", p)
+			}
+		}
+		paths = append(paths, fields)
+	}
+	return paths, nil
+}
+
+// jsonKey returns the fields at paths in the JSON document value joined by
+// sep, or nil if value isn't JSON or any of the fields is missing or null.
+// String fields are used as is, others as their JSON encoding.
+func jsonKey(value *string, paths [][]string, sep string) *string {
+	if value == nil {
+		return nil
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(*value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+
+	parts := make([]string, 0, len(paths))
+	for _, path := range paths {
+		field := doc
+		for _, name := range path {
+			switch v := field.(type) {
+			case map[string]interface{}:
+				field = v[name]
+			case []interface{}:
+				i, err := strconv.Atoi(name)
+				if err != nil || i < 0 || i >= len(v) {
+					return nil
+				}
+				field = v[i]
+			default:
+				return nil
+			}
+		}
+
+		switch v := field.(type) {
+		case nil:
+			return nil
+		case string:
+			parts = append(parts, v)
+		default:
+			buf, err := json.Marshal(v)
+			if err != nil {
+				return nil
+			}
+			parts = append(parts, string(buf))
+		}
+	}
+
+	key := strings.Join(parts, sep)
+	return &key
+}
+
+// checkNullKey returns an error if msg has no key and -null-key is error.
+func (cmd *produceCmd) checkNullKey(msg message) error {
+	if msg.Key == nil && cmd.nullKey == "error" {
+		return fmt.Errorf("missing key with -null-key error")
+	}
+	return nil
+}
+
+// keyPartition returns the partition for a message with the given key that
+// doesn't specify one. The hashCode partitioner can't hash a null key, so those
+// messages are spread round-robin across the partitions instead. The sticky
+// partitioner hashes keys the same way, but sends -sticky-size keyless messages
+// in a row to the same partition before moving on to the next. Without a
+// partitioner, messages are sent to partition 0.
+func (cmd *produceCmd) keyPartition(key *string, partitionCount int32) int32 {
+	if cmd.partitioner == "" {
+		return 0
+	}
+
+	if key != nil {
+		return hashCodePartition(*key, partitionCount)
+	}
+
+	if cmd.partitioner == "sticky" {
+		if cmd.stickyCount == 0 {
+			cmd.sticky = cmd.roundRobin % partitionCount
+			cmd.roundRobin++
+		}
+		cmd.stickyCount++
+		if cmd.stickyCount >= cmd.stickySize {
+			cmd.stickyCount = 0
+		}
+		return cmd.sticky
+	}
+
+	part := cmd.roundRobin % partitionCount
+	cmd.roundRobin++
+	return part
+}
+
+// readValueFile reads the file referenced by msg.ValueFile into msg.rawValue.
+// Relative paths are resolved against dir.
+func readValueFile(msg *message, dir string) error {
+	if msg.ValueFile == nil {
+		return nil
+	}
+
+	if msg.Value != nil {
+		return fmt.Errorf("only one of value and valueFile may be given")
+	}
+
+	path := *msg.ValueFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read valueFile %#v err=%v", *msg.ValueFile, err)
+	}
+	msg.rawValue = buf
+
+	return nil
+}
+
+// dedupMessages reads all messages from in and then sends only the last
+// message per topic and key to out, in the order of those last messages. A
+// later null value supersedes earlier values, so the key is deleted rather
+// than set to a stale value. Messages without a key are all sent.
+func (cmd *produceCmd) dedupMessages(in chan message, out chan message) {
+	defer close(out)
+
+	var (
+		all  []message
+		last = map[string]int{}
+	)
+	for m := range in {
+		if m.Key != nil {
+			last[cmd.messageTopic(m)+"\x00"+*m.Key] = len(all)
+		}
+		all = append(all, m)
+	}
+
+	var dropped int
+	for i, m := range all {
+		if m.Key != nil && last[cmd.messageTopic(m)+"\x00"+*m.Key] != i {
+			dropped++
+			continue
+		}
+		out <- m
+	}
+
+	fmt.Fprintf(os.Stderr, "dropped %v messages with duplicate keys\n", dropped)
+}
+
+func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
+	defer func() { close(out) }()
+
+	var (
+		messages = []message{}
+		linger   *time.Timer
+		lingerC  <-chan time.Time
+	)
+	send := func() {
+		if linger != nil {
+			linger.Stop()
+			linger, lingerC = nil, nil
+		}
+		out <- messages
+		messages = []message{}
+	}
+
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				send()
+				return
+			}
+
+			if len(messages) == 0 && cmd.linger > 0 {
+				linger = time.NewTimer(cmd.linger)
+				lingerC = linger.C
+			}
+			messages = append(messages, m)
+			if len(messages) > 0 && len(messages) >= cmd.batch {
+				send()
+			}
+		case <-lingerC:
+			linger, lingerC = nil, nil
+			send()
+		case <-time.After(cmd.timeout):
+			if len(messages) > 0 {
+				send()
+			}
+		}
+	}
+}
+
+type partitionProduceResult struct {
+	start int64
+}
+
+// messageCodecs returns the encodings of the key and value of msg: its
+// keyCodec and valueCodec if given, otherwise -decodekey and -decodevalue.
+func (cmd *produceCmd) messageCodecs(msg message) (string, string, error) {
+	var keyCodec, valueCodec string
+	if msg.KeyCodec != nil {
+		keyCodec = *msg.KeyCodec
+	}
+	if msg.ValueCodec != nil {
+		valueCodec = *msg.ValueCodec
+	}
+
+	key, err := getTransformValue("keyCodec", "", keyCodec, cmd.decodeKey)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := getTransformValue("valueCodec", "", valueCodec, cmd.decodeValue)
+	if err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+func (cmd *produceCmd) makeSaramaMessage(msg message) (*sarama.Message, error) {
+	var (
+		err error
+		sm  = &sarama.Message{Codec: cmd.compression}
+	)
+
+	keyCodec, valueCodec, err := cmd.messageCodecs(msg)
+	if err != nil {
+		return sm, err
+	}
+
+	if msg.rawKey != nil {
+		sm.Key = msg.rawKey
+	} else if msg.Key != nil {
+		if sm.Key, err = decodeBytes(*msg.Key, keyCodec); err != nil {
+			return sm, fmt.Errorf("failed to decode key as %v string, err=%v", keyCodec, err)
+		}
+	}
+
+	if msg.rawValue != nil {
+		sm.Value = msg.rawValue
+	} else if msg.Value != nil {
+		if sm.Value, err = decodeBytes(*msg.Value, valueCodec); err != nil {
+			return sm, fmt.Errorf("failed to decode value as %v string, err=%v", valueCodec, err)
+		}
+	}
+
+	return sm, nil
+}
+
+func decodeBytes(str string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(str)
+	case "base64":
+		return base64.StdEncoding.DecodeString(str)
+	case "base64url":
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	case "cbor":
+		return cborFromJSON(str)
+	default: // string
+		return []byte(str), nil
+	}
+}
+
+// parseAcks parses the acks level of -acks or an input line's acks field.
+func parseAcks(str string) (sarama.RequiredAcks, error) {
+	switch str {
+	case "all":
+		return sarama.WaitForAll, nil
+	case "leader":
+		return sarama.WaitForLocal, nil
+	case "none":
+		return sarama.NoResponse, nil
+	default:
+		return 0, fmt.Errorf(`unsupported acks %#v, only all, leader and none are supported`, str)
+	}
+}
+
+func acksName(acks sarama.RequiredAcks) string {
+	switch acks {
+	case sarama.WaitForLocal:
+		return "leader"
+	case sarama.NoResponse:
+		return "none"
+	default:
+		return "all"
+	}
+}
+
+// messageAcks returns the acks level of msg's acks field if given, -acks
+// otherwise. Input lines are validated when parsed, so invalid levels fall
+// back to -acks.
+func (cmd *produceCmd) messageAcks(msg message) sarama.RequiredAcks {
+	if msg.Acks != nil {
+		if acks, err := parseAcks(*msg.Acks); err == nil {
+			return acks
+		}
+	}
+	return cmd.acks
+}
+
+// produceBatch sends batch in runs of consecutive messages with the same acks
+// level, one run after another, so mixing levels keeps the input order.
+func (cmd *produceCmd) produceBatch(batch []message, out chan printContext) error {
+	if len(batch) > 0 {
+		cmd.stats.add(len(batch))
+	}
+
+	for len(batch) > 0 {
+		acks := cmd.messageAcks(batch[0])
+		n := 1
+		for n < len(batch) && cmd.messageAcks(batch[n]) == acks {
+			n++
+		}
+		if err := cmd.sendMessages(batch[:n], acks, out); err != nil {
+			return err
+		}
+		batch = batch[n:]
+	}
+
+	return nil
+}
+
+func (cmd *produceCmd) sendMessages(batch []message, acks sarama.RequiredAcks, out chan printContext) error {
+	requests := map[*sarama.Broker]*sarama.ProduceRequest{}
+	sent := map[string]map[int32][]message{}
+	for _, msg := range batch {
+		topic := cmd.messageTopic(msg)
+		broker, ok := cmd.topicLeaders(topic)[*msg.Partition]
+		if !ok {
+			return fmt.Errorf("non-configured partition %v for topic %v", *msg.Partition, topic)
+		}
+		req, ok := requests[broker]
+		if !ok {
+			req = &sarama.ProduceRequest{RequiredAcks: acks, Timeout: 10000}
+			requests[broker] = req
+		}
+
+		sm, err := cmd.makeSaramaMessage(msg)
+		if err != nil {
+			return err
+		}
+		req.AddMessage(topic, *msg.Partition, sm)
+		if sent[topic] == nil {
+			sent[topic] = map[int32][]message{}
+		}
+		sent[topic][*msg.Partition] = append(sent[topic][*msg.Partition], msg)
+	}
+
+	responses := cmd.sendRequests(requests)
+	for broker, res := range responses {
+		if res.err != nil {
+			return fmt.Errorf("failed to send request to broker %#v. err=%s", broker, res.err)
+		}
+	}
+
+	// brokers don't respond to acks none, so there are no offsets to report.
+	if acks == sarama.NoResponse {
+		for topic, partitions := range sent {
+			for p, msgs := range partitions {
+				cmd.printSent(out, topic, p, -1, msgs, acks)
+			}
+		}
+		return nil
+	}
+
+	for _, res := range responses {
+		offsets, err := readPartitionOffsetResults(res.resp)
+		if err != nil {
+
+			return fmt.Errorf("failed to read producer response err=%s", err)
+		}
+
+		for topic, partitions := range offsets {
+			for p, o := range partitions {
+				cmd.printSent(out, topic, p, o.start, sent[topic][p], acks)
+			}
+		}
+	}
+
+	return nil
+}
+
+// printSent prints the result of sending msgs to partition starting at offset
+// start, or -1 when the offset is unknown with acks none.
+func (cmd *produceCmd) printSent(out chan printContext, topic string, p int32, start int64, msgs []message, acks sarama.RequiredAcks) {
+	atomic.AddInt64(&cmd.sent, int64(len(msgs)))
+	if cmd.report {
+		cmd.printReport(out, topic, p, start, msgs, acks)
+		return
+	}
+
+	result := map[string]interface{}{"partition": p, "startOffset": start, "count": len(msgs)}
+	if cmd.topicTemplate != nil {
+		result["topic"] = topic
+	}
+	if acks != sarama.WaitForAll {
+		result["acks"] = acksName(acks)
+	}
+	ctx := printContext{output: result, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+type produceResult struct {
+	resp *sarama.ProduceResponse
+	err  error
+}
+
+// sendRequests sends each request to its broker and waits for the responses.
+// Requests are sent one after another, or concurrently with
+// -order-by-partition. Either way each partition is part of a single request,
+// and the next batch is only sent once all responses are in, so messages are
+// written to each partition in order.
+func (cmd *produceCmd) sendRequests(requests map[*sarama.Broker]*sarama.ProduceRequest) map[*sarama.Broker]produceResult {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[*sarama.Broker]produceResult, len(requests))
+	)
+
+	for broker, req := range requests {
+		if !cmd.orderByPartition {
+			resp, err := broker.Produce(req)
+			results[broker] = produceResult{resp, err}
+			if err != nil {
+				break
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(broker *sarama.Broker, req *sarama.ProduceRequest) {
+			defer wg.Done()
+			resp, err := broker.Produce(req)
+			mu.Lock()
+			results[broker] = produceResult{resp, err}
+			mu.Unlock()
+		}(broker, req)
+	}
+	wg.Wait()
+
+	return results
+}
+
+type producedMessage struct {
+	Topic     string  `json:"topic,omitempty"`
+	Partition int32   `json:"partition"`
+	Offset    int64   `json:"offset"`
+	Key       *string `json:"key"`
+	Acks      string  `json:"acks"`
+	Entry     *int    `json:"entry,omitempty"`
+}
+
+// printReport prints one line per message of msgs, which were written to
+// partition in order starting at offset start, or at unknown offsets reported
+// as -1 when start is -1. The topic is only included when messages are routed
+// via -topic-template.
+func (cmd *produceCmd) printReport(out chan printContext, topic string, partition int32, start int64, msgs []message, acks sarama.RequiredAcks) {
+	if cmd.topicTemplate == nil {
+		topic = ""
+	}
+
+	for i, m := range msgs {
+		offset := start
+		if start >= 0 {
+			offset += int64(i)
+		}
+		result := producedMessage{Topic: topic, Partition: partition, Offset: offset, Key: m.Key, Acks: acksName(acks), Entry: m.entry}
+		ctx := printContext{output: result, done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+}
+
+func readPartitionOffsetResults(resp *sarama.ProduceResponse) (map[string]map[int32]partitionProduceResult, error) {
+	offsets := map[string]map[int32]partitionProduceResult{}
+	for topic, blocks := range resp.Blocks {
+		offsets[topic] = map[int32]partitionProduceResult{}
+		for partition, block := range blocks {
+			if block.Err != sarama.ErrNoError {
+				fmt.Fprintf(os.Stderr, "Failed to send message. err=%s\n", block.Err.Error())
+				return offsets, block.Err
+			}
+
+			offsets[topic][partition] = partitionProduceResult{start: block.Offset}
 		}
 	}
 	return offsets, nil
@@ -464,7 +2343,7 @@ func (cmd *produceCmd) produce(in chan []message, out chan printContext) {
 			if !ok {
 				return
 			}
-			if err := cmd.produceBatch(cmd.leaders, b, out); err != nil {
+			if err := cmd.produceBatch(b, out); err != nil {
 				fmt.Fprintln(os.Stderr, err.Error()) // TODO: failf
 				return
 			}
@@ -472,7 +2351,7 @@ func (cmd *produceCmd) produce(in chan []message, out chan printContext) {
 	}
 }
 
-func (cmd *produceCmd) readInput(q chan struct{}, stdin chan string, out chan string) {
+func (cmd *produceCmd) readInput(q chan struct{}, stdin chan inputLine, out chan inputLine) {
 	defer func() { close(out) }()
 	for {
 		select {
@@ -501,6 +2380,297 @@ like the following:
 In case the input line cannot be interpeted as a JSON object the key and value
 both default to the input line and partition to 0.
 
+The fields of a JSON input line are all optional:
+
+    key         string, the message key, null or missing for a null key.
+    value       string, the message value, null or missing for a null value.
+    valueFile   string, path to a file whose content is the value, instead of value.
+    partition   number, the partition to produce to, instead of -partition or -partitioner.
+    keyCodec    string, how key is encoded, overriding -decodekey.
+    valueCodec  string, how value is encoded, overriding -decodevalue.
+    acks        string, all, leader or none, the acks to wait for, overriding -acks.
+
+Other fields are ignored, so a misspelled field, e.g. "vlaue", silently leaves
+the value null. Use -strict-input to reject lines with unknown fields, or that
+aren't JSON objects of these fields at all, reporting the line number and the
+offending fields.
+
+To check which partition messages would be sent to, without sending them, use
+-explain. It prints the partition for each input message, what picked it and,
+for messages with a key, the key's hashCode as used by -partitioner hashCode:
+
+    $ echo '{"key": "id-23", "value": "ola"}' | kt produce -topic greetings -partitioner hashCode -explain
+    {"key": "id-23", "partition": 3, "partitioner": "hashCode", "hashCode": 99993651}
+
+The partitioner is one of input and -partition when the partition was given,
+hashCode, round-robin or sticky for null keys with hashCode or sticky, or
+default for partition 0.
+Compare runs with and without -partitioner to see how keys move.
+
+To confirm against a real topic that -partitioner places keys where other
+clients do before a real load, use -verify-partitioning. Each input line is
+taken as a key as is, and a test message with that key and the value
+"kt verify-partitioning" is sent without a partition via a producer that
+leaves picking it to -reference-partitioner: murmur2, the Java producer's
+default, or fnv1a, sarama's default. kt then reads the message back where it
+landed and prints, per key, the partition -partitioner predicts next to it:
+
+    $ printf 'id-23\nid-42\n' | kt produce -topic greetings -partitioner hashCode -verify-partitioning
+    {"key": "id-23", "predicted": 3, "partition": 6, "offset": 17, "match": false, "error": "landed in partition 6 instead of 3"}
+    {"key": "id-42", "predicted": 0, "partition": 6, "offset": 18, "match": false, "error": "landed in partition 6 instead of 0"}
+
+Keys that didn't land as predicted include the reason as "error", and kt exits
+with an error once all keys are checked. kt's hashCode partitioner mimics the
+JVM producer up to Kafka 0.8.2, so expect mismatches against the newer
+clients' murmur2. Note that the test messages are really produced and stay in
+the topic, kt doesn't clean them up, so use a scratch topic with the same
+number of partitions or make sure consumers tolerate them.
+
+To produce input in the format of kafka-console-producer with parse.key=true,
+pass the key separator via -key-separator. Each line is split at the first
+occurrence of the separator into key and value, so the value may contain the
+separator as well:
+
+    $ echo 'id-23:{"a":1,"b":"x:y"}' | kt produce -topic greetings -key-separator :
+
+Lines without the separator are sent as value with a null key. The partition
+is taken from -partition, or picked by -partitioner.
+
+Input without a key is sent with a null key. With the hashCode partitioner,
+which needs a key to pick a partition, such messages are spread round-robin
+across the topic's partitions instead. The sticky partitioner hashes keys the
+same way, but sends keyless messages to one partition until -sticky-size of
+them were sent there, then moves on to the next partition. This fills batches
+rather than spreading each batch across all partitions, which usually gives
+better throughput for keyless input. -sticky-size is independent of -batch, so
+keyless messages stick to a partition across batches even for the default
+-batch 1. Pass -null-key error to fail on input
+without a key rather than sending a null key; -literal input never has a key
+and cannot be combined with it, unless -json-key-path is given.
+
+For messages without a key, -json-key-path derives the key from fields of the
+message's JSON value. Multiple comma separated paths form a composite key,
+joined by -json-key-separator, that's partitioned like any other key:
+
+    $ echo '{"user": {"id": 7}, "order": {"id": "a-1"}}' | kt produce -topic orders -literal -partitioner hashCode -json-key-path '$.user.id,$.order.id'
+
+This sends the key 7|a-1. If a field is missing or null, or the value isn't
+JSON, the message has a null key and is handled according to -null-key.
+
+To produce binary values that may contain newlines, use -input-format frames.
+Stdin is then read as a sequence of frames, each frame being
+
+    length  4 bytes, a big-endian signed 32-bit integer
+    data    length bytes
+
+and each frame becomes the value of a message, sent as is regardless of
+-decodevalue. A length of 0 is an empty value, a length of -1 (0xffffffff)
+a null value without data following it, other negative lengths are invalid.
+Frames may be at most -buffersize bytes long, input that ends within a frame
+is an error. With -key-frames, frames are read in pairs of the key followed by
+the value, otherwise all messages have the key given via -frame-key, or a null
+key. For example, to send the value "hans" with key "id-23":
+
+    $ printf '\0\0\0\5id-23\0\0\0\4hans' | kt produce -topic greetings -input-format frames -key-frames
+
+Input that can't be turned into a message, e.g. a value that isn't valid for
+-decodevalue or a missing -null-key error key, stops kt with the offending line
+number. For bulk imports of imperfect data, -continue-on-error notes such lines
+and the reason on stderr and skips them instead, printing the number of
+skipped lines when it's done.
+
+Instead of passing the value inline, a message can reference a file whose raw
+content becomes the value, e.g. to avoid encoding large binary payloads:
+
+    {"key": "id-23", "valueFile": "payloads/id-23.bin"}
+
+Relative paths are resolved against the directory of the -input file the line
+was read from, or the working directory for stdin. The file's content is used
+as is, regardless of -decodevalue.
+
+Keys and values are taken as plain strings by default. Use -encode to decode
+both from hex, base64 or base64url (the URL-safe alphabet, padding optional),
+and -decodekey or -decodevalue to set either one independently, they override
+-encode. The environment variables KT_DECODE_KEY and KT_DECODE_VALUE are used
+when neither flag is given.
+
+With cbor, the key or value is a JSON document that's encoded as CBOR, e.g.
+with -decodevalue cbor:
+
+    {"key": "sensor-7", "value": "{\"temp\": 21.5}"}
+
+Integers are encoded as CBOR integers, other numbers as 64-bit floats, and map
+keys are sorted so equal documents produce equal bytes.
+
+For registry-less Avro topics, -key-schema and -value-schema encode keys and
+values, which are JSON documents, as plain Avro binary data without Confluent
+framing. The schema is given inline or as the path of an .avsc file:
+
+    $ echo '{"id": 23, "name": "hans", "email": null}' | kt produce -topic users -literal -value-schema user.avsc
+
+Input that doesn't match the schema, e.g. a missing field without a default or
+a string for an int, stops kt with the line number and the offending field,
+or is skipped with -continue-on-error. Union values are encoded as the first
+branch that fits, or as the branch named in Avro's JSON encoding, e.g.
+{"email": {"string": "hans@example.com"}}. Bytes and fixed values are strings
+whose code points are the byte values, as in Avro's JSON encoding. kt doesn't
+talk to schema registries, so values are never framed with a schema id.
+
+JSON input can override these per message via keyCodec and valueCodec, e.g. to
+mix binary and plain string values in one run:
+
+    {"key": "id-23", "value": "AAEC", "valueCodec": "base64"}
+
+To produce captured payloads stored as individual files, pass a directory via
+-input-dir instead. Each regular file in the directory becomes one message,
+sent in order of the file names. The file's content is the value and the file
+name is the key, or the first group captured from the file name by the regex
+given via -input-dir-key. Key and value are decoded according to -decodekey and
+-decodevalue.
+
+To reconstruct exact binary records captured as pairs of key and value files,
+list them in a manifest, a JSON array of entries, and pass it via -manifest:
+
+    [
+      {"keyFile": "0001.key", "valueFile": "0001.value"},
+      {"keyFile": "0002.key", "valueFile": "0002.value", "partition": 3},
+      {"keyFile": "0003.key"}
+    ]
+
+Each entry becomes one message, sent in the order listed. Paths are resolved
+relative to the manifest, and the files' content is used as is, regardless of
+-decodekey and -decodevalue. A missing keyFile or valueFile means a null key or
+value, and partition overrides -partition and -partitioner. kt reports each
+entry as with -report, including its index as "entry". Entries whose files
+can't be read are reported with their error instead and skipped, and kt exits
+with an error once the others are sent. Headers require Kafka v0.11.0.0 record
+batches which kt doesn't support, so entries with headers are reported as
+failures.
+
+To read input lines from files rather than stdin, e.g. per-partition capture
+files, pass them comma separated via -input, with - for stdin. By default
+-merge-inputs sequential reads each file to its end before the next, so all
+lines of the first file are sent before those of the second. -merge-inputs fair
+instead takes one line of each file in turn, skipping files that have ended,
+which interleaves the files to approximate one timeline:
+
+    kt produce -topic events -input p0.json,p1.json,p2.json -merge-inputs fair
+
+Either way the lines of each file keep their relative order, but kt doesn't
+order lines across files beyond taking them in turn. Once sent, Kafka only
+guarantees the order per partition. Line numbers in errors count the lines of
+the merged input. The number of lines read from each file is printed to stderr
+at the end.
+
+Gzip compressed input, on stdin or in files of -input-dir or -input, is
+decompressed transparently when it starts with the gzip magic bytes, so
+compressed captures can be replayed directly. The -buffersize limit applies to
+the decompressed lines.
+
+To route messages to different topics, e.g. topics sharded by tenant, pass a Go
+template via -topic-template instead of -topic. It's executed for each message
+with the fields .Key and .Value, which are empty for null keys and values, and
+the functions prefix and suffix which take the first or last n characters:
+
+    -topic-template 'events-{{.Key | prefix 3}}'
+
+Resolved topic names must be valid Kafka topic names. The partitions of each
+topic are looked up once on first use. When the template is used, results
+include the topic each message was sent to.
+
+To replay input that may contain several messages per key, -dedup-keys reads
+all input first and then sends only the last message per key, in input order
+of those messages. A later message with a null value supersedes earlier ones,
+so the key ends up deleted on compacted topics. Messages without a key are all
+sent. As nothing is sent before the input ends, this requires bounded input,
+e.g. a file piped to stdin or -input-dir, and holds all of it in memory. The
+number of dropped duplicates is printed to stderr.
+
+Messages are sent in batches of up to -batch messages. A batch that isn't full
+yet is sent when no further message arrives within -timeout, so a steady
+stream of input can keep a batch open until it's full. To bound the latency of
+a message, -linger sends a batch at the latest that long after its first
+message was added. For bulk loads, a larger -batch with -linger 100ms usually
+gives fuller batches than relying on -timeout alone. Use -queue-size to keep
+reading and batching input while a batch is being sent, and -verbose to print
+the achieved batch sizes when kt is done.
+
+To use kt as a simple load generator, -generate N produces N messages instead
+of reading input. Keys follow -key-pattern: the sequence number of the message
+(seq), 16 random hex digits (random) or the same key for all messages (const).
+Values are -value-size random bytes, or the output of -value-template, which
+can refer to the message's .Seq and .Key. Limit the load with -rate, shape it
+with -batch, -linger and -compression:
+
+    $ kt produce -topic load -generate 100000 -value-size 512 -key-pattern random -partitioner hashCode -rate 5000
+
+The throughput achieved is printed to stderr when all messages are sent.
+
+For long running imports, -report-interval prints a progress summary to stderr
+at the given interval: the messages sent so far, the rate overall and since the
+previous summary, and the invalid input lines skipped with -continue-on-error:
+
+    $ kt produce -topic import -report-interval 1m <events.json
+    progress: sent 241523 messages in 1m0s, 4025.4 messages/s, 4025.4 messages/s over the last 1m0s, skipped 0 invalid input lines
+
+The partition leaders of each topic are looked up when the first message for
+it is sent, and again after -metadata-refresh, 10 minutes by default, so long
+running producers follow leadership changes. A shorter interval picks them up
+sooner at the cost of more metadata requests, 0 keeps the first leaders found.
+Connections to brokers that still lead partitions are reused on refresh.
+
+The partition count of each topic, which -partitioner hashes keys against, is
+looked up once along with its first leaders and cached, so keys keep mapping
+to the same partitions for the whole run even when leaders are refreshed,
+and routing to many topics via -topic-template doesn't add metadata requests.
+Partitions added while kt is running are therefore not used unless
+-refresh-partitions is given: after that long, the count and leaders are
+looked up again before the next message for the topic, so partitions added in
+the meantime are picked up within one interval, and kt notes the change on
+stderr. Keys may then map to different partitions than before the change.
+
+Each batch is sent as one request per leader broker, and the next batch only
+once all of them are acknowledged, so messages are written to each partition in
+input order. kt doesn't retry failed sends, it stops with the error instead, so
+a failure never reorders messages either, but messages of the failed batch may
+or may not have been written. By default the requests of a batch are sent one
+broker after another. With -order-by-partition they're sent to all brokers
+concurrently, which speeds up batches that span partitions on several brokers
+without changing the order within a partition:
+
+    $ kt produce -topic replay -partitioner hashCode -batch 500 -order-by-partition < events.json
+
+kt sends each request with a synchronous broker.Produce call rather than
+sarama's producers, so there is only ever one request in flight per broker and
+no retries that could overtake an earlier request. That's why
+-order-by-partition neither limits Net.MaxOpenRequests to 1, which only matters
+when requests are pipelined on a broker connection like sarama's asynchronous
+producer does, nor uses sarama's sync producer.
+
+Throughput is then bounded by the slowest broker per batch rather than the sum
+over all brokers, larger batches amortize the round trips. For strict per-key
+ordering, make sure a key always maps to the same partition, e.g. via the key
+in the input or -partitioner hashCode.
+
+By default kt prints the start offset and message count per partition for each
+batch it sends. To record where each message landed, use -report to print one
+line per message instead:
+
+    {"partition": 0, "offset": 3, "key": "id-23", "acks": "all"}
+
+kt waits for all in-sync replicas to acknowledge each request by default. Use
+-acks leader to only wait for the partition leader, or -acks none to not wait
+at all. JSON input can set the level per message via acks, e.g. to fire some
+messages without waiting in tests:
+
+    {"key": "id-23", "value": "ola", "acks": "none"}
+
+Consecutive messages with the same level are sent together, messages of
+different levels one after another so the input order is kept. Brokers don't
+respond to acks none, so the offsets of those messages are unknown and
+reported as -1. The batch output includes the level when it's not all, -report
+includes it for every message.
+
 Examples:
 
 Send a single message with a specific key:
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"testing"
+	"text/template"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/stretchr/testify/require"
 )
@@ -179,6 +188,17 @@ func TestProduceParseArgs(t *testing.T) {
 	}
 }
 
+func TestProduceParseArgsStickySize(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-brokers", "hans:9092", "-partitioner", "sticky"})
+	require.Equal(t, 1, target.batch)
+	require.Equal(t, 100, target.stickySize)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "test-topic", "-brokers", "hans:9092", "-partitioner", "sticky", "-sticky-size", "5"})
+	require.Equal(t, 5, target.stickySize)
+}
+
 func newMessage(key, value string, partition int32) message {
 	var k *string
 	if key != "" {
@@ -197,6 +217,13 @@ func newMessage(key, value string, partition int32) message {
 	}
 }
 
+// newFlagMessage is newMessage for messages partitioned according to -partition.
+func newFlagMessage(key, value string, partition int32) message {
+	msg := newMessage(key, value, partition)
+	msg.partitionFlag = true
+	return msg
+}
+
 func TestMakeSaramaMessage(t *testing.T) {
 	target := &produceCmd{decodeKey: "string", decodeValue: "string"}
 	key, value := "key", "value"
@@ -221,6 +248,28 @@ func TestMakeSaramaMessage(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, []byte("hans"), actual.Key)
 	require.Equal(t, []byte("peter"), actual.Value)
+
+	target.decodeKey, target.decodeValue = "base64url", "base64url"
+	key, value = "-_8=", "-_8"
+	msg = message{Key: &key, Value: &value}
+	actual, err = target.makeSaramaMessage(msg)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0xfb, 0xff}, actual.Key)
+	require.Equal(t, []byte{0xfb, 0xff}, actual.Value)
+
+	target.decodeKey, target.decodeValue = "string", "string"
+	keyCodec, valueCodec := "hex", "base64"
+	key, value = "41", "AAEC"
+	msg = message{Key: &key, Value: &value, KeyCodec: &keyCodec, ValueCodec: &valueCodec}
+	actual, err = target.makeSaramaMessage(msg)
+	require.Nil(t, err)
+	require.Equal(t, []byte("A"), actual.Key)
+	require.Equal(t, []byte{0, 1, 2}, actual.Value)
+
+	invalid := "rot13"
+	msg = message{Key: &key, Value: &value, ValueCodec: &invalid}
+	_, err = target.makeSaramaMessage(msg)
+	require.Error(t, err)
 }
 
 func TestDeserializeLines(t *testing.T) {
@@ -256,7 +305,7 @@ func TestDeserializeLines(t *testing.T) {
 			literal:        true,
 			partition:      2,
 			partitionCount: 4,
-			expected:       newMessage("", `{"other":"json","values":"avail"}`, 2),
+			expected:       newFlagMessage("", `{"other":"json","values":"avail"}`, 2),
 		},
 		{
 			in:             `so lange schon`,
@@ -267,20 +316,755 @@ func TestDeserializeLines(t *testing.T) {
 	}
 
 	for _, d := range data {
-		in := make(chan string, 1)
+		in := make(chan inputLine, 1)
 		out := make(chan message)
 		target.literal = d.literal
 		target.partition = d.partition
+		target.roundRobin = 0
 		go target.deserializeLines(in, out, d.partitionCount)
-		in <- d.in
+		in <- inputLine{text: d.in}
 
 		select {
 		case <-time.After(50 * time.Millisecond):
 			t.Errorf("did not receive output in time")
 		case actual := <-out:
 			if !(reflect.DeepEqual(d.expected, actual)) {
-				t.Errorf(spew.Sprintf("\nexpected %#v\nactual   %#v", d.expected, actual))
+				t.Error(spew.Sprintf("\nexpected %#v\nactual   %#v", d.expected, actual))
+			}
+		}
+	}
+}
+
+func TestSplitKeyValue(t *testing.T) {
+	data := []struct {
+		in       string
+		sep      string
+		expected message
+	}{
+		{in: "id-23:hans", sep: ":", expected: newMessage("id-23", "hans", 0)},
+		{in: `id-23:{"a":"x:y"}`, sep: ":", expected: newMessage("id-23", `{"a":"x:y"}`, 0)},
+		{in: "id-23::", sep: ":", expected: newMessage("id-23", ":", 0)},
+		{in: "id-23 => a => b", sep: " => ", expected: newMessage("id-23", "a => b", 0)},
+		{in: "no separator", sep: ":", expected: newMessage("", "no separator", 0)},
+	}
+
+	for _, d := range data {
+		actual := splitKeyValue(d.in, d.sep)
+		d.expected.Partition = nil
+		require.Equal(t, d.expected, actual, "input %#v", d.in)
+	}
+
+	// empty keys and values are kept as such rather than null
+	actual := splitKeyValue(":", ":")
+	require.Equal(t, "", *actual.Key)
+	require.Equal(t, "", *actual.Value)
+}
+
+func TestDeserializeLinesKeySeparator(t *testing.T) {
+	target := &produceCmd{keySep: "\t", partition: 2}
+	in := make(chan inputLine, 1)
+	out := make(chan message)
+	go target.deserializeLines(in, out, 4)
+	in <- inputLine{text: "hans\tpeter\tpan"}
+	close(in)
+
+	require.Equal(t, newFlagMessage("hans", "peter\tpan", 2), <-out)
+}
+
+func TestJSONKey(t *testing.T) {
+	paths, err := parseKeyPaths("$.user.id, $.items.1.sku,order")
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"user", "id"}, {"items", "1", "sku"}, {"order"}}, paths)
+
+	for _, invalid := range []string{"", "$", "$.a,", "$.a..b"} {
+		_, err := parseKeyPaths(invalid)
+		require.Error(t, err, "input %#v", invalid)
+	}
+
+	composite := `7|b|{"n":1.50}`
+	data := []struct {
+		value    string
+		expected *string
+	}{
+		{
+			value:    `{"user": {"id": 7}, "items": [{"sku": "a"}, {"sku": "b"}], "order": {"n": 1.50}}`,
+			expected: &composite,
+		},
+		{value: `{"user": {"id": "u"}, "items": [{"sku": "a"}], "order": 1}`},
+		{value: `{"user": {"id": null}, "items": [{"sku": "a"}, {"sku": "b"}], "order": 1}`},
+		{value: `{"user": "u", "items": [], "order": 1}`},
+		{value: `not json`},
+	}
+	for _, d := range data {
+		require.Equal(t, d.expected, jsonKey(&d.value, paths, "|"), "input %#v", d.value)
+	}
+	require.Nil(t, jsonKey(nil, paths, "|"))
+}
+
+func TestDeserializeLinesJSONKeyPath(t *testing.T) {
+	paths, err := parseKeyPaths("$.id")
+	require.Nil(t, err)
+	target := &produceCmd{literal: true, partitioner: "hashCode", keyPaths: paths}
+	in := make(chan inputLine, 2)
+	out := make(chan message)
+	go target.deserializeLines(in, out, 4)
+	in <- inputLine{text: `{"id": "id-23"}`}
+	in <- inputLine{text: `{"name": "hans"}`}
+	close(in)
+
+	actual := <-out
+	require.Equal(t, "id-23", *actual.Key)
+	require.Equal(t, hashCodePartition("id-23", 4), *actual.Partition)
+
+	actual = <-out
+	require.Nil(t, actual.Key)
+	require.Equal(t, int32(0), *actual.Partition)
+}
+
+func TestKeyPartition(t *testing.T) {
+	key := "random"
+
+	target := &produceCmd{}
+	require.Equal(t, int32(0), target.keyPartition(&key, 5))
+	require.Equal(t, int32(0), target.keyPartition(nil, 5))
+
+	target.partitioner = "hashCode"
+	require.Equal(t, hashCodePartition(key, 5), target.keyPartition(&key, 5))
+	for _, expected := range []int32{0, 1, 2, 0} {
+		require.Equal(t, expected, target.keyPartition(nil, 3))
+	}
+
+	target = &produceCmd{partitioner: "sticky", batch: 1, stickySize: 2}
+	require.Equal(t, hashCodePartition(key, 5), target.keyPartition(&key, 5))
+	for _, expected := range []int32{0, 0, 1, 1, 2, 2, 0} {
+		require.Equal(t, expected, target.keyPartition(nil, 3))
+	}
+}
+
+func TestCheckNullKey(t *testing.T) {
+	key := "hans"
+	for _, policy := range []string{"", "null", "error"} {
+		target := &produceCmd{nullKey: policy}
+		require.NoError(t, target.checkNullKey(message{Key: &key}))
+		if policy == "error" {
+			require.Error(t, target.checkNullKey(message{}))
+		} else {
+			require.NoError(t, target.checkNullKey(message{}))
+		}
+	}
+}
+
+func TestDeserializeLinesNullKeyPolicy(t *testing.T) {
+	target := &produceCmd{nullKey: "null", partitioner: "hashCode"}
+	in := make(chan inputLine, 2)
+	out := make(chan message)
+	go target.deserializeLines(in, out, 2)
+	in <- inputLine{text: `{"value":"1"}`}
+	in <- inputLine{text: `{"value":"2"}`}
+	close(in)
+
+	for _, expected := range []int32{0, 1} {
+		msg := <-out
+		require.Nil(t, msg.Key)
+		require.Equal(t, expected, *msg.Partition)
+	}
+}
+
+func TestReadFileMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-input-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hans-23.json"), []byte("{\"a\":1}\n"), 0644))
+
+	target := &produceCmd{inputDir: dir, partition: 2}
+	actual, err := target.readFileMessage("hans-23.json", 4)
+	require.NoError(t, err)
+	require.Equal(t, newMessage("hans-23.json", "{\"a\":1}\n", 2), actual)
+
+	target.dirKey = regexp.MustCompile(`^(\w+)-\d+`)
+	target.partitioner = "hashCode"
+	actual, err = target.readFileMessage("hans-23.json", 4)
+	require.NoError(t, err)
+	require.Equal(t, newMessage("hans", "{\"a\":1}\n", hashCodePartition("hans", 4)), actual)
+
+	_, err = target.readFileMessage("peter.json", 4)
+	require.Error(t, err)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err = zw.Write([]byte("{\"b\":2}\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "peter-42.json.gz"), gz.Bytes(), 0644))
+
+	actual, err = target.readFileMessage("peter-42.json.gz", 4)
+	require.NoError(t, err)
+	require.Equal(t, newMessage("peter", "{\"b\":2}\n", hashCodePartition("peter", 4)), actual)
+}
+
+func TestPrintReport(t *testing.T) {
+	target := &produceCmd{}
+	out := make(chan printContext)
+	msgs := []message{newMessage("a", "1", 3), newMessage("", "2", 3)}
+	go target.printReport(out, "ignored", 3, 41, msgs, sarama.WaitForAll)
+
+	for i, m := range msgs {
+		ctx := <-out
+		require.Equal(t, producedMessage{Partition: 3, Offset: 41 + int64(i), Key: m.Key, Acks: "all"}, ctx.output)
+		close(ctx.done)
+	}
+}
+
+func TestPrintReportAcksNone(t *testing.T) {
+	target := &produceCmd{}
+	out := make(chan printContext)
+	msgs := []message{newMessage("a", "1", 3), newMessage("b", "2", 3)}
+	go target.printReport(out, "ignored", 3, -1, msgs, sarama.NoResponse)
+
+	for _, m := range msgs {
+		ctx := <-out
+		require.Equal(t, producedMessage{Partition: 3, Offset: -1, Key: m.Key, Acks: "none"}, ctx.output)
+		close(ctx.done)
+	}
+}
+
+func TestMessageAcks(t *testing.T) {
+	none, leader, typo := "none", "leader", "nope"
+	target := &produceCmd{acks: sarama.WaitForAll}
+	require.Equal(t, sarama.WaitForAll, target.messageAcks(message{}))
+	require.Equal(t, sarama.NoResponse, target.messageAcks(message{Acks: &none}))
+	require.Equal(t, sarama.WaitForLocal, target.messageAcks(message{Acks: &leader}))
+	require.Equal(t, sarama.WaitForAll, target.messageAcks(message{Acks: &typo}))
+
+	_, _, err := target.parseLine(inputLine{text: `{"value": "ola", "acks": "nope"}`}, 1)
+	require.Error(t, err)
+
+	msg, _, err := target.parseLine(inputLine{text: `{"value": "ola", "acks": "leader"}`}, 1)
+	require.NoError(t, err)
+	require.Equal(t, "leader", *msg.Acks)
+}
+
+func TestRouteTopic(t *testing.T) {
+	target := &produceCmd{
+		topicTemplate: template.Must(template.New("topic").Funcs(topicTemplateFuncs).Parse(`events-{{.Key | prefix 3}}`)),
+		leaders:       map[string]map[int32]*sarama.Broker{"events-abc": {0: nil, 1: nil}},
+	}
+
+	msg := newMessage("abcdef", "1", 0)
+	count, err := target.routeTopic(&msg, 5)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), count)
+	require.Equal(t, "events-abc", msg.topic)
+	require.Equal(t, "events-abc", target.messageTopic(msg))
+
+	msg = newMessage("a/b", "1", 0)
+	_, err = target.routeTopic(&msg, 5)
+	require.Error(t, err)
+
+	target.topicTemplate = nil
+	msg = newMessage("abcdef", "1", 0)
+	count, err = target.routeTopic(&msg, 5)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), count)
+	require.Equal(t, "", msg.topic)
+}
+
+func TestPartitionCount(t *testing.T) {
+	target := &produceCmd{
+		leaders:     map[string]map[int32]*sarama.Broker{"events": {0: nil, 1: nil}},
+		refreshPart: time.Hour,
+	}
+	require.Equal(t, int32(2), target.partitionCount("events"))
+
+	// leaders refreshed with an added partition don't change the cached count.
+	target.leaders["events"][2] = nil
+	require.Equal(t, int32(2), target.partitionCount("events"))
+
+	// without a template, -topic's count is looked up rather than passed on.
+	target.topic = "events"
+	msg := newMessage("a", "1", 0)
+	count, err := target.routeTopic(&msg, 5)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), count)
+}
+
+func TestReadValueFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-value-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "value.bin")
+	require.NoError(t, ioutil.WriteFile(path, []byte{0, 1, 2}, 0644))
+
+	msg := message{ValueFile: &path}
+	require.NoError(t, readValueFile(&msg, ""))
+	require.Equal(t, []byte{0, 1, 2}, msg.rawValue)
+
+	target := &produceCmd{decodeValue: "hex"}
+	sm, err := target.makeSaramaMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 1, 2}, sm.Value)
+
+	value := "hans"
+	require.Error(t, readValueFile(&message{Value: &value, ValueFile: &path}, ""))
+
+	missing := filepath.Join(dir, "missing.bin")
+	require.Error(t, readValueFile(&message{ValueFile: &missing}, ""))
+
+	relative := "value.bin"
+	msg = message{ValueFile: &relative}
+	require.NoError(t, readValueFile(&msg, dir))
+	require.Equal(t, []byte{0, 1, 2}, msg.rawValue)
+	require.Error(t, readValueFile(&message{ValueFile: &relative}, ""))
+
+	in := inputLine{text: `{"key": "k", "valueFile": "value.bin"}`, input: filepath.Join(dir, "in.json"), line: 1}
+	msg, _, err = (&produceCmd{}).parseLine(in, 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 1, 2}, msg.rawValue)
+}
+
+func TestInputLinePosition(t *testing.T) {
+	require.Equal(t, "line 3", inputLine{input: "-", line: 3}.position())
+	require.Equal(t, "", inputLine{input: "-", line: 3}.dir())
+	require.Equal(t, "line 7 of in/p0.json", inputLine{input: "in/p0.json", line: 7}.position())
+	require.Equal(t, "in", inputLine{input: "in/p0.json", line: 7}.dir())
+}
+
+func TestManifestMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1.key"), []byte{0xff, 0}, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1.value"), []byte{1, 2}, 0644))
+	manifest := filepath.Join(dir, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`[
+		{"keyFile": "1.key", "valueFile": "1.value"},
+		{"keyFile": "1.key", "partition": 3},
+		{"keyFile": "missing.key"},
+		{"valueFile": "1.value", "headers": {"a": "b"}}
+	]`), 0644))
+
+	entries, err := readManifest(manifest)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	target := &produceCmd{manifestDir: dir, partition: 2, decodeKey: "hex", decodeValue: "hex"}
+	msg, err := target.manifestMessage(0, entries[0], 4)
+	require.NoError(t, err)
+	require.Equal(t, 0, *msg.entry)
+	require.Equal(t, int32(2), *msg.Partition)
+	sm, err := target.makeSaramaMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xff, 0}, sm.Key)
+	require.Equal(t, []byte{1, 2}, sm.Value)
+
+	msg, err = target.manifestMessage(1, entries[1], 4)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), *msg.Partition)
+	require.Nil(t, msg.rawValue)
+	require.Nil(t, msg.Value)
+
+	_, err = target.manifestMessage(2, entries[2], 4)
+	require.Error(t, err)
+	_, err = target.manifestMessage(3, entries[3], 4)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{"keyFile": "1.key"}`), 0644))
+	_, err = readManifest(manifest)
+	require.Error(t, err)
+}
+
+func TestEncodeAvro(t *testing.T) {
+	schema, err := parseAvroSchema(`{"type": "record", "name": "A", "fields": [{"name": "id", "type": "int"}]}`)
+	require.NoError(t, err)
+	target := &produceCmd{keySchema: &avroSchema{typ: "string"}, valueSchema: schema}
+
+	msg, _, err := target.parseLine(inputLine{text: `{"key": "\"k\"", "value": "{\"id\": 1}"}`}, 1)
+	require.NoError(t, err)
+	require.NoError(t, target.encodeAvro(&msg))
+	sm, err := target.makeSaramaMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x02, 'k'}, sm.Key)
+	require.Equal(t, []byte{0x02}, sm.Value)
+
+	msg, _, err = target.parseLine(inputLine{text: `{"key": null, "value": null}`}, 1)
+	require.NoError(t, err)
+	require.NoError(t, target.encodeAvro(&msg))
+	require.Nil(t, msg.rawKey)
+	require.Nil(t, msg.rawValue)
+
+	msg, _, err = target.parseLine(inputLine{text: `{"value": "{\"id\": \"x\"}"}`}, 1)
+	require.NoError(t, err)
+	err = target.encodeAvro(&msg)
+	require.Error(t, err)
+	require.Equal(t, `failed to encode value as Avro: id: expected int, got "x"`, err.Error())
+}
+
+func TestBatchRecordsLinger(t *testing.T) {
+	target := &produceCmd{batch: 100, timeout: time.Hour, linger: 20 * time.Millisecond}
+	in := make(chan message)
+	out := make(chan []message)
+	go target.batchRecords(in, out)
+
+	// a steady stream keeps resetting -timeout, -linger sends the batch anyway.
+	started := time.Now()
+	go func() {
+		for i := 0; i < 10; i++ {
+			in <- newMessage("", "v", 0)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case b := <-out:
+		require.NotEmpty(t, b)
+		require.True(t, len(b) < 10, "expected a partial batch, got %v messages", len(b))
+		require.True(t, time.Since(started) < time.Second)
+	case <-time.After(time.Second):
+		t.Fatal("linger did not send the batch")
+	}
+}
+
+func TestBatchStats(t *testing.T) {
+	var stats batchStats
+	require.Equal(t, "sent no batches", stats.String())
+
+	for _, size := range []int{4, 1, 7} {
+		stats.add(size)
+	}
+	require.Equal(t, batchStats{count: 3, messages: 12, min: 1, max: 7}, stats)
+	require.Equal(t, "sent 12 messages in 3 batches, batch sizes min=1 avg=4.0 max=7", stats.String())
+}
+
+func TestProgress(t *testing.T) {
+	require.Equal(t,
+		"progress: sent 3000 messages in 1m0s, 50.0 messages/s, 100.0 messages/s over the last 10s, skipped 2 invalid input lines",
+		progress(time.Minute, 10*time.Second, 3000, 1000, 2),
+	)
+}
+
+func TestDedupMessages(t *testing.T) {
+	target := &produceCmd{topic: "events"}
+	in := make(chan message, 6)
+	out := make(chan message)
+	for _, m := range []message{
+		newMessage("a", "1", 0),
+		newMessage("b", "1", 0),
+		newMessage("", "x", 0),
+		newMessage("a", "2", 0),
+		newMessage("b", "2", 0),
+		newMessage("b", "", 0), // tombstone
+	} {
+		in <- m
+	}
+	close(in)
+	go target.dedupMessages(in, out)
+
+	actual := []message{}
+	for m := range out {
+		actual = append(actual, m)
+	}
+	require.Equal(t, []message{newMessage("", "x", 0), newMessage("a", "2", 0), newMessage("b", "", 0)}, actual)
+}
+
+func TestExplain(t *testing.T) {
+	key := "id-23"
+	hc := hashCode(key)
+	given := int32(1)
+
+	target := &produceCmd{partitioner: "hashCode", partition: 2}
+	require.Equal(t,
+		partitionExplanation{Key: &key, Partition: hashCodePartition(key, 8), Partitioner: "hashCode", HashCode: &hc},
+		target.explain(message{Key: &key}, 8),
+	)
+	require.Equal(t,
+		partitionExplanation{Key: &key, Partition: 1, Partitioner: "input", HashCode: &hc},
+		target.explain(message{Key: &key, Partition: &given}, 8),
+	)
+	require.Equal(t,
+		partitionExplanation{Partition: 1, Partitioner: "-partition"},
+		target.explain(message{Partition: &given, partitionFlag: true}, 8),
+	)
+	require.Equal(t,
+		partitionExplanation{Partition: 0, Partitioner: "round-robin"},
+		target.explain(message{}, 8),
+	)
+
+	target.partitioner = ""
+	require.Equal(t,
+		partitionExplanation{Key: &key, Partition: 0, Partitioner: "default", HashCode: &hc},
+		target.explain(message{Key: &key}, 8),
+	)
+
+	target.literal = true
+	msg, count, err := target.parseLine(inputLine{text: "hans"}, 8)
+	require.NoError(t, err)
+	require.Equal(t, partitionExplanation{Partition: 2, Partitioner: "-partition"}, target.explain(msg, count))
+}
+
+func TestGenerateMessages(t *testing.T) {
+	target := &produceCmd{generate: 3, valueSize: 8, keyPattern: "seq", partition: 1}
+	q := make(chan struct{})
+	out := make(chan message)
+	go target.generateMessages(q, out, 4)
+
+	var seq int
+	for msg := range out {
+		require.Equal(t, strconv.Itoa(seq), *msg.Key)
+		require.Len(t, msg.rawValue, 8)
+		require.Equal(t, int32(1), *msg.Partition)
+		seq++
+	}
+	require.Equal(t, 3, seq)
+	require.Equal(t, int64(24), target.generatedBytes)
+
+	target.keyPattern = "random"
+	msg, err := target.generateMessage(0)
+	require.Nil(t, err)
+	require.Len(t, *msg.Key, 16)
+
+	target.keyPattern = "const"
+	target.valueTmpl = template.Must(template.New("value").Parse(`{"n": {{.Seq}}, "key": "{{.Key}}"}`))
+	msg, err = target.generateMessage(7)
+	require.Nil(t, err)
+	require.Equal(t, "kt-generate", *msg.Key)
+	require.Equal(t, `{"n": 7, "key": "kt-generate"}`, string(msg.rawValue))
+}
+
+func TestDeserializeLinesContinueOnError(t *testing.T) {
+	target := &produceCmd{decodeKey: "string", decodeValue: "hex", nullKey: "error", contOnError: true}
+	in := make(chan inputLine, 4)
+	out := make(chan message)
+	go target.deserializeLines(in, out, 1)
+	in <- inputLine{text: `{"key": "a", "value": "41"}`}
+	in <- inputLine{text: `{"key": "b", "value": "not hex"}`}
+	in <- inputLine{text: `{"value": "42"}`}
+	in <- inputLine{text: `{"key": "c", "value": "43"}`}
+	close(in)
+
+	var keys []string
+	for msg := range out {
+		keys = append(keys, *msg.Key)
+	}
+	require.Equal(t, []string{"a", "c"}, keys)
+	require.Equal(t, int64(2), target.skipped)
+}
+
+func TestReadFrames(t *testing.T) {
+	in := []byte{0, 0, 0, 4, 'h', 'a', 'n', 's', 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 2, '\n', 0}
+	out := make(chan []byte, 10)
+	require.NoError(t, readFrames(bytes.NewReader(in), 10, out))
+
+	var frames [][]byte
+	for f := range out {
+		frames = append(frames, f)
+	}
+	require.Equal(t, [][]byte{[]byte("hans"), {}, nil, {'\n', 0}}, frames)
+
+	data := []struct {
+		in  []byte
+		err string
+	}{
+		{in: []byte{0, 0, 0, 4, 'h', 'a'}, err: "frame 0: unexpected EOF"},
+		{in: []byte{0, 0, 0, 1, 'h', 0, 0}, err: "frame 1: unexpected EOF"},
+		{in: []byte{0xff, 0xff, 0xff, 0xfe}, err: "frame 0: invalid length -2"},
+		{in: []byte{0, 0, 0, 11}, err: "frame 0: length 11 exceeds the limit of 10 bytes, use -buffersize to raise it"},
+	}
+	for _, d := range data {
+		out := make(chan []byte, 10)
+		err := readFrames(bytes.NewReader(d.in), 10, out)
+		require.EqualError(t, err, d.err, "input %#v", d.in)
+	}
+}
+
+func TestDeserializeFrames(t *testing.T) {
+	target := &produceCmd{keyFrames: true, partitioner: "hashCode"}
+	in := make(chan []byte, 5)
+	out := make(chan message)
+	go target.deserializeFrames(make(chan struct{}), in, out, 4)
+	in <- []byte("id-23")
+	in <- []byte("hans")
+	in <- nil
+	in <- nil
+	in <- []byte("dangling")
+	close(in)
+
+	msg := <-out
+	require.Equal(t, "id-23", *msg.Key)
+	require.Equal(t, []byte("hans"), msg.rawValue)
+	require.Equal(t, hashCodePartition("id-23", 4), *msg.Partition)
+
+	msg = <-out
+	require.Nil(t, msg.Key)
+	require.Nil(t, msg.rawValue)
+
+	_, ok := <-out
+	require.False(t, ok)
+
+	key := "fixed"
+	target = &produceCmd{frameKey: &key, partition: 2}
+	in = make(chan []byte, 1)
+	out = make(chan message)
+	go target.deserializeFrames(make(chan struct{}), in, out, 4)
+	in <- []byte{0}
+	close(in)
+
+	msg = <-out
+	require.Equal(t, "fixed", *msg.Key)
+	require.Equal(t, []byte{0}, msg.rawValue)
+	require.Equal(t, int32(2), *msg.Partition)
+}
+
+func TestCheckMessageFields(t *testing.T) {
+	require.NoError(t, checkMessageFields(`{"key": "a", "value": null, "valueFile": "f", "partition": 1, "keyCodec": "hex", "valueCodec": "hex"}`))
+	require.NoError(t, checkMessageFields(`{}`))
+	require.EqualError(t, checkMessageFields(`{"key": "a", "vlaue": "b", "Partition": 1}`), `unknown fields "Partition", "vlaue"`)
+	require.Error(t, checkMessageFields(`hans`))
+	require.Error(t, checkMessageFields(`["key"]`))
+}
+
+func TestDeserializeLinesStrictInput(t *testing.T) {
+	target := &produceCmd{decodeKey: "string", decodeValue: "string", strictInput: true, contOnError: true}
+	in := make(chan inputLine, 7)
+	out := make(chan message)
+	go target.deserializeLines(in, out, 1)
+	in <- inputLine{text: `{"key": "a", "vlaue": "1"}`}
+	in <- inputLine{text: `not json`}
+	in <- inputLine{text: `null`}
+	in <- inputLine{text: `"hans"`}
+	in <- inputLine{text: `[1, 2]`}
+	in <- inputLine{text: `{"key": "b", "value": 2}`}
+	in <- inputLine{text: `{"key": "c", "value": "3"}`}
+	close(in)
+
+	var keys []string
+	for msg := range out {
+		keys = append(keys, *msg.Key)
+	}
+	require.Equal(t, []string{"c"}, keys)
+	require.Equal(t, int64(6), target.skipped)
+}
+
+func TestMergeLines(t *testing.T) {
+	inputs := [][]string{{"a1", "a2", "a3"}, {"b1"}, {"c1", "c2"}}
+	names := []string{"a.json", "b.json", "-"}
+	merge := func(fair bool) ([]string, []int64) {
+		ins := make([]chan string, len(inputs))
+		for i, lines := range inputs {
+			ins[i] = make(chan string, len(lines))
+			for _, l := range lines {
+				ins[i] <- l
 			}
+			close(ins[i])
+		}
+		counts := make([]int64, len(inputs))
+		out := make(chan inputLine)
+		go mergeLines(ins, names, fair, counts, out)
+		var result []string
+		for l := range out {
+			for i, name := range names {
+				if name == l.input {
+					require.Equal(t, inputs[i][l.line-1], l.text)
+				}
+			}
+			result = append(result, l.text)
+		}
+		return result, counts
+	}
+
+	lines, counts := merge(false)
+	require.Equal(t, []string{"a1", "a2", "a3", "b1", "c1", "c2"}, lines)
+	require.Equal(t, []int64{3, 1, 2}, counts)
+
+	lines, counts = merge(true)
+	require.Equal(t, []string{"a1", "b1", "c1", "a2", "c2", "a3"}, lines)
+	require.Equal(t, []int64{3, 1, 2}, counts)
+}
+
+func TestParseInputs(t *testing.T) {
+	inputs, err := parseInputs("p0.json, p1.json,-")
+	require.NoError(t, err)
+	require.Equal(t, []string{"p0.json", "p1.json", "-"}, inputs)
+
+	_, err = parseInputs("p0.json,,p1.json")
+	require.EqualError(t, err, `invalid -input "p0.json,,p1.json", it contains an empty file name`)
+
+	_, err = parseInputs("-,p0.json,-")
+	require.EqualError(t, err, `invalid -input "-,p0.json,-", stdin can only be read once`)
+
+	require.True(t, boundedInputs("p0.json,p1.json"))
+	require.False(t, boundedInputs("p0.json,-"))
+	require.False(t, boundedInputs(""))
+}
+
+func TestVerifyLanded(t *testing.T) {
+	v := partitionVerification{Key: "id-23", Predicted: 3, Partition: 3, Offset: 17}
+	landed := &sarama.ConsumerMessage{Partition: 3, Offset: 17, Key: []byte("id-23"), Value: []byte(verifyValue)}
+
+	ok, reason := verifyLanded(v, landed)
+	require.True(t, ok)
+	require.Equal(t, "", reason)
+
+	moved := v
+	moved.Partition = 1
+	ok, reason = verifyLanded(moved, &sarama.ConsumerMessage{Partition: 1, Offset: 17, Key: []byte("id-23"), Value: []byte(verifyValue)})
+	require.False(t, ok)
+	require.Equal(t, "landed in partition 1 instead of 3", reason)
+
+	ok, reason = verifyLanded(v, nil)
+	require.False(t, ok)
+	require.Equal(t, "failed to read back the test message", reason)
+
+	ok, reason = verifyLanded(v, &sarama.ConsumerMessage{Partition: 3, Offset: 18, Key: []byte("id-23"), Value: []byte(verifyValue)})
+	require.False(t, ok)
+	require.Equal(t, "read back partition 3 offset 18 instead", reason)
+
+	ok, reason = verifyLanded(v, &sarama.ConsumerMessage{Partition: 3, Offset: 17, Key: []byte("id-42"), Value: []byte(verifyValue)})
+	require.False(t, ok)
+	require.Equal(t, `read back key "id-42" instead`, reason)
+
+	ok, reason = verifyLanded(v, &sarama.ConsumerMessage{Partition: 3, Offset: 17, Key: []byte("id-23"), Value: []byte("other")})
+	require.False(t, ok)
+	require.Equal(t, "read back a value other than the test message's", reason)
+}
+
+func TestVerifyKey(t *testing.T) {
+	var (
+		partitions = int32(8)
+		offset     = int64(0)
+		written    = map[int32]map[int64]*sarama.ConsumerMessage{}
+	)
+	// send picks partitions like the Java producer, as a real broker round
+	// trip via the murmur2 reference partitioner would.
+	send := func(key string) (int32, int64, error) {
+		p, err := murmur2Partitioner{}.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key)}, partitions)
+		if err != nil {
+			return -1, -1, err
+		}
+		offset++
+		if written[p] == nil {
+			written[p] = map[int64]*sarama.ConsumerMessage{}
+		}
+		written[p][offset] = &sarama.ConsumerMessage{Partition: p, Offset: offset, Key: []byte(key), Value: []byte(verifyValue)}
+		return p, offset, nil
+	}
+	read := func(p int32, o int64) *sarama.ConsumerMessage { return written[p][o] }
+
+	target := &produceCmd{partitioner: "hashCode"}
+	result := target.verifyKey("id-23", partitions, send, read)
+	require.Equal(t, hashCodePartition("id-23", partitions), result.Predicted)
+	require.Equal(t, murmur2Partition([]byte("id-23"), partitions), result.Partition)
+	require.NotEqual(t, result.Predicted, result.Partition)
+	require.False(t, result.Match)
+	require.Equal(t, fmt.Sprintf("landed in partition %v instead of %v", result.Partition, result.Predicted), result.Error)
+
+	// keys that happen to hash to the same partition match.
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if hashCodePartition(key, partitions) == murmur2Partition([]byte(key), partitions) {
+			result = target.verifyKey(key, partitions, send, read)
+			require.True(t, result.Match, key)
+			require.Equal(t, "", result.Error)
+			return
 		}
 	}
+	t.Fatal("expected a key that both partitioners agree on")
 }
@@ -1,54 +1,112 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
 
 type topicArgs struct {
-	brokers    string
-	filter     string
-	partitions bool
-	leaders    bool
-	replicas   bool
-	verbose    bool
-	pretty     bool
-	version    string
+	brokers     string
+	filter      string
+	partitions  bool
+	leaders     bool
+	replicas    bool
+	verbose     bool
+	pretty      bool
+	color       string
+	version     string
+	concurrency int
+	rateSample  time.Duration
+	offsetTime  string
+	tls         tlsArgs
 }
 
 type topicCmd struct {
-	brokers    []string
-	filter     *regexp.Regexp
-	partitions bool
-	leaders    bool
-	replicas   bool
-	verbose    bool
-	pretty     bool
-	version    sarama.KafkaVersion
-
-	client sarama.Client
+	brokers     []string
+	filter      *regexp.Regexp
+	partitions  bool
+	leaders     bool
+	replicas    bool
+	verbose     bool
+	pretty      bool
+	color       bool
+	version     sarama.KafkaVersion
+	concurrency int
+	rateSample  time.Duration
+	offsetTimes []partitionOffset
+	tlsConfig   *tls.Config
+
+	client  sarama.Client
+	offsets chan struct{}
 }
 
 type topic struct {
 	Name       string      `json:"name"`
+	Rate       *float64    `json:"estimatedRate,omitempty"`
 	Partitions []partition `json:"partitions,omitempty"`
 }
 
 type partition struct {
-	Id           int32   `json:"id"`
-	OldestOffset int64   `json:"oldest"`
-	NewestOffset int64   `json:"newest"`
-	Leader       string  `json:"leader,omitempty"`
-	Replicas     []int32 `json:"replicas,omitempty"`
-	ISRs         []int32 `json:"isrs,omitempty"`
+	Id           int32    `json:"id"`
+	OldestOffset int64    `json:"oldest"`
+	NewestOffset int64    `json:"newest"`
+	Leader       string   `json:"leader,omitempty"`
+	Replicas     []int32  `json:"replicas,omitempty"`
+	ISRs         []int32  `json:"isrs,omitempty"`
+	Rate         *float64 `json:"estimatedRate,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+type partitionOffset struct {
+	partition int32
+	offset    int64
+}
+
+type offsetTime struct {
+	Topic     string     `json:"topic"`
+	Partition int32      `json:"partition"`
+	Offset    int64      `json:"offset"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// offsetTimeout bounds how long kt waits for the message at an offset that
+// passed the watermark check.
+const offsetTimeout = 10 * time.Second
+
+// parseOffsetTimes parses comma separated partition=offset pairs.
+func parseOffsetTimes(str string) ([]partitionOffset, error) {
+	result := []partitionOffset{}
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid partition=offset pair %#v", pair)
+		}
+
+		p, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid partition %#v", parts[0])
+		}
+
+		o, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || o < 0 {
+			return nil, fmt.Errorf("invalid offset %#v", parts[1])
+		}
+
+		result = append(result, partitionOffset{partition: int32(p), offset: o})
+	}
+	return result, nil
 }
 
 func (cmd *topicCmd) parseFlags(as []string) topicArgs {
@@ -64,14 +122,36 @@ func (cmd *topicCmd) parseFlags(as []string) topicArgs {
 	flags.StringVar(&args.filter, "filter", "", "Regex to filter topics by name.")
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
-	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+	addColorFlag(flags, &args.color)
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version, or auto to probe the brokers for it (defaults to v0.10.0.0).")
+	flags.IntVar(&args.concurrency, "concurrency", defaultOffsetConcurrency, "Max number of concurrent offset requests when reading partitions.")
+	addTLSFlags(flags, &args.tls)
+	flags.StringVar(&args.offsetTime, "offset-time", "", "Comma separated partition=offset pairs to print the timestamps of the messages at, instead of topic information.")
+	flags.DurationVar(&args.rateSample, "rate-sample", 0, "Sample newest offsets twice this far apart to estimate produce rates in messages/sec (default 0 to disable).")
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of topic:")
 		flags.PrintDefaults()
-		fmt.Fprintln(os.Stderr, `
+		fmt.Fprint(os.Stderr, `
 The values for -brokers can also be set via the environment variable KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
+
+With -rate-sample kt reads the newest offsets twice, the given duration apart,
+and reports the difference per second as "estimatedRate" for each topic, and
+for each partition when combined with -partitions. These are rough estimates
+of the produce rate in messages per second: they don't account for compaction
+or transaction markers and only reflect the sampled window.
+
+With -offset-time kt prints the timestamp of the message at each of the given
+offsets instead, by consuming that single message. For example, to see when
+offset 12345 of partition 0 of topic events was written:
+
+  kt topic -filter '^events$' -offset-time 0=12345 -version v0.10.0.0
+
+This prints one JSON object per topic and pair. If there is no message at the
+offset, e.g. due to compaction, the timestamp of the next message is printed
+along with its offset. Timestamps require -version v0.10.0.0 or later.
 `)
+		fmt.Fprintln(os.Stderr, tlsDocString)
 		os.Exit(2)
 	}
 
@@ -94,11 +174,8 @@ func (cmd *topicCmd) parseArgs(as []string) {
 			args.brokers = "localhost:9092"
 		}
 	}
-	cmd.brokers = strings.Split(args.brokers, ",")
-	for i, b := range cmd.brokers {
-		if !strings.Contains(b, ":") {
-			cmd.brokers[i] = b + ":9092"
-		}
+	if cmd.brokers, err = parseBrokers(args.brokers); err != nil {
+		failf("%v", err)
 	}
 
 	if re, err = regexp.Compile(args.filter); err != nil {
@@ -110,8 +187,30 @@ func (cmd *topicCmd) parseArgs(as []string) {
 	cmd.leaders = args.leaders
 	cmd.replicas = args.replicas
 	cmd.pretty = args.pretty
+	if cmd.color, err = resolveColor(args.color); err != nil {
+		failf("%v", err)
+	}
 	cmd.verbose = args.verbose
-	cmd.version = kafkaVersion(args.version)
+
+	if args.concurrency < 1 {
+		failf("concurrency should be at least 1, got %v", args.concurrency)
+	}
+	cmd.concurrency = args.concurrency
+	cmd.rateSample = args.rateSample
+
+	if cmd.tlsConfig, err = newTLSConfig(args.tls); err != nil {
+		failf("%v", err)
+	}
+	cmd.version = resolveKafkaVersion(args.version, cmd.brokers, cmd.tlsConfig)
+
+	if args.offsetTime != "" {
+		if cmd.offsetTimes, err = parseOffsetTimes(args.offsetTime); err != nil {
+			failf("invalid -offset-time err=%v", err)
+		}
+		if !cmd.version.IsAtLeast(sarama.V0_10_0_0) {
+			failf("-offset-time requires -version v0.10.0.0 or later for message timestamps")
+		}
+	}
 }
 
 func (cmd *topicCmd) connect() {
@@ -127,6 +226,7 @@ func (cmd *topicCmd) connect() {
 		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-topic-" + sanitizeUsername(usr.Username)
+	applyTLS(cfg, cmd.tlsConfig)
 	if cmd.verbose {
 		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
 	}
@@ -150,6 +250,7 @@ func (cmd *topicCmd) run(as []string) {
 
 	cmd.connect()
 	defer cmd.client.Close()
+	cmd.offsets = make(chan struct{}, cmd.concurrency)
 
 	if all, err = cmd.client.Topics(); err != nil {
 		failf("failed to read topics err=%v", err)
@@ -162,13 +263,17 @@ func (cmd *topicCmd) run(as []string) {
 		}
 	}
 
-	go print(out, cmd.pretty)
+	go print(out, cmd.pretty, cmd.color)
 
 	var wg sync.WaitGroup
 	for _, tn := range topics {
 		wg.Add(1)
 		go func(top string) {
-			cmd.print(top, out)
+			if len(cmd.offsetTimes) > 0 {
+				cmd.printOffsetTimes(top, out)
+			} else {
+				cmd.print(top, out)
+			}
 			wg.Done()
 		}(tn)
 	}
@@ -191,6 +296,89 @@ func (cmd *topicCmd) print(name string, out chan printContext) {
 	<-ctx.done
 }
 
+func (cmd *topicCmd) printOffsetTimes(name string, out chan printContext) {
+	consumer, err := sarama.NewConsumerFromClient(cmd.client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create consumer for topic %s. err=%v\n", name, err)
+		return
+	}
+	defer logClose("consumer", consumer)
+
+	ps := []int32{}
+	for _, po := range cmd.offsetTimes {
+		ps = append(ps, po.partition)
+	}
+	marks := fetchWatermarks(cmd.client, name, ps, cmd.offsets)
+
+	for _, po := range cmd.offsetTimes {
+		ctx := printContext{output: readOffsetTime(consumer, name, po, marks[po.partition]), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
+}
+
+// readOffsetTime consumes the message at po, or the next one after it, and
+// returns its timestamp. Offsets outside of wm are reported as errors rather
+// than waiting for a message that may never arrive.
+func readOffsetTime(consumer sarama.Consumer, topic string, po partitionOffset, wm watermarks) offsetTime {
+	result := offsetTime{Topic: topic, Partition: po.partition, Offset: po.offset}
+
+	if wm.err != nil {
+		result.Error = wm.err.Error()
+		return result
+	}
+	if po.offset < wm.oldest || po.offset >= wm.newest {
+		result.Error = fmt.Sprintf("offset out of range [%v, %v)", wm.oldest, wm.newest)
+		return result
+	}
+
+	pc, err := consumer.ConsumePartition(topic, po.partition, po.offset)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer logClose(fmt.Sprintf("partition consumer %v", po.partition), pc)
+
+	select {
+	case msg := <-pc.Messages():
+		result.Offset = msg.Offset
+		if !msg.Timestamp.IsZero() {
+			result.Timestamp = &msg.Timestamp
+		}
+	case err := <-pc.Errors():
+		result.Error = err.Error()
+	case <-time.After(offsetTimeout):
+		result.Error = fmt.Sprintf("timed out after %s waiting for message", offsetTimeout)
+	}
+
+	return result
+}
+
+// sampleRates waits for cmd.rateSample after the given watermarks were read and
+// estimates the produce rate per partition, and for the whole topic, from the
+// growth of the newest offsets.
+func (cmd *topicCmd) sampleRates(name string, ps []int32, before map[int32]watermarks) (map[int32]float64, *float64) {
+	start := time.Now()
+	time.Sleep(cmd.rateSample)
+	after := fetchWatermarks(cmd.client, name, ps, cmd.offsets)
+	secs := time.Since(start).Seconds()
+
+	var (
+		total float64
+		rates = map[int32]float64{}
+	)
+	for _, p := range ps {
+		b, a := before[p], after[p]
+		if b.err != nil || a.err != nil {
+			continue
+		}
+		rates[p] = float64(a.newest-b.newest) / secs
+		total += rates[p]
+	}
+
+	return rates, &total
+}
+
 func (cmd *topicCmd) readTopic(name string) (topic, error) {
 	var (
 		err error
@@ -199,7 +387,7 @@ func (cmd *topicCmd) readTopic(name string) (topic, error) {
 		top = topic{Name: name}
 	)
 
-	if !cmd.partitions {
+	if !cmd.partitions && cmd.rateSample == 0 {
 		return top, nil
 	}
 
@@ -207,15 +395,28 @@ func (cmd *topicCmd) readTopic(name string) (topic, error) {
 		return top, err
 	}
 
+	marks := fetchWatermarks(cmd.client, name, ps, cmd.offsets)
+
+	var rates map[int32]float64
+	if cmd.rateSample > 0 {
+		rates, top.Rate = cmd.sampleRates(name, ps, marks)
+	}
+
+	if !cmd.partitions {
+		return top, nil
+	}
+
 	for _, p := range ps {
 		np := partition{Id: p}
 
-		if np.OldestOffset, err = cmd.client.GetOffset(name, p, sarama.OffsetOldest); err != nil {
-			return top, err
+		if wm := marks[p]; wm.err != nil {
+			np.Error = wm.err.Error()
+		} else {
+			np.OldestOffset, np.NewestOffset = wm.oldest, wm.newest
 		}
 
-		if np.NewestOffset, err = cmd.client.GetOffset(name, p, sarama.OffsetNewest); err != nil {
-			return top, err
+		if r, ok := rates[p]; ok {
+			np.Rate = &r
 		}
 
 		if cmd.leaders {
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTopicParseArgs(t *testing.T) {
@@ -48,3 +53,86 @@ func TestTopicParseArgs(t *testing.T) {
 		return
 	}
 }
+
+type tOffsetClient struct {
+	sarama.Client
+	latency time.Duration
+	errs    map[int32]error
+}
+
+func (c tOffsetClient) GetOffset(topic string, partition int32, at int64) (int64, error) {
+	if c.latency > 0 {
+		<-time.After(c.latency)
+	}
+	if err, ok := c.errs[partition]; ok {
+		return 0, err
+	}
+	if at == sarama.OffsetOldest {
+		return int64(partition), nil
+	}
+	return int64(partition) * 10, nil
+}
+
+func (c tOffsetClient) Partitions(topic string) ([]int32, error) {
+	return []int32{0, 1, 2, 3}, nil
+}
+
+func TestReadTopicPartitionErrors(t *testing.T) {
+	target := &topicCmd{
+		partitions: true,
+		client:     tOffsetClient{errs: map[int32]error{2: sarama.ErrNotLeaderForPartition}},
+		offsets:    make(chan struct{}, 2),
+	}
+
+	actual, err := target.readTopic("hans")
+	require.NoError(t, err)
+
+	expected := topic{
+		Name: "hans",
+		Partitions: []partition{
+			{Id: 0, OldestOffset: 0, NewestOffset: 0},
+			{Id: 1, OldestOffset: 1, NewestOffset: 10},
+			{Id: 2, Error: sarama.ErrNotLeaderForPartition.Error()},
+			{Id: 3, OldestOffset: 3, NewestOffset: 30},
+		},
+	}
+	require.Equal(t, expected, actual)
+}
+
+func BenchmarkFetchWatermarks(b *testing.B) {
+	partitions := make([]int32, 64)
+	for i := range partitions {
+		partitions[i] = int32(i)
+	}
+	client := tOffsetClient{latency: time.Millisecond}
+
+	for _, concurrency := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			limit := make(chan struct{}, concurrency)
+			for i := 0; i < b.N; i++ {
+				fetchWatermarks(client, "hans", partitions, limit)
+			}
+		})
+	}
+}
+
+func TestParseOffsetTimes(t *testing.T) {
+	actual, err := parseOffsetTimes("0=12345, 3=0")
+	require.NoError(t, err)
+	require.Equal(t, []partitionOffset{{partition: 0, offset: 12345}, {partition: 3, offset: 0}}, actual)
+
+	for _, in := range []string{"", "0", "0=", "a=1", "0=b", "-1=2", "0=-2", "0=1=2"} {
+		_, err := parseOffsetTimes(in)
+		require.Error(t, err, "input %#v", in)
+	}
+}
+
+func TestReadOffsetTimeOutOfRange(t *testing.T) {
+	po := partitionOffset{partition: 1, offset: 10}
+
+	actual := readOffsetTime(nil, "events", po, watermarks{oldest: 2, newest: 10})
+	require.Equal(t, offsetTime{Topic: "events", Partition: 1, Offset: 10, Error: "offset out of range [2, 10)"}, actual)
+
+	actual = readOffsetTime(nil, "events", po, watermarks{err: sarama.ErrUnknownTopicOrPartition})
+	require.Equal(t, sarama.ErrUnknownTopicOrPartition.Error(), actual.Error)
+}